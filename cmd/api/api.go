@@ -11,7 +11,9 @@ import (
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/wtran29/go-ecommerce/internal/cards"
 	"github.com/wtran29/go-ecommerce/internal/driver"
+	"github.com/wtran29/go-ecommerce/internal/events"
 	"github.com/wtran29/go-ecommerce/internal/models"
 )
 
@@ -21,11 +23,14 @@ type config struct {
 	port int
 	env  string
 	db   struct {
-		dsn string
+		dsn         string
+		automigrate bool
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret  string
+		key     string
+		gateway string
+		webhook string
 	}
 	smtp struct {
 		host     string
@@ -33,15 +38,23 @@ type config struct {
 		username string
 		password string
 	}
-	secretkey string
-	frontend  string // address for front end
+	idempotency struct {
+		ttl time.Duration
+	}
+	taxRate    int    // basis points, 825 is 8.25%
+	currency   string // currency every payment is taken in
+	secretkey  string
+	frontend   string // address for front end
+	invoiceURL string // address of the invoice service
 }
 
 type application struct {
 	config  config
 	logger  *slog.Logger
 	version string
-	DB      models.DBModel
+	DB      models.Repository
+	Gateway cards.PaymentGateway
+	Events  events.Bus
 }
 
 func (app *application) serve() error {
@@ -72,26 +85,53 @@ func main() {
 	flag.IntVar(&cfg.smtp.port, "smtpport", smptport, "smtp port")
 	flag.StringVar(&cfg.secretkey, "secret", fmt.Sprintf("%v", os.Getenv("SKEY")), "secret key")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "url for frontend")
+	flag.StringVar(&cfg.invoiceURL, "invoice-url", "http://localhost:5000", "url of the invoice service")
+	flag.IntVar(&cfg.taxRate, "taxrate", 0, "Sales tax rate in basis points")
+	flag.StringVar(&cfg.currency, "currency", "usd", "Currency payments are taken in")
+	flag.DurationVar(&cfg.idempotency.ttl, "idempotency-ttl", 24*time.Hour, "How long idempotency keys are remembered")
+	flag.StringVar(&cfg.stripe.gateway, "gateway", "stripe", "Payment gateway {stripe|fake}")
+	flag.BoolVar(&cfg.db.automigrate, "automigrate", false, "Apply pending database migrations on startup")
 
 	flag.Parse()
 
 	cfg.stripe.key = os.Getenv("STRIPE_KEY")
 	cfg.stripe.secret = os.Getenv("STRIPE_SECRET")
+	cfg.stripe.webhook = os.Getenv("STRIPE_WEBHOOK_SECRET")
 
 	jsonLogger := slog.NewJSONHandler(os.Stdout, nil)
 	logger := slog.New(jsonLogger)
 
+	gateway, err := cards.NewGateway(cfg.stripe.gateway, cfg.stripe.secret, cfg.stripe.key)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	conn, err := driver.OpenDB(cfg.db.dsn)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
 
+	db := &models.DBModel{DB: conn}
+
 	app := &application{
 		config:  cfg,
 		logger:  logger,
 		version: version,
-		DB:      models.DBModel{DB: conn},
+		DB:      db,
+		Gateway: gateway,
+		Events:  events.NewPostgres(conn, logger),
+	}
+
+	if cfg.db.automigrate {
+		applied, err := db.MigrateUp()
+		if err != nil {
+			app.logger.Error("Error migrating database", "error", err)
+			log.Fatal(err)
+		}
+		for _, mg := range applied {
+			app.logger.Info(fmt.Sprintf("Applied migration %06d_%s", mg.Version, mg.Name))
+		}
 	}
 
 	// encryptKey, _ := app.GenerateEncryptionKey(16)
@@ -99,7 +139,7 @@ func main() {
 
 	err = app.serve()
 	if err != nil {
-		app.logger.Error("Error starting backend server", err)
+		app.logger.Error("Error starting backend server", "error", err)
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// apiKey gives user an api key with scopes
+func apiKey(t *testing.T, ta *testApp, user models.User, scopes ...string) string {
+	t.Helper()
+
+	key, err := models.GenerateAPIKey(user.ID, "test", scopes, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ta.db.InsertToken(key, user); err != nil {
+		t.Fatal(err)
+	}
+	return key.PlainText
+}
+
+func TestCheckAuthentication(t *testing.T) {
+	ta := newTestApp(t)
+	user, session := ta.signIn(t, models.RoleOwner)
+
+	challenge, err := models.GenerateToken(user.ID, 5*time.Minute, models.ScopeTwoFactor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ta.db.InsertToken(challenge, user); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"session token", session, http.StatusOK},
+		{"two-factor challenge", challenge.PlainText, http.StatusUnauthorized},
+		{"api key", apiKey(t, ta, user, models.KeyScopeOrdersRead), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		resp := ta.do(t, "POST", "/api/is-authenticated", nil, nil, "Authorization", "Bearer "+tt.token)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+	}
+}
+
+func TestResendInvoiceLinkScope(t *testing.T) {
+	ta := newTestApp(t)
+	user, _ := ta.signIn(t, models.RoleOwner)
+
+	key := apiKey(t, ta, user, models.KeyScopeOrdersRead)
+	resp := ta.do(t, "POST", "/api/admin/get-sale/1/resend-invoice-link", nil, nil, "Authorization", "Bearer "+key)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("read only key: status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestLoginLockoutIgnoresEmailCase(t *testing.T) {
+	ta := newTestApp(t)
+	user, _ := ta.signIn(t, models.RoleOwner)
+
+	login := func(email string) int {
+		resp := ta.do(t, "POST", "/api/authenticate", map[string]string{"email": email, "password": "wrong"}, nil)
+		return resp.StatusCode
+	}
+
+	// a failure under one spelling delays the next attempt under another
+	if status := login("  " + strings.ToUpper(user.Email) + "\t"); status == http.StatusTooManyRequests {
+		t.Fatalf("first attempt: status %d", status)
+	}
+	if status := login(user.Email); status != http.StatusTooManyRequests {
+		t.Errorf("next attempt straight after: status %d, want 429", status)
+	}
+
+	// failures under many spellings add up to one lockout
+	variants := []string{user.Email, strings.ToUpper(user.Email), " " + user.Email, user.Email + "\n", "\t" + strings.ToUpper(user.Email[:1]) + user.Email[1:]}
+	for _, email := range variants {
+		if _, err := ta.db.RecordFailure(models.AccountKey(email), models.AccountPolicy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	until, err := ta.db.LockedUntil(models.AccountKey(user.Email))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Until(until) < models.AccountPolicy.Lockout-time.Minute {
+		t.Errorf("after %d failures under different spellings the account is locked until %s, want about %s from now",
+			len(variants)+1, until, models.AccountPolicy.Lockout)
+	}
+	for _, email := range variants {
+		if status := login(email); status != http.StatusTooManyRequests {
+			t.Errorf("login as %q while locked out: status %d, want 429", email, status)
+		}
+	}
+}
+
+func TestTwoFactorCodesThrottled(t *testing.T) {
+	for _, path := range []string{"/api/admin/two-factor/recovery-codes", "/api/admin/two-factor/disable"} {
+		t.Run(path, func(t *testing.T) {
+			ta := newTestApp(t)
+			user, token := ta.signIn(t, models.RoleOwner)
+			if err := ta.db.SetTwoFactorSecret(user.ID, "not-a-real-secret"); err != nil {
+				t.Fatal(err)
+			}
+			if err := ta.db.EnableTwoFactor(user.ID, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			resp := ta.do(t, "POST", path, map[string]string{"code": "000000"}, nil, "Authorization", "Bearer "+token)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("wrong code: status %d, want 400", resp.StatusCode)
+			}
+			resp = ta.do(t, "POST", path, map[string]string{"code": "000001"}, nil, "Authorization", "Bearer "+token)
+			if resp.StatusCode != http.StatusTooManyRequests {
+				t.Errorf("next guess straight after: status %d, want 429", resp.StatusCode)
+			}
+
+			tf, err := ta.db.GetTwoFactor(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tf.Enabled {
+				t.Errorf("two-factor authentication was turned off")
+			}
+		})
+	}
+}
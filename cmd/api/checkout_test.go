@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/wtran29/go-ecommerce/internal/cards"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// checkout runs a cart checkout the way the browser does: price the cart into a
+// payment intent, confirm it with a card, then record the order
+func checkout(t *testing.T, ta *testApp, card string) (*http.Response, jsonResponse) {
+	t.Helper()
+
+	itemID := ta.db.AddItem(models.Item{Name: "Widget", Price: 1250})
+
+	var cart cartResponse
+	resp := ta.do(t, "POST", "/api/cart", map[string]any{
+		"lines": []models.CartLine{{ItemID: itemID, Quantity: 2}},
+	}, &cart)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("create cart: status %d", resp.StatusCode)
+	}
+
+	var pi stripe.PaymentIntent
+	resp = ta.do(t, "POST", "/api/payment-intent", map[string]any{"cart_token": cart.Token}, &pi)
+	if resp.StatusCode != http.StatusOK || pi.ID == "" {
+		t.Fatalf("payment intent: status %d, id %q", resp.StatusCode, pi.ID)
+	}
+	if pi.Amount != 2500 {
+		t.Fatalf("payment intent amount = %d, want 2500", pi.Amount)
+	}
+
+	// the browser confirms the intent with Stripe.js; the fake takes it from its hook
+	ta.do(t, "POST", "/api/fake-gateway/payment-intents/"+pi.ID+"/confirm", map[string]string{"payment_method": card}, nil)
+
+	var out jsonResponse
+	resp = ta.do(t, "POST", "/api/cart/"+cart.Token+"/checkout", map[string]string{
+		"first_name":     "Jane",
+		"last_name":      "Doe",
+		"email":          "jane@example.com",
+		"payment_intent": pi.ID,
+		"payment_method": card,
+	}, &out)
+	return resp, out
+}
+
+func TestCheckoutCart(t *testing.T) {
+	ta := newTestApp(t)
+
+	resp, out := checkout(t, ta, cards.FakeCardVisa)
+	if resp.StatusCode != http.StatusCreated || !out.OK {
+		t.Fatalf("checkout: status %d, %+v", resp.StatusCode, out)
+	}
+
+	order, err := ta.db.GetOrderByID(out.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Amount != 2500 || order.StatusID != models.OrderPaid {
+		t.Errorf("order amount %d, status %s; want 2500, Paid", order.Amount, order.StatusID)
+	}
+	if order.Transaction.LastFour != "4242" {
+		t.Errorf("order card ends in %q, want 4242", order.Transaction.LastFour)
+	}
+}
+
+func TestCheckoutCartDeclined(t *testing.T) {
+	ta := newTestApp(t)
+
+	resp, _ := checkout(t, ta, cards.FakeCardDeclined)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("checkout with a declined card: status %d, want 400", resp.StatusCode)
+	}
+
+	orders, _, _, err := ta.db.GetAllOrdersPaginated(false, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 0 {
+		t.Errorf("%d orders recorded for a declined card", len(orders))
+	}
+}
+
+func TestCheckoutCartOtherPaymentIntent(t *testing.T) {
+	ta := newTestApp(t)
+	resp, out := checkout(t, ta, cards.FakeCardVisa)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("checkout: status %d, %+v", resp.StatusCode, out)
+	}
+	order, err := ta.db.GetOrderByID(out.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if order.Transaction.PaymentIntent == "" {
+		t.Fatal("order has no payment intent")
+	}
+
+	// a cart for the same amount cannot be checked out with the intent that paid the first
+	itemID := ta.db.AddItem(models.Item{Name: "Gadget", Price: 2500})
+	var cart cartResponse
+	ta.do(t, "POST", "/api/cart", map[string]any{"lines": []models.CartLine{{ItemID: itemID, Quantity: 1}}}, &cart)
+	resp = ta.do(t, "POST", "/api/cart/"+cart.Token+"/checkout", map[string]string{
+		"first_name":     "Jane",
+		"last_name":      "Doe",
+		"email":          "jane@example.com",
+		"payment_intent": order.Transaction.PaymentIntent,
+		"payment_method": cards.FakeCardVisa,
+	}, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("checkout with another cart's intent: status %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestVirtualTerminalPaymentReused(t *testing.T) {
+	ta := newTestApp(t)
+	_, token := ta.signIn(t, models.RoleOwner)
+	auth := []string{"Authorization", "Bearer " + token}
+
+	var pi stripe.PaymentIntent
+	ta.do(t, "POST", "/api/admin/virtual-terminal-payment-intent", map[string]any{"amount": 1000}, &pi, auth...)
+	ta.do(t, "POST", "/api/fake-gateway/payment-intents/"+pi.ID+"/confirm", map[string]string{"payment_method": cards.FakeCardVisa}, nil)
+	if pi.Currency != "usd" {
+		t.Errorf("intent currency = %s, want the configured usd", pi.Currency)
+	}
+
+	body := map[string]any{
+		"amount":         1000,
+		"email":          "jane@example.com",
+		"payment_intent": pi.ID,
+		"payment_method": cards.FakeCardVisa,
+	}
+	resp := ta.do(t, "POST", "/api/admin/virtual-terminal-succeeded", body, nil, auth...)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first use: status %d", resp.StatusCode)
+	}
+	resp = ta.do(t, "POST", "/api/admin/virtual-terminal-succeeded", body, nil, auth...)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("second use: status %d, want 400", resp.StatusCode)
+	}
+
+	recs, err := ta.db.GetUnresolvedReconciliations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 0 {
+		t.Errorf("a reused intent was recorded for reconciliation")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wtran29/go-ecommerce/internal/events"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// recordedEvents is a bus that keeps what is published
+type recordedEvents struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (b *recordedEvents) Publish(_ context.Context, e events.Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.events = append(b.events, e)
+	return nil
+}
+
+func (b *recordedEvents) Subscribe(ctx context.Context, _ func(events.Event)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// ofType returns the events of one type published so far
+func (b *recordedEvents) ofType(typ string) []events.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var found []events.Event
+	for _, e := range b.events {
+		if e.Type == typ {
+			found = append(found, e)
+		}
+	}
+	return found
+}
+
+func TestDashboard(t *testing.T) {
+	ta := newTestApp(t)
+	bus := &recordedEvents{}
+	ta.Events = bus
+	_, token := ta.signIn(t, models.RoleReadOnly)
+	auth := []string{"Authorization", "Bearer " + token}
+	_, ownerToken := ta.signIn(t, models.RoleOwner)
+
+	stats := func() models.DashboardStats {
+		t.Helper()
+		var s models.DashboardStats
+		resp := ta.do(t, "GET", "/api/admin/dashboard?tz=America/Chicago", nil, &s, auth...)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("dashboard: status %d", resp.StatusCode)
+		}
+		return s
+	}
+
+	if s := stats(); s.Revenue != 0 || s.Orders != 0 || s.Refunds != 0 {
+		t.Errorf("with no sales the dashboard shows %+v", s)
+	}
+
+	id, _ := chargedOrder(t, ta, 2500)
+	chargedOrder(t, ta, 1000)
+	s := stats()
+	if s.Revenue != 3500 || s.Orders != 2 {
+		t.Errorf("after two sales revenue is %d from %d orders, want 3500 from 2", s.Revenue, s.Orders)
+	}
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since := s.Since.In(chicago); since.Hour() != 0 || since.Minute() != 0 || time.Since(since) > 24*time.Hour {
+		t.Errorf("the day starts at %s, want the last midnight in America/Chicago", since)
+	}
+
+	resp := ta.do(t, "POST", "/api/admin/refund", map[string]any{"id": id, "amount": 2500}, nil, "Authorization", "Bearer "+ownerToken)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("refund: status %d", resp.StatusCode)
+	}
+	s = stats()
+	if s.Refunds != 1 || s.RefundedAmount != 2500 || s.Revenue != 3500 {
+		t.Errorf("after a refund the dashboard shows %+v, want 1 refund of 2500 and revenue unchanged", s)
+	}
+
+	// the refund tells every web instance, which has the dashboard fetch the figures again
+	updated := bus.ofType(events.OrderUpdated)
+	if len(updated) != 1 || updated[0].OrderID != id || updated[0].StatusID != int(models.OrderRefunded) {
+		t.Errorf("published order updates %+v, want one for order %d becoming Refunded", updated, id)
+	}
+
+	resp = ta.do(t, "GET", "/api/admin/dashboard?tz=Nowhere/Special", nil, nil, auth...)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("unknown time zone: status %d, want 400", resp.StatusCode)
+	}
+}
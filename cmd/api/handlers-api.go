@@ -1,39 +1,41 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/stripe/stripe-go/v76"
 	"github.com/wtran29/go-ecommerce/internal/cards"
 	"github.com/wtran29/go-ecommerce/internal/encryption"
+	"github.com/wtran29/go-ecommerce/internal/events"
 	"github.com/wtran29/go-ecommerce/internal/models"
+	"github.com/wtran29/go-ecommerce/internal/netutil"
 	"github.com/wtran29/go-ecommerce/internal/urlsigner"
 	"github.com/wtran29/go-ecommerce/internal/validator"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type stripePayload struct {
-	Currency      string `json:"currency"`
-	Amount        string `json:"amount"`
-	PaymentMethod string `json:"payment_method"`
-	Email         string `json:"email"`
-	Cardbrand     string `json:"card_brand"`
-	ExpiryMonth   int    `json:"exp_month"`
-	ExpiryYear    int    `json:"exp_year"`
-	LastFour      string `json:"last_four"`
-	Plan          string `json:"plan"`
-	ProductID     string `json:"product_id"`
-	FirstName     string `json:"first_name"`
-	LastName      string `json:"last_name"`
+	Amount        string            `json:"amount"`
+	PaymentMethod string            `json:"payment_method"`
+	Email         string            `json:"email"`
+	Cardbrand     string            `json:"card_brand"`
+	ExpiryMonth   int               `json:"exp_month"`
+	ExpiryYear    int               `json:"exp_year"`
+	LastFour      string            `json:"last_four"`
+	Plan          string            `json:"plan"`
+	ProductID     string            `json:"product_id"`
+	FirstName     string            `json:"first_name"`
+	LastName      string            `json:"last_name"`
+	Quantity      int               `json:"quantity"`
+	CartToken     string            `json:"cart_token"`
+	Lines         []models.CartLine `json:"lines"`
+	Coupon        string            `json:"coupon"`
 }
 
 type jsonResponse struct {
@@ -43,63 +45,95 @@ type jsonResponse struct {
 	ID      int    `json:"id,omitempty"`
 }
 
+// transaction statuses
 const (
-	Cleared   = 1
-	Refunded  = 2
-	Cancelled = 3
+	TransactionPending  = 1
+	TransactionCleared  = 2
+	TransactionDeclined = 3
+	TransactionRefunded = 4
 )
 
 func (app *application) GetPaymentIntent(w http.ResponseWriter, r *http.Request) {
 	var payload stripePayload
-	err := json.NewDecoder(r.Body).Decode(&payload)
+	err := app.readJSON(w, r, &payload)
 	if err != nil {
-		app.logger.Error(err.Error())
+		app.badRequest(w, r, err)
 		return
 	}
 
-	amount, err := strconv.Atoi(payload.Amount)
+	// the amount is computed from our prices, never taken from the request
+	quote, err := app.quoteForPayload(payload)
 	if err != nil {
-		app.logger.Error(err.Error())
+		app.badRequest(w, r, err)
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: payload.Currency,
+	metadata := quote.Metadata()
+	if payload.CartToken != "" {
+		metadata["cart_token"] = payload.CartToken
 	}
 
-	isValid := true
-
-	pi, msg, err := card.Charge(payload.Currency, amount)
+	pi, msg, err := app.Gateway.CreatePaymentIntent(app.config.currency, quote.Total, metadata, app.idempotencyKey(r))
 	if err != nil {
-		isValid = false
+		app.logger.Error(err.Error())
+		app.writeJSON(w, gatewayStatus(err), jsonResponse{OK: false, Message: msg})
+		return
 	}
 
-	if isValid {
-		out, err := json.MarshalIndent(pi, "", "  ")
+	app.writeJSON(w, http.StatusOK, pi)
+}
+
+// quoteForPayload prices the cart, lines or single product referenced by a payment request
+func (app *application) quoteForPayload(payload stripePayload) (models.Quote, error) {
+	var lines []models.CartLine
+	switch {
+	case payload.CartToken != "":
+		cart, err := app.DB.GetCart(payload.CartToken)
 		if err != nil {
-			app.logger.Error(err.Error())
-			return
+			return models.Quote{}, errors.New("cart not found")
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(out)
-	} else {
-		j := jsonResponse{
-			OK:      false,
-			Message: msg,
-			Content: "",
+		lines = cart.Lines
+	case len(payload.Lines) > 0:
+		lines = payload.Lines
+	default:
+		productID, err := strconv.Atoi(payload.ProductID)
+		if err != nil {
+			return models.Quote{}, errors.New("a product, lines or cart token is required")
 		}
+		lines = []models.CartLine{{ItemID: productID, Quantity: max(payload.Quantity, 1)}}
+	}
 
-		out, err := json.MarshalIndent(j, "", "  ")
-		if err != nil {
-			app.logger.Error(err.Error())
+	quote, err := app.DB.QuoteForLines(lines, payload.Coupon, app.config.taxRate)
+	if err != nil {
+		return quote, err
+	}
+	for _, l := range quote.Lines {
+		if l.Item.IsRecurring {
+			return quote, errors.New("subscription plans cannot be bought with a one time payment")
 		}
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(out)
+	}
+	return quote, nil
+}
 
+// VirtualTerminalPaymentIntent creates a payment intent for an amount keyed in by an admin
+func (app *application) VirtualTerminalPaymentIntent(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Amount int `json:"amount"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
 	}
 
+	pi, msg, err := app.Gateway.CreatePaymentIntent(app.config.currency, payload.Amount,
+		map[string]string{"source": "virtual-terminal"}, app.idempotencyKey(r))
+	if err != nil {
+		app.logger.Error(err.Error())
+		app.writeJSON(w, gatewayStatus(err), jsonResponse{OK: false, Message: msg})
+		return
+	}
+	app.writeJSON(w, http.StatusOK, pi)
 }
 
 func (app *application) GetItemByID(w http.ResponseWriter, r *http.Request) {
@@ -120,23 +154,6 @@ func (app *application) GetItemByID(w http.ResponseWriter, r *http.Request) {
 	w.Write(out)
 }
 
-// Invoice is the JSON payload that will be sent to the microservice
-type Invoice struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"-"`
-	Products  []Product `json:"products"`
-}
-
-// Product represents the fields of each item
-type Product struct {
-	Name     string
-	Amount   int
-	Quantity int
-}
-
 func (app *application) CreateCustomerAndSubscribe(w http.ResponseWriter, r *http.Request) {
 	var data stripePayload
 	err := json.NewDecoder(r.Body).Decode(&data)
@@ -158,203 +175,119 @@ func (app *application) CreateCustomerAndSubscribe(w http.ResponseWriter, r *htt
 
 	app.logger.Info(fmt.Sprintf("data: %v %v %v %v", data.Email, data.LastFour, data.PaymentMethod, data.Plan))
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: data.Currency,
+	productID, _ := strconv.Atoi(data.ProductID)
+	item, err := app.DB.GetItem(productID)
+	if err != nil || !item.IsRecurring {
+		app.badRequest(w, r, errors.New("invalid subscription plan"))
+		return
 	}
 
-	okay := true
-	var subscription *stripe.Subscription
-	txnMsg := "Transaction successful"
+	// derive a key per gateway call so a retried request reuses the same customer and subscription
+	customerKey, subscriptionKey := "", ""
+	if key := app.idempotencyKey(r); key != "" {
+		customerKey = key + "-customer"
+		subscriptionKey = key + "-subscription"
+	}
 
-	stripeCustomer, msg, err := card.CreateCustomer(data.PaymentMethod, data.Email)
+	stripeCustomer, msg, err := app.Gateway.CreateCustomer(data.PaymentMethod, data.Email, customerKey)
 	if err != nil {
 		app.logger.Error(err.Error())
-		okay = false
-		txnMsg = msg
-	}
-
-	if okay {
-		subscription, err = card.SubscribeToPlan(stripeCustomer, data.Plan, data.Email, data.LastFour, "")
-		if err != nil {
-			app.logger.Error(err.Error())
-			okay = false
-			txnMsg = "Error subscribing customer"
-			return
-		}
-
-		app.logger.Info(fmt.Sprintf("subscription id is %v", subscription.ID))
-	}
-
-	if okay {
-		productID, _ := strconv.Atoi(data.ProductID)
-		customer := models.Customer{
-			FirstName: data.FirstName,
-			LastName:  data.LastName,
-			Email:     data.Email,
-		}
-		customerID, err := app.SaveCustomer(customer)
-		if err != nil {
-			app.logger.Error(err.Error())
-			return
-		}
-
-		amount, _ := strconv.Atoi(data.Amount)
-		// expiryMonth, _ := strconv.Atoi(data.ExpiryMonth)
-		// expiryYear, _ := strconv.Atoi(data.ExpiryYear)
-		txn := models.Transaction{
-			Amount:              amount,
-			Currency:            "usd",
-			LastFour:            data.LastFour,
-			ExpiryMonth:         data.ExpiryMonth,
-			ExpiryYear:          data.ExpiryYear,
-			TransactionStatusID: 2,
-			PaymentIntent:       subscription.ID,
-			PaymentMethod:       data.PaymentMethod,
-		}
-
-		txnID, err := app.SaveTransaction(txn)
-		if err != nil {
-			app.logger.Error(err.Error())
-			return
-		}
-
-		order := models.Order{
-			ItemID:        productID,
-			TransactionID: txnID,
-			CustomerID:    customerID,
-			StatusID:      1,
-			Quantity:      1,
-			Amount:        amount,
-			CreatedAt:     time.Now(),
-			UpdatedAt:     time.Now(),
-		}
-
-		orderID, err := app.SaveOrder(order)
-		if err != nil {
-			app.logger.Error(err.Error())
-			return
-		}
-
-		var products []Product
-		// GetItemsByOrderID here?
-		orders, err := app.GetProductsForInvoice(order)
-		if err != nil {
-			app.logger.Error(err.Error())
-			return
-		}
-
-		for _, order := range orders {
-			var product Product
-			product.Name = order.Item.Name
-			product.Quantity = order.Quantity
-			product.Amount = order.Amount
-			products = append(products, product)
-		}
-
-		inv := Invoice{
-			ID:        orderID,
-			FirstName: data.FirstName,
-			LastName:  data.LastName,
-			Email:     data.Email,
-			CreatedAt: time.Now(),
-			Products:  products,
-		}
-
-		err = app.callInvoiceMicro(inv)
-		if err != nil {
-			app.logger.Error(err.Error())
-		}
-
-	}
-	// msg := ""
-
-	resp := jsonResponse{
-		OK:      okay,
-		Message: txnMsg,
+		app.writeJSON(w, gatewayStatus(err), jsonResponse{OK: false, Message: msg})
+		return
 	}
 
-	out, err := json.MarshalIndent(resp, "", " ")
+	// subscribe to the plan of the product so the plan and the recorded price always agree
+	subscription, err := app.Gateway.SubscribeToPlan(stripeCustomer, item.PlanID, data.Email, data.LastFour, "", subscriptionKey)
 	if err != nil {
 		app.logger.Error(err.Error())
+		app.writeJSON(w, gatewayStatus(err), jsonResponse{OK: false, Message: "Error subscribing customer"})
 		return
 	}
-	w.Header().Set("Content-Type", "application/json")
+	app.logger.Info(fmt.Sprintf("subscription id is %v", subscription.ID))
 
-	w.Write(out)
-}
-
-func (app *application) callInvoiceMicro(inv Invoice) error {
-	url := os.Getenv("INVOICE_API")
-	out, err := json.MarshalIndent(inv, "", " ")
+	// the first invoice is charged as the subscription is created; a declined charge
+	// leaves it incomplete, and it is not an order
+	err = cards.VerifySubscription(subscription)
 	if err != nil {
-		return err
+		app.logger.Error(err.Error())
+		app.writeJSON(w, http.StatusPaymentRequired, jsonResponse{
+			OK:      false,
+			Message: "Your card could not be charged for the subscription",
+		})
+		return
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(out))
-	if err != nil {
-		return err
+	customer := models.Customer{
+		FirstName: data.FirstName,
+		LastName:  data.LastName,
+		Email:     data.Email,
 	}
 
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	amount := item.Price
+	txn := models.Transaction{
+		Amount:              amount,
+		Currency:            app.config.currency,
+		LastFour:            data.LastFour,
+		ExpiryMonth:         data.ExpiryMonth,
+		ExpiryYear:          data.ExpiryYear,
+		TransactionStatusID: TransactionCleared,
+		PaymentIntent:       subscription.ID,
+		PaymentMethod:       data.PaymentMethod,
 	}
 
-	defer resp.Body.Close()
-	app.logger.Info(fmt.Sprint(resp.Body))
-
-	return nil
-}
+	order := models.Order{
+		StatusID:  models.OrderPaid,
+		Amount:    amount,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+	lines := []models.OrderItem{
+		{ItemID: item.ID, Quantity: 1, UnitPrice: amount, LineTotal: amount, Item: item},
+	}
 
-// SaveCustomer saves a customer and returns customer id
-func (app *application) SaveCustomer(customer models.Customer) (int, error) {
-	id, err := app.DB.InsertCustomer(customer)
+	// the invoice is queued with the order
+	_, err = app.SaveCheckout(customer, txn, order, lines)
 	if err != nil {
-		app.logger.Error(err.Error())
-		return 0, err
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{
+			OK:      false,
+			Message: "Your subscription was charged but could not be recorded; we will contact you",
+		})
+		return
 	}
-	return id, nil
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "Transaction successful"})
 }
 
-// SaveTransaction saves a transaction and returns txn id
-func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(txn)
+// SaveCheckout saves a paid checkout with models.SaveChargedCheckout and announces the
+// sale
+func (app *application) SaveCheckout(customer models.Customer, txn models.Transaction, order models.Order, lines []models.OrderItem) (int, error) {
+	id, err := models.SaveChargedCheckout(app.DB, customer, txn, order, lines)
 	if err != nil {
 		app.logger.Error(err.Error())
 		return 0, err
 	}
+	app.publish(events.Event{Type: events.SaleCreated, OrderID: id, Amount: txn.Amount, Currency: txn.Currency})
 	return id, nil
 }
 
-// SaveOrder saves a order and returns order id
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+// SaveTransaction saves a charged transaction with models.SaveChargedTransaction and
+// announces the sale
+func (app *application) SaveTransaction(txn models.Transaction, email string) (int, error) {
+	id, err := models.SaveChargedTransaction(app.DB, txn, email)
 	if err != nil {
 		app.logger.Error(err.Error())
 		return 0, err
 	}
+	app.publish(events.Event{Type: events.SaleCreated, Amount: txn.Amount, Currency: txn.Currency})
 	return id, nil
 }
 
-func (app *application) GetProductsForInvoice(order models.Order) ([]*models.Order, error) {
-	orders, err := app.DB.GetAllOrdersByUser(order.CustomerID, order.CreatedAt)
-	if err != nil {
-		app.logger.Error(err.Error())
-		return nil, err
-	}
-	return orders, nil
-}
-
 // CreateAuthToken creates an auth token
 func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request) {
 	var userInput struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email     string `json:"email"`
+		Password  string `json:"password"`
+		TokenName string `json:"token_name"`
 	}
 
 	err := app.readJSON(w, r, &userInput)
@@ -363,29 +296,52 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if app.throttled(w, loginKeys(r, userInput.Email)...) {
+		return
+	}
+
 	// get user by email in db
 	user, err := app.DB.GetUserByEmail(userInput.Email)
 	if err != nil {
+		app.loginFailed(r, userInput.Email)
 		app.InvalidCredentials(w)
 		return
 	}
 	// validate password
 	validPassword, err := app.PasswordMatches(user.Password, userInput.Password)
-	if err != nil {
+	if err != nil || !validPassword {
+		app.loginFailed(r, userInput.Email)
 		app.InvalidCredentials(w)
 		return
 	}
 
-	if !validPassword {
-		app.InvalidCredentials(w)
+	// users with a second factor get a challenge to answer instead of a token
+	if user.TwoFactorEnabled {
+		app.sendTwoFactorChallenge(w, r, user, userInput.TokenName)
 		return
 	}
+
+	app.loginSucceeded(user.Email)
+	app.sendAuthToken(w, r, user, userInput.TokenName, false)
+}
+
+// sendAuthToken generates a session token for user, saves it and writes it out.
+// secondFactor records that the user has just passed their second factor.
+func (app *application) sendAuthToken(w http.ResponseWriter, r *http.Request, user models.User, name string, secondFactor bool) {
 	// generate token
 	token, err := models.GenerateToken(user.ID, 24*time.Hour, models.ScopeAuthentication)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
+	token.SecondFactor = secondFactor
+
+	token.Name = strings.TrimSpace(name)
+	if token.Name == "" {
+		token.Name = "login"
+	}
+	token.IP = netutil.ClientIP(r)
+	token.UserAgent = r.UserAgent()
 
 	// save to db
 	err = app.DB.InsertToken(token, user)
@@ -402,41 +358,48 @@ func (app *application) CreateAuthToken(w http.ResponseWriter, r *http.Request)
 	}
 
 	payload.Error = false
-	payload.Message = fmt.Sprintf("token for %s created", userInput.Email)
+	payload.Message = fmt.Sprintf("token for %s created", user.Email)
 	payload.Token = token
 
 	_ = app.writeJSON(w, http.StatusOK, payload)
 }
 
-func (app *application) authenticateToken(r *http.Request) (*models.User, error) {
+// authenticateToken resolves the bearer token of a request, either a session token or
+// an api key, to its user
+func (app *application) authenticateToken(r *http.Request) (*models.User, *models.Token, error) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
-		return nil, errors.New("no authorization header received")
+		return nil, nil, errors.New("no authorization header received")
 	}
 
 	headerParts := strings.Split(authHeader, " ")
 	if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-		return nil, errors.New("no authorization header received")
+		return nil, nil, errors.New("no authorization header received")
 	}
 
 	token := headerParts[1]
-	if len(token) != 26 {
-		return nil, errors.New("wrong authentication token size")
+	if models.IsAPIKey(token) {
+		if len(token) != models.APIKeyLength {
+			return nil, nil, errors.New("wrong api key size")
+		}
+	} else if len(token) != 26 {
+		return nil, nil, errors.New("wrong authentication token size")
 	}
 
 	// get the user from the tokens table
-	user, err := app.DB.GetUserForToken(token)
+	user, t, err := app.DB.GetUserForToken(token)
 	if err != nil {
-		return nil, errors.New("no matching user found")
+		return nil, nil, errors.New("no matching user found")
 	}
 
-	return user, nil
+	return user, t, nil
 }
 
 func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Request) {
-	// validate token and get user
-	user, err := app.authenticateToken(r)
-	if err != nil {
+	// validate token and get user; only a signed in session counts, not a two-factor
+	// challenge or an api key
+	user, token, err := app.authenticateToken(r)
+	if err != nil || token.Scope != models.ScopeAuthentication {
 		app.InvalidCredentials(w)
 		return
 	}
@@ -452,17 +415,16 @@ func (app *application) CheckAuthentication(w http.ResponseWriter, r *http.Reque
 
 func (app *application) VirtualTerminalPaymentSuccess(w http.ResponseWriter, r *http.Request) {
 	var txnData struct {
-		PaymentAmount   int    `json:"amount"`
-		PaymentCurrency string `json:"currency"`
-		FirstName       string `json:"first_name"`
-		LastName        string `json:"last_name"`
-		Email           string `json:"email"`
-		PaymentIntent   string `json:"payment_intent"`
-		PaymentMethod   string `json:"payment_method"`
-		BankReturnCode  string `json:"bank_return_code"`
-		ExpiryMonth     int    `json:"expiry_month"`
-		ExpiryYear      int    `json:"expiry_year"`
-		LastFour        string `json:"last_four"`
+		PaymentAmount  int    `json:"amount"`
+		FirstName      string `json:"first_name"`
+		LastName       string `json:"last_name"`
+		Email          string `json:"email"`
+		PaymentIntent  string `json:"payment_intent"`
+		PaymentMethod  string `json:"payment_method"`
+		BankReturnCode string `json:"bank_return_code"`
+		ExpiryMonth    int    `json:"expiry_month"`
+		ExpiryYear     int    `json:"expiry_year"`
+		LastFour       string `json:"last_four"`
 	}
 	err := app.readJSON(w, r, &txnData)
 	if err != nil {
@@ -470,18 +432,25 @@ func (app *application) VirtualTerminalPaymentSuccess(w http.ResponseWriter, r *
 		return
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
+	pi, err := app.Gateway.RetrievePaymentIntent(txnData.PaymentIntent)
+	if err != nil {
+		app.gatewayError(w, r, err)
+		return
 	}
 
-	pi, err := card.RetrievePaymentIntent(txnData.PaymentIntent)
+	pm, err := app.Gateway.GetPaymentMethod(txnData.PaymentMethod)
 	if err != nil {
-		app.badRequest(w, r, err)
+		app.gatewayError(w, r, err)
 		return
 	}
 
-	pm, err := card.GetPaymentMethod(txnData.PaymentMethod)
+	// the admin keyed in the amount, but it must be what was actually charged
+	err = cards.VerifyPaymentIntent(pi, txnData.PaymentAmount, app.config.currency)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	err = cards.VerifyMetadata(pi, map[string]string{"source": "virtual-terminal"})
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -493,17 +462,17 @@ func (app *application) VirtualTerminalPaymentSuccess(w http.ResponseWriter, r *
 
 	txn := models.Transaction{
 		Amount:              txnData.PaymentAmount,
-		Currency:            txnData.PaymentCurrency,
+		Currency:            app.config.currency,
 		LastFour:            txnData.LastFour,
 		ExpiryMonth:         txnData.ExpiryMonth,
 		ExpiryYear:          txnData.ExpiryYear,
 		PaymentIntent:       txnData.PaymentIntent,
 		PaymentMethod:       txnData.PaymentMethod,
 		BankReturnCode:      pi.LatestCharge.ID,
-		TransactionStatusID: 2,
+		TransactionStatusID: TransactionCleared,
 	}
 
-	_, err = app.SaveTransaction(txn)
+	_, err = app.SaveTransaction(txn, txnData.Email)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
@@ -523,20 +492,40 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	// verify email exists
-	_, err = app.DB.GetUserByEmail(payload.Email)
-	if err != nil {
-		var resp struct {
-			Error   bool   `json:"error"`
-			Message string `json:"message"`
-		}
-		resp.Error = true
-		resp.Message = "No matching email found on our system"
-		app.writeJSON(w, http.StatusAccepted, resp)
+	keys := []models.ThrottleKey{
+		{Kind: models.ThrottleResetAccount, Key: models.AccountKey(payload.Email).Key},
+		{Kind: models.ThrottleResetIP, Key: netutil.ClientIP(r)},
+	}
+	if app.throttled(w, keys...) {
 		return
+	}
+	for _, k := range keys {
+		_, err = app.DB.RecordFailure(k, models.ResetPolicy)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+	}
+
+	// answer the same whether or not the email belongs to a user, and send the email in
+	// the background so the response time does not tell either
+	user, err := app.DB.GetUserByEmail(payload.Email)
+	if err == nil {
+		go app.sendPasswordResetLink(user.Email)
+	}
 
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
 	}
-	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, payload.Email)
+	resp.Error = false
+	resp.Message = "If that email belongs to an account, a password reset link is on its way"
+
+	app.writeJSON(w, http.StatusAccepted, resp)
+}
+
+// sendPasswordResetLink emails a signed password reset link
+func (app *application) sendPasswordResetLink(email string) {
+	link := fmt.Sprintf("%s/reset-password?email=%s", app.config.frontend, email)
 	sign := urlsigner.Signer{
 		Secret: []byte(app.config.secretkey),
 	}
@@ -554,19 +543,10 @@ func (app *application) SendPasswordResetEmail(w http.ResponseWriter, r *http.Re
 	data.Name = "Saul Goodman"
 	// send mail
 
-	err = app.SendEmail("info@ecomm.com", payload.Email, "Password Reset Request", "password-reset", data)
+	err := app.SendEmail("info@ecomm.com", email, "Password Reset Request", "password-reset", data)
 	if err != nil {
 		app.logger.Error(err.Error())
-		app.badRequest(w, r, err)
-		return
-	}
-	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
 	}
-	resp.Error = false
-
-	app.writeJSON(w, http.StatusCreated, resp)
 }
 
 func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
@@ -607,6 +587,7 @@ func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
 		app.badRequest(w, r, err)
 		return
 	}
+	app.publish(events.Event{Type: events.PasswordChanged, UserID: user.ID})
 
 	var resp struct {
 		Error   bool   `json:"error"`
@@ -702,12 +683,14 @@ func (app *application) GetSale(w http.ResponseWriter, r *http.Request) {
 	app.writeJSON(w, http.StatusOK, order)
 }
 
+// RefundCharge refunds all or part of what was paid for an order. Refunds of an order
+// can never add up to more than was paid; the order is partially refunded until they
+// reach it.
 func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 	var chargeToRefund struct {
-		ID            int    `json:"id"`
-		PaymentIntent string `json:"pi"`
-		Amount        int    `json:"amount"`
-		Currency      string `json:"currency"`
+		ID     int    `json:"id"`
+		Amount int    `json:"amount"`
+		Reason string `json:"reason"`
 	}
 
 	err := app.readJSON(w, r, &chargeToRefund)
@@ -716,43 +699,127 @@ func (app *application) RefundCharge(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// validate amount against the order
+	order, err := app.DB.GetOrderByID(chargeToRefund.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	refunds, err := app.DB.GetRefundsForOrder(order.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	left := order.Transaction.Amount
+	for _, rf := range refunds {
+		left -= rf.Amount
+	}
+
+	v := validator.New()
+	v.Check(chargeToRefund.Amount > 0, "amount", "must be more than zero")
+	v.Check(chargeToRefund.Amount <= left, "amount", fmt.Sprintf("must be at most %d, what is left to refund", left))
+	v.Check(len(chargeToRefund.Reason) <= 255, "reason", "must be at most 255 characters")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: chargeToRefund.Currency,
+	// check the move SaveRefund will make before any money goes back
+	to := models.OrderRefunded
+	if chargeToRefund.Amount < left {
+		to = models.OrderPartiallyRefunded
+	}
+	if !order.StatusID.CanMoveTo(to) {
+		app.badRequest(w, r, fmt.Errorf("an order that is %s cannot be moved to %s", order.StatusID, to))
+		return
 	}
 
-	err = card.Refund(chargeToRefund.PaymentIntent, chargeToRefund.Amount)
+	re, err := app.Gateway.Refund(order.Transaction.PaymentIntent, chargeToRefund.Amount, app.idempotencyKey(r))
 	if err != nil {
-		app.badRequest(w, r, err)
+		app.gatewayError(w, r, err)
 		return
 	}
+
+	refund := models.Refund{
+		OrderID:        order.ID,
+		TransactionID:  order.TransactionID,
+		Amount:         chargeToRefund.Amount,
+		Currency:       order.Transaction.Currency,
+		Reason:         chargeToRefund.Reason,
+		StripeRefundID: re.ID,
+	}
+	if user := app.authenticatedUser(r); user != nil {
+		refund.UserID = user.ID
+	}
+
 	// update status in db
-	err = app.DB.UpdateOrderStatus(chargeToRefund.ID, Refunded)
+	status, err := app.DB.SaveRefund(refund)
 	if err != nil {
+		app.logger.Error(fmt.Sprintf("refund %s of order %d was not recorded: %s", re.ID, order.ID, err))
+		_, rerr := app.DB.InsertReconciliation(models.Reconciliation{
+			Kind:           models.ReconcileRefund,
+			StripeRefundID: re.ID,
+			PaymentIntent:  order.Transaction.PaymentIntent,
+			PaymentMethod:  order.Transaction.PaymentMethod,
+			Amount:         refund.Amount,
+			Currency:       refund.Currency,
+			Email:          order.Customer.Email,
+			Reason:         fmt.Sprintf("refund of order %d was not recorded: %s", order.ID, err),
+		})
+		if rerr != nil {
+			app.logger.Error("could not record refund for reconciliation", "refund", re.ID, "error", rerr)
+		}
 		app.badRequest(w, r, errors.New("the charge was refunded but database could not be updated"))
 		return
 	}
+	app.publish(events.Event{Type: events.OrderUpdated, OrderID: order.ID, StatusID: int(status)})
+	app.queueCreditNote(models.CreditNoteJob{
+		OrderID:  order.ID,
+		Amount:   refund.Amount,
+		Currency: refund.Currency,
+		Reason:   refund.Reason,
+	})
 
 	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
+		Error    bool               `json:"error"`
+		Message  string             `json:"message"`
+		StatusID models.OrderStatus `json:"status_id"`
 	}
 
 	resp.Error = false
 	resp.Message = "Charge refunded"
+	if status == models.OrderPartiallyRefunded {
+		resp.Message = "Charge partially refunded"
+	}
+	resp.StatusID = status
 
 	app.writeJSON(w, http.StatusOK, resp)
+}
 
+// GetOrderRefunds returns the refunds of an order, newest first
+func (app *application) GetOrderRefunds(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	refunds, err := app.DB.GetRefundsForOrder(orderID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if refunds == nil {
+		refunds = []*models.Refund{}
+	}
+
+	app.writeJSON(w, http.StatusOK, refunds)
 }
 
+// CancelSubscription cancels the subscription an order was paid with at the gateway and
+// marks the order cancelled
 func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Request) {
 	var subToCancel struct {
-		ID            int    `json:"id"`
-		PaymentIntent string `json:"pi"`
-		Currency      string `json:"currency"`
+		ID int `json:"id"`
 	}
 
 	err := app.readJSON(w, r, &subToCancel)
@@ -761,24 +828,34 @@ func (app *application) CancelSubscription(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	card := cards.Card{
-		Secret:   app.config.stripe.secret,
-		Key:      app.config.stripe.key,
-		Currency: subToCancel.Currency,
+	order, err := app.DB.GetOrderByID(subToCancel.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if !order.StatusID.CanMoveTo(models.OrderCancelled) {
+		app.badRequest(w, r, fmt.Errorf("a subscription that is %s cannot be cancelled", order.StatusID))
+		return
 	}
 
-	err = card.CancelSubscription(subToCancel.PaymentIntent)
+	// subscription orders store the subscription id as their payment intent
+	err = app.Gateway.CancelSubscription(order.Transaction.PaymentIntent)
 	if err != nil {
-		app.badRequest(w, r, err)
+		app.gatewayError(w, r, err)
 		return
 	}
 
 	// update status in db
-	err = app.DB.UpdateOrderStatus(subToCancel.ID, Cancelled)
+	change := models.StatusChange{Reason: "Subscription cancelled"}
+	if user := app.authenticatedUser(r); user != nil {
+		change.UserID = user.ID
+	}
+	err = app.DB.UpdateOrderStatus(order.ID, models.OrderCancelled, change)
 	if err != nil {
 		app.badRequest(w, r, errors.New("the charge was cancelled but database could not be updated"))
 		return
 	}
+	app.publish(events.Event{Type: events.OrderUpdated, OrderID: order.ID, StatusID: int(models.OrderCancelled)})
 
 	var resp struct {
 		Error   bool   `json:"error"`
@@ -831,7 +908,33 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 		app.badRequest(w, r, err)
 		return
 	}
+
+	// a new user without a role gets the least privileged one; an edit without a role
+	// keeps the one they have
+	if user.Role == "" && userID > 0 {
+		stored, err := app.DB.GetOneUser(userID)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		user.Role = stored.Role
+	}
+	if user.Role == "" {
+		user.Role = models.RoleReadOnly
+	}
+	if !models.ValidRole(user.Role) {
+		app.badRequest(w, r, fmt.Errorf("unknown role %q", user.Role))
+		return
+	}
+
 	if userID > 0 {
+		// owners cannot demote themselves, so there is always someone left to manage users
+		if current := app.authenticatedUser(r); current != nil && current.ID == userID && !models.RoleCan(user.Role, models.PermManageUsers) {
+			app.badRequest(w, r, errors.New("you cannot remove your own permission to manage users"))
+			return
+		}
+
+		user.ID = userID
 		err = app.DB.EditUser(user)
 		if err != nil {
 			app.badRequest(w, r, err)
@@ -848,6 +951,7 @@ func (app *application) EditUser(w http.ResponseWriter, r *http.Request) {
 				app.badRequest(w, r, err)
 				return
 			}
+			app.publish(events.Event{Type: events.PasswordChanged, UserID: user.ID})
 		}
 	} else {
 		newHash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
@@ -877,11 +981,16 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		app.badRequest(w, r, err)
 		return
 	}
+	if current := app.authenticatedUser(r); current != nil && current.ID == userID {
+		app.badRequest(w, r, errors.New("you cannot delete yourself"))
+		return
+	}
 	err = app.DB.DeleteUser(userID)
 	if err != nil {
 		app.badRequest(w, r, err)
 		return
 	}
+	app.publish(events.Event{Type: events.UserDeleted, UserID: userID})
 	var resp struct {
 		Error   bool   `json:"error"`
 		Message string `json:"message"`
@@ -890,3 +999,26 @@ func (app *application) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	resp.Error = false
 	app.writeJSON(w, http.StatusOK, resp)
 }
+
+// UnlockUser clears the failed logins that locked out a user's account
+func (app *application) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	user, err := app.DB.GetOneUser(userID)
+	if err != nil {
+		app.badRequest(w, r, errors.New("user not found"))
+		return
+	}
+
+	err = app.DB.ClearFailures(models.AccountKey(user.Email))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "account unlocked"})
+}
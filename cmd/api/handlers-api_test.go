@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/wtran29/go-ecommerce/internal/cards"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+func TestGetPaymentIntentErrors(t *testing.T) {
+	ta := newTestApp(t)
+	cheap := ta.db.AddItem(models.Item{Name: "Sticker", Price: 10})
+
+	req, err := http.NewRequest("POST", ta.server.URL+"/api/payment-intent", strings.NewReader("{not json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed body: status %d, want 400", resp.StatusCode)
+	}
+
+	// the fake refuses amounts below Stripe's minimum charge
+	var out jsonResponse
+	resp = ta.do(t, "POST", "/api/payment-intent", map[string]any{"product_id": strconv.Itoa(cheap)}, &out)
+	if resp.StatusCode != http.StatusBadRequest || out.OK || out.Message == "" {
+		t.Errorf("amount too small: status %d, %+v; want 400 with a message", resp.StatusCode, out)
+	}
+}
+
+func TestCreateCustomerAndSubscribe(t *testing.T) {
+	tests := []struct {
+		name   string
+		card   string
+		status int
+		orders int
+	}{
+		{"paid", cards.FakeCardVisa, http.StatusOK, 1},
+		{"card refused", cards.FakeCardDeclined, http.StatusPaymentRequired, 0},
+		{"first invoice declined", cards.FakeCardChargeCustomerFail, http.StatusPaymentRequired, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t)
+			ta.config.currency = "eur"
+			plan := ta.db.AddItem(models.Item{Name: "Bronze Plan", Price: 2000, IsRecurring: true, PlanID: "price_bronze"})
+
+			var out jsonResponse
+			resp := ta.do(t, "POST", "/api/create-customer-and-subscribe-to-plan", map[string]any{
+				"product_id":     strconv.Itoa(plan),
+				"payment_method": tt.card,
+				"email":          "jane@example.com",
+				"first_name":     "Jane",
+				"last_name":      "Doe",
+				"last_four":      "4242",
+			}, &out)
+			if resp.StatusCode != tt.status || out.OK != (tt.status == http.StatusOK) || out.Message == "" {
+				t.Errorf("status %d, %+v; want %d", resp.StatusCode, out, tt.status)
+			}
+
+			orders, _, _, err := ta.db.GetAllOrdersPaginated(true, 10, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(orders) != tt.orders {
+				t.Errorf("%d subscriptions recorded, want %d", len(orders), tt.orders)
+			}
+			for _, o := range orders {
+				if o.Transaction.Currency != "eur" {
+					t.Errorf("subscription recorded in %q, want the configured eur", o.Transaction.Currency)
+				}
+			}
+		})
+	}
+}
+
+func TestEditUserRole(t *testing.T) {
+	ta := newTestApp(t)
+	_, token := ta.signIn(t, models.RoleOwner)
+	auth := []string{"Authorization", "Bearer " + token}
+
+	support, _ := ta.signIn(t, models.RoleSupport)
+	resp := ta.do(t, "POST", "/api/admin/all-users/edit/"+strconv.Itoa(support.ID), map[string]any{
+		"first_name": "Sam",
+		"last_name":  "Support",
+		"email":      support.Email,
+	}, nil, auth...)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("edit: status %d", resp.StatusCode)
+	}
+	if u, _ := ta.db.GetOneUser(support.ID); u.Role != models.RoleSupport || u.FirstName != "Sam" {
+		t.Errorf("edit without a role: %s with role %s, want Sam with role support", u.FirstName, u.Role)
+	}
+
+	resp = ta.do(t, "POST", "/api/admin/all-users/edit/0", map[string]any{
+		"first_name": "Nora",
+		"last_name":  "New",
+		"email":      "nora@example.com",
+		"password":   "password",
+	}, nil, auth...)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create: status %d", resp.StatusCode)
+	}
+	if u, _ := ta.db.GetUserByEmail("nora@example.com"); u.Role != models.RoleReadOnly {
+		t.Errorf("new user without a role has role %s, want read-only", u.Role)
+	}
+}
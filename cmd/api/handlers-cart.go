@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wtran29/go-ecommerce/internal/cards"
+	"github.com/wtran29/go-ecommerce/internal/models"
+	"github.com/wtran29/go-ecommerce/internal/validator"
+)
+
+type cartResponse struct {
+	Token string             `json:"token"`
+	Lines []models.OrderItem `json:"lines"`
+	Total int                `json:"total"`
+}
+
+// writeCart prices the cart lines and writes the cart out as JSON
+func (app *application) writeCart(w http.ResponseWriter, r *http.Request, status int, cart models.Cart) {
+	lines, err := app.DB.OrderItemsForCart(cart)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	resp := cartResponse{
+		Token: cart.Token,
+		Lines: lines,
+	}
+	for _, l := range lines {
+		resp.Total += l.LineTotal
+	}
+
+	app.writeJSON(w, status, resp)
+}
+
+// CreateCart creates a new cart, optionally with initial lines, and returns its token
+func (app *application) CreateCart(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Lines []models.CartLine `json:"lines"`
+	}
+	if r.ContentLength != 0 {
+		err := app.readJSON(w, r, &payload)
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+	}
+
+	token, err := models.NewCartToken()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	cart := models.Cart{Token: token}
+	for _, l := range payload.Lines {
+		if err := app.validateCartLine(l); err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		cart.Add(l.ItemID, l.Quantity)
+	}
+
+	err = app.DB.SaveCart(cart)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeCart(w, r, http.StatusCreated, cart)
+}
+
+// GetCart returns a cart by token
+func (app *application) GetCart(w http.ResponseWriter, r *http.Request) {
+	cart, err := app.DB.GetCart(chi.URLParam(r, "token"))
+	if err != nil {
+		app.badRequest(w, r, errors.New("cart not found"))
+		return
+	}
+	app.writeCart(w, r, http.StatusOK, cart)
+}
+
+// AddCartItem adds an item to a cart
+func (app *application) AddCartItem(w http.ResponseWriter, r *http.Request) {
+	var line models.CartLine
+	err := app.readJSON(w, r, &line)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if err := app.validateCartLine(line); err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	cart, err := app.DB.GetCart(chi.URLParam(r, "token"))
+	if err != nil {
+		app.badRequest(w, r, errors.New("cart not found"))
+		return
+	}
+
+	cart.Add(line.ItemID, line.Quantity)
+	err = app.DB.SaveCart(cart)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeCart(w, r, http.StatusOK, cart)
+}
+
+// RemoveCartItem removes an item from a cart
+func (app *application) RemoveCartItem(w http.ResponseWriter, r *http.Request) {
+	itemID, err := strconv.Atoi(chi.URLParam(r, "itemID"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	cart, err := app.DB.GetCart(chi.URLParam(r, "token"))
+	if err != nil {
+		app.badRequest(w, r, errors.New("cart not found"))
+		return
+	}
+
+	cart.Remove(itemID)
+	err = app.DB.SaveCart(cart)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeCart(w, r, http.StatusOK, cart)
+}
+
+// CheckoutCart records the order for a cart whose payment intent has been confirmed
+func (app *application) CheckoutCart(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		FirstName     string `json:"first_name"`
+		LastName      string `json:"last_name"`
+		Email         string `json:"email"`
+		PaymentIntent string `json:"payment_intent"`
+		PaymentMethod string `json:"payment_method"`
+		Coupon        string `json:"coupon"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(len(payload.FirstName) > 1, "first_name", "must be at least 2 characters")
+	v.Check(len(payload.LastName) > 1, "last_name", "must be at least 2 characters")
+	v.Check(payload.Email != "", "email", "must be provided")
+	v.Check(payload.PaymentIntent != "", "payment_intent", "must be provided")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	cart, err := app.DB.GetCart(chi.URLParam(r, "token"))
+	if err != nil {
+		app.badRequest(w, r, errors.New("cart not found"))
+		return
+	}
+	if cart.IsEmpty() {
+		app.badRequest(w, r, errors.New("cart is empty"))
+		return
+	}
+
+	quote, err := app.DB.QuoteForLines(cart.Lines, payload.Coupon, app.config.taxRate)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	lines, total := quote.Lines, quote.Total
+
+	pi, err := app.Gateway.RetrievePaymentIntent(payload.PaymentIntent)
+	if err != nil {
+		app.gatewayError(w, r, err)
+		return
+	}
+
+	// never record an order unless the intent was paid for the order total
+	err = cards.VerifyPaymentIntent(pi, total, app.config.currency)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	metadata := quote.Metadata()
+	metadata["cart_token"] = cart.Token
+	err = cards.VerifyMetadata(pi, metadata)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	pm, err := app.Gateway.GetPaymentMethod(payload.PaymentMethod)
+	if err != nil {
+		app.gatewayError(w, r, err)
+		return
+	}
+
+	bankReturnCode := ""
+	if pi.LatestCharge != nil {
+		bankReturnCode = pi.LatestCharge.ID
+	}
+
+	customer := models.Customer{
+		FirstName: payload.FirstName,
+		LastName:  payload.LastName,
+		Email:     payload.Email,
+	}
+	txn := models.Transaction{
+		Amount:              total,
+		Currency:            app.config.currency,
+		LastFour:            pm.Card.Last4,
+		ExpiryMonth:         int(pm.Card.ExpMonth),
+		ExpiryYear:          int(pm.Card.ExpYear),
+		PaymentIntent:       payload.PaymentIntent,
+		PaymentMethod:       payload.PaymentMethod,
+		BankReturnCode:      bankReturnCode,
+		TransactionStatusID: TransactionCleared,
+	}
+	order := models.Order{
+		StatusID:  models.OrderPaid,
+		Amount:    total,
+		Discount:  quote.Discount,
+		Tax:       quote.Tax,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	orderID, err := app.SaveCheckout(customer, txn, order, lines)
+	if errors.Is(err, models.ErrPaymentIntentUsed) {
+		app.badRequest(w, r, err)
+		return
+	}
+	if err != nil {
+		app.writeJSON(w, http.StatusInternalServerError, jsonResponse{
+			OK:      false,
+			Message: "Your payment was taken but the order could not be recorded; we will contact you",
+		})
+		return
+	}
+
+	if err := app.DB.DeleteCart(cart.Token); err != nil {
+		app.logger.Error(err.Error())
+	}
+
+	app.writeJSON(w, http.StatusCreated, jsonResponse{
+		OK:      true,
+		Message: "Transaction successful",
+		ID:      orderID,
+	})
+}
+
+// validateCartLine checks that a line refers to a one time item with a positive quantity
+func (app *application) validateCartLine(l models.CartLine) error {
+	if l.Quantity < 1 {
+		return errors.New("quantity must be at least 1")
+	}
+	item, err := app.DB.GetItem(l.ItemID)
+	if err != nil {
+		return errors.New("item not found")
+	}
+	if item.IsRecurring {
+		return errors.New("subscription plans cannot be added to a cart")
+	}
+	return nil
+}
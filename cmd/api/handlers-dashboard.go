@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Dashboard returns today's sales figures. The day starts at midnight in the time zone
+// given as ?tz=, for example America/Chicago, or UTC without one. The dashboard page
+// fetches it once and again whenever an order changes.
+func (app *application) Dashboard(w http.ResponseWriter, r *http.Request) {
+	loc := time.UTC
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			app.badRequest(w, r, fmt.Errorf("unknown time zone %q", tz))
+			return
+		}
+	}
+
+	now := time.Now().In(loc)
+	y, m, d := now.Date()
+	since := time.Date(y, m, d, 0, 0, 0, 0, loc)
+
+	stats, err := app.DB.GetDashboardStats(since)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, stats)
+}
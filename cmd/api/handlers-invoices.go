@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wtran29/go-ecommerce/internal/models"
+	"github.com/wtran29/go-ecommerce/internal/urlsigner"
+	"github.com/wtran29/go-ecommerce/internal/validator"
+)
+
+const (
+	// invoiceDownloadTTL is how long an admin's invoice download link works
+	invoiceDownloadTTL = 5 * time.Minute
+	// invoiceResendTTL is how long an admin's invoice resend link works
+	invoiceResendTTL = time.Minute
+)
+
+// invoiceLink is a signed link to the invoice service for an invoice
+type invoiceLink struct {
+	Number  string    `json:"number"`
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// GetOrderInvoices returns the invoices issued for an order, newest first
+func (app *application) GetOrderInvoices(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	invoices, err := app.DB.GetInvoicesForOrder(orderID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if invoices == nil {
+		invoices = []*models.Invoice{}
+	}
+
+	app.writeJSON(w, http.StatusOK, invoices)
+}
+
+// GetOrderCreditNotes returns the credit notes issued for refunds of an order, newest
+// first
+func (app *application) GetOrderCreditNotes(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	notes, err := app.DB.GetCreditNotesForOrder(orderID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if notes == nil {
+		notes = []*models.CreditNote{}
+	}
+
+	app.writeJSON(w, http.StatusOK, notes)
+}
+
+// queueCreditNote asks the invoice service to issue and email a credit note for a
+// refund. The refund has already happened, so a failure is only logged.
+func (app *application) queueCreditNote(refund models.CreditNoteJob) {
+	job, err := models.NewJob(models.JobKindCreditNote, refund)
+	if err == nil {
+		_, err = app.DB.EnqueueJob(job)
+	}
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("could not queue credit note for order %d: %s", refund.OrderID, err))
+	}
+}
+
+// InvoiceDownloadLink returns a short-lived signed link to download the invoice of an
+// order from the invoice service
+func (app *application) InvoiceDownloadLink(w http.ResponseWriter, r *http.Request) {
+	inv, err := app.orderInvoice(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	path := fmt.Sprintf("/invoice/download?number=%s", url.QueryEscape(inv.Number))
+	app.writeJSON(w, http.StatusOK, app.signInvoiceLink(inv, path, invoiceDownloadTTL))
+}
+
+// InvoiceResendLink returns a short-lived, single-use signed link that emails the
+// invoice of an order again when posted to, to the email given or else the customer's
+// own address
+func (app *application) InvoiceResendLink(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if payload.Email != "" {
+		_, err := mail.ParseAddress(payload.Email)
+		v.Check(err == nil, "email", "must be a valid email address")
+	}
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	inv, err := app.orderInvoice(r)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	// the count of resends so far makes the link work once
+	path := fmt.Sprintf("/invoice/resend?number=%s&resend=%d", url.QueryEscape(inv.Number), inv.Resends)
+	if payload.Email != "" {
+		path += "&email=" + url.QueryEscape(payload.Email)
+	}
+	app.writeJSON(w, http.StatusOK, app.signInvoiceLink(inv, path, invoiceResendTTL))
+}
+
+// orderInvoice returns the invoice of the order in the url that is not void
+func (app *application) orderInvoice(r *http.Request) (models.Invoice, error) {
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return models.Invoice{}, err
+	}
+
+	invoices, err := app.DB.GetInvoicesForOrder(orderID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return models.Invoice{}, err
+	}
+	for _, inv := range invoices {
+		if inv.Status != models.InvoiceVoid {
+			return *inv, nil
+		}
+	}
+	return models.Invoice{}, fmt.Errorf("order %d has no invoice yet", orderID)
+}
+
+// signInvoiceLink signs a path on the invoice service so it works until ttl from now
+func (app *application) signInvoiceLink(inv models.Invoice, path string, ttl time.Duration) invoiceLink {
+	sign := urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+
+	expires := time.Now().Add(ttl)
+	return invoiceLink{
+		Number:  inv.Number,
+		URL:     app.config.invoiceURL + sign.GenerateExpiringToken(path, expires),
+		Expires: expires,
+	}
+}
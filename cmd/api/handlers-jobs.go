@@ -0,0 +1,60 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// ListJobs returns recent background jobs with the status given as ?status=, failed
+// by default, or of any status for ?status=all
+func (app *application) ListJobs(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = models.JobFailed
+	case "all":
+		status = ""
+	case models.JobPending, models.JobRunning, models.JobDone, models.JobFailed:
+	default:
+		app.badRequest(w, r, fmt.Errorf("unknown job status %q", status))
+		return
+	}
+
+	jobs, err := app.DB.GetJobs(status)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if jobs == nil {
+		jobs = []*models.Job{}
+	}
+
+	app.writeJSON(w, http.StatusOK, jobs)
+}
+
+// RetryJob queues a failed job again with a fresh set of attempts
+func (app *application) RetryJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.RetryJob(jobID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.badRequest(w, r, errors.New("no failed job with that id"))
+		return
+	}
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "job queued"})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wtran29/go-ecommerce/internal/events"
+	"github.com/wtran29/go-ecommerce/internal/models"
+	"github.com/wtran29/go-ecommerce/internal/validator"
+)
+
+// fulfilmentStatuses are the statuses an admin may move an order to by hand. The
+// others follow from payments, refunds and Stripe events.
+var fulfilmentStatuses = []models.OrderStatus{models.OrderFulfilled, models.OrderShipped, models.OrderDelivered}
+
+// GetOrderHistory returns the status changes of an order, oldest first
+func (app *application) GetOrderHistory(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	history, err := app.DB.GetOrderStatusHistory(orderID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if history == nil {
+		history = []*models.OrderStatusHistory{}
+	}
+
+	app.writeJSON(w, http.StatusOK, history)
+}
+
+// UpdateFulfilment marks an order fulfilled, shipped or delivered, with an optional
+// reason such as a tracking number
+func (app *application) UpdateFulfilment(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var payload struct {
+		StatusID models.OrderStatus `json:"status_id"`
+		Reason   string             `json:"reason"`
+	}
+	err = app.readJSON(w, r, &payload)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(slices.Contains(fulfilmentStatuses, payload.StatusID), "status_id", "must be fulfilled, shipped or delivered")
+	v.Check(len(payload.Reason) <= 255, "reason", "must be at most 255 characters")
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	change := models.StatusChange{Reason: payload.Reason}
+	if user := app.authenticatedUser(r); user != nil {
+		change.UserID = user.ID
+	}
+	err = app.DB.UpdateOrderStatus(orderID, payload.StatusID, change)
+	if errors.Is(err, models.ErrInvalidTransition) {
+		app.badRequest(w, r, err)
+		return
+	}
+	if err != nil {
+		app.logger.Error(err.Error())
+		app.badRequest(w, r, errors.New("the order could not be updated"))
+		return
+	}
+	app.publish(events.Event{Type: events.OrderUpdated, OrderID: orderID, StatusID: int(payload.StatusID)})
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "Order " + payload.StatusID.String(),
+	}
+	app.writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wtran29/go-ecommerce/internal/events"
+	"github.com/wtran29/go-ecommerce/internal/models"
+	"github.com/wtran29/go-ecommerce/internal/netutil"
+	"github.com/wtran29/go-ecommerce/internal/validator"
+)
+
+// ListTokens returns the active session tokens and api keys of the authenticated user
+func (app *application) ListTokens(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if user == nil {
+		app.InvalidCredentials(w)
+		return
+	}
+
+	tokens, err := app.DB.GetTokensForUser(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if tokens == nil {
+		tokens = []*models.Token{}
+	}
+
+	app.writeJSON(w, http.StatusOK, tokens)
+}
+
+// CreateAPIKey creates a scoped api key for the authenticated user. The key is only
+// shown in this response.
+func (app *application) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if user == nil {
+		app.InvalidCredentials(w)
+		return
+	}
+
+	var input struct {
+		Name       string   `json:"name"`
+		Scopes     []string `json:"scopes"`
+		TTLInHours int      `json:"ttl_hours"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	input.Name = strings.TrimSpace(input.Name)
+	v := validator.New()
+	v.Check(input.Name != "", "name", "must be provided")
+	v.Check(len(input.Scopes) > 0, "scopes", "at least one scope is required")
+	v.Check(input.TTLInHours >= 0, "ttl_hours", "must not be negative")
+	for _, scope := range input.Scopes {
+		v.Check(models.ValidKeyScope(scope), "scopes", fmt.Sprintf("unknown scope %q", scope))
+		v.Check(user.CanGrant(scope), "scopes", fmt.Sprintf("your role cannot grant %q", scope))
+	}
+	if !v.Valid() {
+		app.failedValidation(w, r, v.Errors)
+		return
+	}
+
+	key, err := models.GenerateAPIKey(user.ID, input.Name, input.Scopes, time.Duration(input.TTLInHours)*time.Hour)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	key.IP = netutil.ClientIP(r)
+	key.UserAgent = r.UserAgent()
+
+	err = app.DB.InsertToken(key, *user)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusCreated, key)
+}
+
+// RevokeToken revokes one of the authenticated user's session tokens or api keys
+func (app *application) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if user == nil {
+		app.InvalidCredentials(w)
+		return
+	}
+
+	tokenID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.DB.RevokeToken(user.ID, tokenID)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.badRequest(w, r, errors.New("token not found"))
+		return
+	}
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	app.publish(events.Event{Type: events.TokenRevoked, UserID: user.ID, TokenID: tokenID})
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: "token revoked",
+	}
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// RevokeAllTokens revokes every session token and api key of the authenticated user,
+// including the token used for this request
+func (app *application) RevokeAllTokens(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if user == nil {
+		app.InvalidCredentials(w)
+		return
+	}
+
+	n, err := app.DB.RevokeAllTokens(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	app.publish(events.Event{Type: events.TokenRevoked, UserID: user.ID})
+
+	resp := jsonResponse{
+		OK:      true,
+		Message: fmt.Sprintf("%d tokens revoked", n),
+	}
+	app.writeJSON(w, http.StatusOK, resp)
+}
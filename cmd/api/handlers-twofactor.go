@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/wtran29/go-ecommerce/internal/encryption"
+	"github.com/wtran29/go-ecommerce/internal/models"
+	"github.com/wtran29/go-ecommerce/internal/netutil"
+	"github.com/wtran29/go-ecommerce/internal/totp"
+)
+
+// totpIssuer names this site in authenticator apps
+const totpIssuer = "Go Ecommerce"
+
+// sendTwoFactorChallenge answers a correct password for a user with a second factor
+// with a short-lived challenge token to exchange, with a code, for a session token
+func (app *application) sendTwoFactorChallenge(w http.ResponseWriter, r *http.Request, user models.User, name string) {
+	challenge, err := models.GenerateToken(user.ID, 5*time.Minute, models.ScopeTwoFactor)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	challenge.Name = "two-factor challenge"
+	challenge.IP = netutil.ClientIP(r)
+	challenge.UserAgent = r.UserAgent()
+
+	err = app.DB.InsertToken(challenge, user)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var payload struct {
+		Error             bool   `json:"error"`
+		Message           string `json:"message"`
+		TwoFactorRequired bool   `json:"two_factor_required"`
+		Challenge         string `json:"challenge"`
+	}
+	payload.Message = "enter the code from your authenticator app"
+	payload.TwoFactorRequired = true
+	payload.Challenge = challenge.PlainText
+
+	_ = app.writeJSON(w, http.StatusOK, payload)
+}
+
+// CompleteTwoFactorLogin exchanges a challenge token and a code or recovery code for a
+// session token. A wrong code spends the challenge, so the password must be given again.
+func (app *application) CompleteTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Challenge string `json:"challenge"`
+		Code      string `json:"code"`
+		TokenName string `json:"token_name"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if len(input.Challenge) != 26 {
+		app.InvalidCredentials(w)
+		return
+	}
+	user, challenge, err := app.DB.GetUserForToken(input.Challenge)
+	if err != nil || challenge.Scope != models.ScopeTwoFactor {
+		app.InvalidCredentials(w)
+		return
+	}
+	if app.throttled(w, loginKeys(r, user.Email)...) {
+		return
+	}
+
+	err = app.DB.RevokeToken(user.ID, challenge.ID)
+	if err != nil {
+		app.InvalidCredentials(w)
+		return
+	}
+
+	ok, err := app.verifySecondFactor(user.ID, input.Code)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+	if !ok {
+		app.loginFailed(r, user.Email)
+		app.InvalidCredentials(w)
+		return
+	}
+
+	app.loginSucceeded(user.Email)
+	app.sendAuthToken(w, r, *user, input.TokenName, true)
+}
+
+// verifySecondFactor checks a code from the user's authenticator, or failing that one
+// of their recovery codes. Each code is only accepted once.
+func (app *application) verifySecondFactor(userID int, code string) (bool, error) {
+	tf, err := app.DB.GetTwoFactor(userID)
+	if err != nil {
+		return false, err
+	}
+	if tf.Secret == "" {
+		return false, nil
+	}
+
+	if ok, err := app.verifyTOTP(tf, code); ok || err != nil {
+		return ok, err
+	}
+	if !tf.Enabled {
+		return false, nil
+	}
+	return app.DB.UseRecoveryCode(userID, models.HashRecoveryCode(code))
+}
+
+// verifyTOTP checks a code from the user's authenticator and records its time step
+func (app *application) verifyTOTP(tf models.TwoFactor, code string) (bool, error) {
+	secret, err := app.decryptTOTPSecret(tf.Secret)
+	if err != nil {
+		return false, err
+	}
+
+	counter, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return app.DB.UseTOTPCounter(tf.UserID, counter)
+}
+
+func (app *application) encryptTOTPSecret(secret string) (string, error) {
+	useEncrypt := encryption.Encryption{
+		Key: []byte(app.config.secretkey),
+	}
+	return useEncrypt.Encrypt(secret)
+}
+
+func (app *application) decryptTOTPSecret(secret string) (string, error) {
+	useEncrypt := encryption.Encryption{
+		Key: []byte(app.config.secretkey),
+	}
+	return useEncrypt.Decrypt(secret)
+}
+
+// TwoFactorSetup starts enrollment for the authenticated user, returning a new secret
+// and the URI to show as a QR code. The secret is not used until TwoFactorEnable.
+func (app *application) TwoFactorSetup(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if user == nil {
+		app.InvalidCredentials(w)
+		return
+	}
+
+	tf, err := app.DB.GetTwoFactor(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if tf.Enabled {
+		app.badRequest(w, r, errors.New("two-factor authentication is already enabled"))
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	encrypted, err := app.encryptTOTPSecret(secret)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	err = app.DB.SetTwoFactorSecret(user.ID, encrypted)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error  bool   `json:"error"`
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	resp.Secret = secret
+	resp.URI = totp.ProvisioningURI(totpIssuer, user.Email, secret)
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// TwoFactorEnable confirms enrollment with a first code and returns recovery codes
+func (app *application) TwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if user == nil {
+		app.InvalidCredentials(w)
+		return
+	}
+
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	tf, err := app.DB.GetTwoFactor(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if tf.Enabled {
+		app.badRequest(w, r, errors.New("two-factor authentication is already enabled"))
+		return
+	}
+	if tf.Secret == "" {
+		app.badRequest(w, r, errors.New("start two-factor setup first"))
+		return
+	}
+
+	ok, err := app.verifyTOTP(tf, input.Code)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if !ok {
+		app.badRequest(w, r, errors.New("invalid code"))
+		return
+	}
+
+	codes, hashes, err := models.GenerateRecoveryCodes(models.RecoveryCodeCount)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	err = app.DB.EnableTwoFactor(user.ID, hashes)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.sendRecoveryCodes(w, codes)
+}
+
+// TwoFactorRecoveryCodes replaces the authenticated user's recovery codes, given a
+// current code
+func (app *application) TwoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if user == nil {
+		app.InvalidCredentials(w)
+		return
+	}
+
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	tf, err := app.DB.GetTwoFactor(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if !tf.Enabled {
+		app.badRequest(w, r, errors.New("two-factor authentication is not enabled"))
+		return
+	}
+	// codes are guessed here as at login, so they share its counters
+	if app.throttled(w, loginKeys(r, user.Email)...) {
+		return
+	}
+	ok, err := app.verifyTOTP(tf, input.Code)
+	if err != nil || !ok {
+		app.loginFailed(r, user.Email)
+		app.badRequest(w, r, errors.New("invalid code"))
+		return
+	}
+	app.loginSucceeded(user.Email)
+
+	codes, hashes, err := models.GenerateRecoveryCodes(models.RecoveryCodeCount)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	err = app.DB.ReplaceRecoveryCodes(user.ID, hashes)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.sendRecoveryCodes(w, codes)
+}
+
+func (app *application) sendRecoveryCodes(w http.ResponseWriter, codes []string) {
+	var resp struct {
+		Error         bool     `json:"error"`
+		Message       string   `json:"message"`
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	resp.Message = "store these recovery codes somewhere safe, they will not be shown again"
+	resp.RecoveryCodes = codes
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// TwoFactorDisable turns off the authenticated user's second factor, given a current
+// code or recovery code
+func (app *application) TwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	user := app.authenticatedUser(r)
+	if user == nil {
+		app.InvalidCredentials(w)
+		return
+	}
+
+	var input struct {
+		Code string `json:"code"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	if app.throttled(w, loginKeys(r, user.Email)...) {
+		return
+	}
+	ok, err := app.verifySecondFactor(user.ID, input.Code)
+	if err != nil || !ok {
+		app.loginFailed(r, user.Email)
+		app.badRequest(w, r, errors.New("invalid code"))
+		return
+	}
+	app.loginSucceeded(user.Email)
+
+	err = app.DB.ResetTwoFactor(user.ID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "two-factor authentication disabled"})
+}
+
+// ResetUserTwoFactor lets an admin turn off another user's second factor, for example
+// after they lose their phone and recovery codes
+func (app *application) ResetUserTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	_, err = app.DB.GetOneUser(userID)
+	if err != nil {
+		app.badRequest(w, r, errors.New("user not found"))
+		return
+	}
+
+	err = app.DB.ResetTwoFactor(userID)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, jsonResponse{OK: true, Message: "two-factor authentication reset"})
+}
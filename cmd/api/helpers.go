@@ -1,13 +1,18 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"time"
 
+	"github.com/stripe/stripe-go/v76"
+	"github.com/wtran29/go-ecommerce/internal/events"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -70,6 +75,21 @@ func (app *application) badRequest(w http.ResponseWriter, r *http.Request, err e
 	return nil
 }
 
+// gatewayError answers a request the payment gateway failed with the status
+// gatewayStatus gives for err
+func (app *application) gatewayError(w http.ResponseWriter, r *http.Request, err error) error {
+	app.logger.Error(err.Error())
+
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	payload.Error = true
+	payload.Message = err.Error()
+
+	return app.writeJSON(w, gatewayStatus(err), payload)
+}
+
 func (app *application) InvalidCredentials(w http.ResponseWriter) error {
 	var payload struct {
 		Error   bool   `json:"error"`
@@ -85,6 +105,19 @@ func (app *application) InvalidCredentials(w http.ResponseWriter) error {
 	return nil
 }
 
+// forbidden tells an authenticated user they may not do what they asked
+func (app *application) forbidden(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "you do not have permission to do that"
+
+	return app.writeJSON(w, http.StatusForbidden, payload)
+}
+
 func (app *application) PasswordMatches(hash, password string) (bool, error) {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	if err != nil {
@@ -121,3 +154,34 @@ func (app *application) failedValidation(w http.ResponseWriter, r *http.Request,
 	payload.Errors = errors
 	app.writeJSON(w, http.StatusUnprocessableEntity, payload)
 }
+
+// publish sends an event to the web instances. Events are notifications only, so a
+// failure is logged rather than failing the request that caused it.
+func (app *application) publish(e events.Event) {
+	if app.Events == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := app.Events.Publish(ctx, e)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("publish %s: %s", e.Type, err))
+	}
+}
+
+// gatewayStatus is the status to answer with when the payment gateway refused a call:
+// 402 for a card that was declined, 400 for a request it found invalid, and 502 when
+// the gateway itself failed
+func gatewayStatus(err error) int {
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) {
+		switch {
+		case stripeErr.Type == stripe.ErrorTypeCard:
+			return http.StatusPaymentRequired
+		case stripeErr.HTTPStatusCode >= 400 && stripeErr.HTTPStatusCode < 500:
+			return http.StatusBadRequest
+		}
+	}
+	return http.StatusBadGateway
+}
@@ -1,14 +1,227 @@
 package main
 
-import "net/http"
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/wtran29/go-ecommerce/internal/models"
+	"github.com/wtran29/go-ecommerce/internal/netutil"
+)
+
+type contextKey string
+
+const (
+	userContextKey        = contextKey("user")
+	tokenContextKey       = contextKey("token")
+	idempotencyContextKey = contextKey("idempotency-key")
+)
+
+// Auth lets through requests carrying a session token. Api keys are refused here;
+// routes that accept them use RequireScope instead.
 func (app *application) Auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		_, err := app.authenticateToken(r)
+		user, token, err := app.authenticateToken(r)
 		if err != nil {
 			app.InvalidCredentials(w)
 			return
 		}
-		next.ServeHTTP(w, r)
+		if token.Scope != models.ScopeAuthentication {
+			app.forbidden(w)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, tokenContextKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireScope lets through requests carrying a session token, or an api key granted
+// at least one of scopes
+func (app *application) RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, token, err := app.authenticateToken(r)
+			if err != nil {
+				app.InvalidCredentials(w)
+				return
+			}
+			if token.Scope != models.ScopeAuthentication && !hasAnyScope(token, scopes) {
+				app.forbidden(w)
+				return
+			}
+			ctx := context.WithValue(r.Context(), userContextKey, user)
+			ctx = context.WithValue(ctx, tokenContextKey, token)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// hasAnyScope reports whether token was granted at least one of scopes
+func hasAnyScope(token *models.Token, scopes []string) bool {
+	for _, s := range scopes {
+		if token.HasScope(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// idempotencyKey returns the key to send to the payment gateway for a request that
+// came through Idempotent, or "" if it had no Idempotency-Key header
+func (app *application) idempotencyKey(r *http.Request) string {
+	key, _ := r.Context().Value(idempotencyContextKey).(string)
+	return key
+}
+
+// authenticatedUser returns the user Auth stored in the request context
+func (app *application) authenticatedUser(r *http.Request) *models.User {
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if !ok {
+		return nil
+	}
+	return user
+}
+
+// RequirePermission only lets through users whose role grants permission. It must
+// run after Auth or RequireScope.
+func (app *application) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := app.authenticatedUser(r)
+			if user == nil {
+				app.InvalidCredentials(w)
+				return
+			}
+			if !user.Can(permission) {
+				app.forbidden(w)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// responseRecorder captures a response while writing it through to the client
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotencyOwner returns who a request's idempotency key belongs to: the signed in
+// user, else the cart in the path, else the client's address
+func (app *application) idempotencyOwner(r *http.Request) string {
+	if user := app.authenticatedUser(r); user != nil {
+		return fmt.Sprintf("user:%d", user.ID)
+	}
+	if token := chi.URLParam(r, "token"); token != "" {
+		return "cart:" + token
+	}
+	return "ip:" + netutil.ClientIP(r)
+}
+
+// Idempotent honors the Idempotency-Key header. The first response for a key is stored
+// and replayed for retries with the same body; a different body under the same key is
+// rejected with 422. Keys belong to the signed in user, or on routes anyone may call to
+// the cart or client sending them, so one client can never replay another's response.
+func (app *application) Idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+		if err != nil {
+			app.badRequest(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(body)
+		hash := hex.EncodeToString(sum[:])
+
+		k := models.IdempotencyKey{
+			Key:         key,
+			Route:       fmt.Sprintf("%s %s", r.Method, r.URL.Path),
+			Owner:       app.idempotencyOwner(r),
+			RequestHash: hash,
+			ExpiresAt:   time.Now().Add(app.config.idempotency.ttl),
+		}
+
+		// the gateway gets a key of the owner's own too, as Stripe keys are per account
+		gatewayKey := sha256.Sum256([]byte(k.Owner + "\x00" + k.Key))
+		r = r.WithContext(context.WithValue(r.Context(), idempotencyContextKey, hex.EncodeToString(gatewayKey[:])))
+
+		stored, reserved, err := app.DB.ReserveIdempotencyKey(k)
+		if err != nil {
+			app.logger.Error(err.Error())
+			app.badRequest(w, r, errors.New("could not process idempotency key"))
+			return
+		}
+
+		if !reserved {
+			switch {
+			case stored.RequestHash != hash:
+				app.failedValidation(w, r, map[string]string{
+					"idempotency_key": "key was already used with a different request body",
+				})
+			case stored.StatusCode == 0:
+				var resp struct {
+					Error   bool   `json:"error"`
+					Message string `json:"message"`
+				}
+				resp.Error = true
+				resp.Message = "a request with this idempotency key is still being processed"
+				app.writeJSON(w, http.StatusConflict, resp)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.ResponseBody)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			// server errors and panics release the key so the client can retry
+			if p := recover(); p != nil || rec.status == 0 || rec.status >= http.StatusInternalServerError {
+				if err := app.DB.ReleaseIdempotencyKey(k); err != nil {
+					app.logger.Error(err.Error())
+				}
+				if p != nil {
+					panic(p)
+				}
+				return
+			}
+			if err := app.DB.SaveIdempotentResponse(k, rec.status, rec.body.Bytes()); err != nil {
+				app.logger.Error(err.Error())
+			}
+		}()
+
+		next.ServeHTTP(rec, r)
 	})
 }
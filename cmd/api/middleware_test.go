@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+func TestIdempotentAnonymous(t *testing.T) {
+	ta := newTestApp(t)
+	itemID := ta.db.AddItem(models.Item{Name: "Widget", Price: 1000})
+
+	var first, retry stripe.PaymentIntent
+	ta.do(t, "POST", "/api/payment-intent", map[string]any{"lines": []models.CartLine{{ItemID: itemID, Quantity: 1}}}, &first,
+		"Idempotency-Key", "key-1")
+
+	resp := ta.do(t, "POST", "/api/payment-intent", map[string]any{"lines": []models.CartLine{{ItemID: itemID, Quantity: 1}}}, &retry,
+		"Idempotency-Key", "key-1")
+	if resp.Header.Get("Idempotent-Replayed") != "true" || retry.ID != first.ID {
+		t.Errorf("retry was not replayed: got %s, want %s", retry.ID, first.ID)
+	}
+
+	resp = ta.do(t, "POST", "/api/payment-intent", map[string]any{"lines": []models.CartLine{{ItemID: itemID, Quantity: 3}}}, nil,
+		"Idempotency-Key", "key-1")
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("same key with another body: status %d, want 422", resp.StatusCode)
+	}
+}
+
+func TestIdempotentPerCart(t *testing.T) {
+	ta := newTestApp(t)
+	itemID := ta.db.AddItem(models.Item{Name: "Widget", Price: 1000})
+
+	checkout := func() *http.Response {
+		var cart cartResponse
+		ta.do(t, "POST", "/api/cart", map[string]any{"lines": []models.CartLine{{ItemID: itemID, Quantity: 1}}}, &cart)
+		return ta.do(t, "POST", "/api/cart/"+cart.Token+"/checkout", map[string]string{"payment_intent": "pi_unknown"}, nil,
+			"Idempotency-Key", "key-1")
+	}
+
+	// carts are checked out by different shoppers, so one cart never sees another's response
+	checkout()
+	resp := checkout()
+	if resp.Header.Get("Idempotent-Replayed") != "" {
+		t.Errorf("another cart with the same key was given the first cart's response")
+	}
+}
+
+func TestIdempotentPerUser(t *testing.T) {
+	ta := newTestApp(t)
+	_, alice := ta.signIn(t, models.RoleOwner)
+	_, bob := ta.signIn(t, models.RoleOwner)
+	path := "/api/admin/virtual-terminal-payment-intent"
+	body := map[string]any{"amount": 1000, "currency": "usd"}
+
+	var first, retry, other stripe.PaymentIntent
+	ta.do(t, "POST", path, body, &first, "Authorization", "Bearer "+alice, "Idempotency-Key", "key-1")
+
+	resp := ta.do(t, "POST", path, body, &retry, "Authorization", "Bearer "+alice, "Idempotency-Key", "key-1")
+	if resp.Header.Get("Idempotent-Replayed") != "true" || retry.ID != first.ID {
+		t.Errorf("retry was not replayed: got %s, want %s", retry.ID, first.ID)
+	}
+
+	resp = ta.do(t, "POST", path, body, &other, "Authorization", "Bearer "+bob, "Idempotency-Key", "key-1")
+	if resp.Header.Get("Idempotent-Replayed") != "" || other.ID == first.ID {
+		t.Errorf("another user with the same key was given the first user's response")
+	}
+
+	resp = ta.do(t, "POST", path, map[string]any{"amount": 2000, "currency": "usd"}, nil,
+		"Authorization", "Bearer "+alice, "Idempotency-Key", "key-1")
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("same key with another body: status %d, want 422", resp.StatusCode)
+	}
+}
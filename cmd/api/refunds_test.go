@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/wtran29/go-ecommerce/internal/cards"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// chargedOrder records a paid order for an intent the fake gateway charged
+func chargedOrder(t *testing.T, ta *testApp, amount int) (int, string) {
+	t.Helper()
+
+	pi, _, err := ta.gateway.CreatePaymentIntent("usd", amount, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ta.gateway.ConfirmPaymentIntent(pi.ID, cards.FakeCardVisa); err != nil {
+		t.Fatal(err)
+	}
+
+	itemID := ta.db.AddItem(models.Item{Name: "Widget", Price: amount})
+	id, err := ta.db.SaveCheckout(
+		models.Customer{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"},
+		models.Transaction{Amount: amount, Currency: "usd", PaymentIntent: pi.ID, TransactionStatusID: TransactionCleared},
+		models.Order{StatusID: models.OrderPaid, Amount: amount},
+		[]models.OrderItem{{ItemID: itemID, Quantity: 1, UnitPrice: amount, LineTotal: amount}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, pi.ID
+}
+
+func TestRefundDisputedOrder(t *testing.T) {
+	ta := newTestApp(t)
+	_, token := ta.signIn(t, models.RoleOwner)
+	auth := []string{"Authorization", "Bearer " + token}
+
+	id, pi := chargedOrder(t, ta, 2500)
+	if err := ta.db.UpdateOrderStatus(id, models.OrderDisputed, models.StatusChange{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a disputed order can only be refunded in full
+	resp := ta.do(t, "POST", "/api/admin/refund", map[string]any{"id": id, "amount": 1000}, nil, auth...)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("partial refund of a disputed order: status %d, want 400", resp.StatusCode)
+	}
+	if got := ta.gateway.Refunded(pi); got != 0 {
+		t.Fatalf("a refund the order could not record was sent to the gateway: %d refunded", got)
+	}
+
+	resp = ta.do(t, "POST", "/api/admin/refund", map[string]any{"id": id, "amount": 2500}, nil, auth...)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("full refund of a disputed order: status %d, want 200", resp.StatusCode)
+	}
+	if got := orderStatus(t, ta, id); got != models.OrderRefunded {
+		t.Errorf("order is %s, want Refunded", got)
+	}
+}
+
+// unsavedRefunds is a repository that loses every refund
+type unsavedRefunds struct {
+	*models.MemoryModel
+}
+
+func (unsavedRefunds) SaveRefund(models.Refund) (models.OrderStatus, error) {
+	return 0, errors.New("database is down")
+}
+
+func TestRefundNotRecorded(t *testing.T) {
+	ta := newTestApp(t)
+	_, token := ta.signIn(t, models.RoleOwner)
+	id, pi := chargedOrder(t, ta, 2500)
+	ta.DB = unsavedRefunds{ta.db}
+
+	resp := ta.do(t, "POST", "/api/admin/refund", map[string]any{"id": id, "amount": 1000}, nil, "Authorization", "Bearer "+token)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", resp.StatusCode)
+	}
+
+	recs, err := ta.db.GetUnresolvedReconciliations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recs) != 1 || recs[0].PaymentIntent != pi || recs[0].Amount != 1000 {
+		t.Fatalf("reconciliations = %+v, want the 1000 refunded on %s", recs, pi)
+	}
+	if recs[0].Kind != models.ReconcileRefund || recs[0].StripeRefundID == "" {
+		t.Errorf("reconciliation kind %q, refund %q: want a refund with its gateway id", recs[0].Kind, recs[0].StripeRefundID)
+	}
+	if got := ta.gateway.Refunded(pi); got != 1000 {
+		t.Errorf("gateway refunded %d, want 1000", got)
+	}
+}
+
+// subscribedOrder records a paid subscription order for a subscription the fake
+// gateway started
+func subscribedOrder(t *testing.T, ta *testApp) (int, string) {
+	t.Helper()
+
+	cust, _, err := ta.gateway.CreateCustomer(cards.FakeCardVisa, "jane@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub, err := ta.gateway.SubscribeToPlan(cust, "price_bronze", "jane@example.com", "4242", "visa", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	itemID := ta.db.AddItem(models.Item{Name: "Bronze Plan", Price: 2000})
+	id, err := ta.db.SaveCheckout(
+		models.Customer{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"},
+		models.Transaction{Amount: 2000, Currency: "usd", PaymentIntent: sub.ID, TransactionStatusID: TransactionCleared},
+		models.Order{StatusID: models.OrderPaid, Amount: 2000},
+		[]models.OrderItem{{ItemID: itemID, Quantity: 1, UnitPrice: 2000, LineTotal: 2000}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, sub.ID
+}
+
+func TestCancelSubscriptionOfOrder(t *testing.T) {
+	ta := newTestApp(t)
+	_, token := ta.signIn(t, models.RoleOwner)
+	id, sub := subscribedOrder(t, ta)
+	_, other := subscribedOrder(t, ta)
+
+	// the subscription sent by the client is not the one the order was paid with
+	resp := ta.do(t, "POST", "/api/admin/cancel-subscription", map[string]any{"id": id, "pi": other}, nil,
+		"Authorization", "Bearer "+token)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d, want 200", resp.StatusCode)
+	}
+	if !ta.gateway.Cancelled(sub) {
+		t.Errorf("the order's subscription was not cancelled")
+	}
+	if ta.gateway.Cancelled(other) {
+		t.Errorf("another order's subscription was cancelled")
+	}
+	if got := orderStatus(t, ta, id); got != models.OrderCancelled {
+		t.Errorf("order is %s, want Cancelled", got)
+	}
+}
+
+// downGateway is a gateway whose refunds and cancellations fail as in an outage
+type downGateway struct {
+	*cards.FakeGateway
+}
+
+func (downGateway) Refund(string, int, string) (*stripe.Refund, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (downGateway) CancelSubscription(string) error {
+	return errors.New("connection refused")
+}
+
+func TestGatewayOutage(t *testing.T) {
+	ta := newTestApp(t)
+	_, token := ta.signIn(t, models.RoleOwner)
+	charged, _ := chargedOrder(t, ta, 2500)
+	subscribed, _ := subscribedOrder(t, ta)
+	ta.Gateway = downGateway{ta.gateway}
+
+	resp := ta.do(t, "POST", "/api/admin/refund", map[string]any{"id": charged, "amount": 2500}, nil, "Authorization", "Bearer "+token)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("refund: status %d, want 502", resp.StatusCode)
+	}
+	resp = ta.do(t, "POST", "/api/admin/cancel-subscription", map[string]any{"id": subscribed}, nil, "Authorization", "Bearer "+token)
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("cancel subscription: status %d, want 502", resp.StatusCode)
+	}
+}
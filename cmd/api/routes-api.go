@@ -5,6 +5,8 @@ import (
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
+	"github.com/wtran29/go-ecommerce/internal/cards"
+	"github.com/wtran29/go-ecommerce/internal/models"
 )
 
 func (app *application) routes() http.Handler {
@@ -13,40 +15,94 @@ func (app *application) routes() http.Handler {
 	mux.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"http://*", "https://*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "Idempotency-Key"},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
 
-	mux.Post("/api/payment-intent", app.GetPaymentIntent)
+	mux.With(app.Idempotent).Post("/api/payment-intent", app.GetPaymentIntent)
 	mux.Get("/api/item/{id}", app.GetItemByID)
 
-	mux.Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribe)
+	mux.Post("/api/cart", app.CreateCart)
+	mux.Get("/api/cart/{token}", app.GetCart)
+	mux.Post("/api/cart/{token}/items", app.AddCartItem)
+	mux.Delete("/api/cart/{token}/items/{itemID}", app.RemoveCartItem)
+	mux.With(app.Idempotent).Post("/api/cart/{token}/checkout", app.CheckoutCart)
+
+	mux.With(app.Idempotent).Post("/api/create-customer-and-subscribe-to-plan", app.CreateCustomerAndSubscribe)
 
 	mux.Post("/api/authenticate", app.CreateAuthToken)
+	mux.Post("/api/authenticate/two-factor", app.CompleteTwoFactorLogin)
 	mux.Post("/api/is-authenticated", app.CheckAuthentication)
 	mux.Post("/api/forgot-password", app.SendPasswordResetEmail)
 	mux.Post("/api/reset-password", app.ResetPassword)
 
+	mux.Post("/api/webhooks/stripe", app.StripeWebhook)
+
+	// with -gateway=fake, cmd/web and end to end tests reach the fake's payments here
+	if fake, ok := app.Gateway.(*cards.FakeGateway); ok {
+		mux.Mount("/api/fake-gateway", fake.Handler())
+	}
+
 	mux.Route("/api/admin", func(mux chi.Router) {
-		mux.Use(app.Auth)
+		// routes only signed in users may call
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.Auth)
+
+			mux.Get("/test", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("got in"))
+			})
+
+			mux.Post("/tokens", app.ListTokens)
+			mux.Post("/tokens/revoke/{id}", app.RevokeToken)
+			mux.Post("/tokens/revoke-all", app.RevokeAllTokens)
+			mux.Post("/api-keys", app.CreateAPIKey)
 
-		mux.Get("/test", func(w http.ResponseWriter, r *http.Request) {
-			w.Write([]byte("got in"))
+			mux.Post("/two-factor/setup", app.TwoFactorSetup)
+			mux.Post("/two-factor/enable", app.TwoFactorEnable)
+			mux.Post("/two-factor/recovery-codes", app.TwoFactorRecoveryCodes)
+			mux.Post("/two-factor/disable", app.TwoFactorDisable)
+
+			charge := mux.With(app.RequirePermission(models.PermChargeCards))
+			charge.With(app.Idempotent).Post("/virtual-terminal-payment-intent", app.VirtualTerminalPaymentIntent)
+			charge.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSuccess)
+
+			mux.With(app.RequirePermission(models.PermFulfilOrders)).Post("/get-sale/{id}/status", app.UpdateFulfilment)
+
+			jobs := mux.With(app.RequirePermission(models.PermManageJobs))
+			jobs.Post("/jobs", app.ListJobs)
+			jobs.Post("/jobs/retry/{id}", app.RetryJob)
 		})
 
-		mux.Post("/virtual-terminal-succeeded", app.VirtualTerminalPaymentSuccess)
-		mux.Post("/all-sales", app.AllSales)
-		mux.Post("/all-subscriptions", app.AllSubscriptions)
+		// routes api keys may also call when granted the scope
+		reports := mux.With(app.RequireScope(models.KeyScopeOrdersRead, models.KeyScopeReportsRead), app.RequirePermission(models.PermViewSales))
+		reports.Post("/all-sales", app.AllSales)
+		reports.Post("/all-subscriptions", app.AllSubscriptions)
+		reports.Get("/dashboard", app.Dashboard)
+
+		sales := mux.With(app.RequireScope(models.KeyScopeOrdersRead), app.RequirePermission(models.PermViewSales))
+		sales.Post("/get-sale/{id}", app.GetSale)
+		sales.Post("/get-sale/{id}/invoices", app.GetOrderInvoices)
+		sales.Post("/get-sale/{id}/invoice-link", app.InvoiceDownloadLink)
+		sales.Post("/get-sale/{id}/credit-notes", app.GetOrderCreditNotes)
+		sales.Post("/get-sale/{id}/refunds", app.GetOrderRefunds)
+		sales.Post("/get-sale/{id}/history", app.GetOrderHistory)
+
+		// resending emails the customer, so a read only key may not do it
+		invoices := mux.With(app.RequireScope(models.KeyScopeInvoicesWrite), app.RequirePermission(models.PermSendInvoices))
+		invoices.Post("/get-sale/{id}/resend-invoice-link", app.InvoiceResendLink)
 
-		mux.Post("/get-sale/{id}", app.GetSale)
-		mux.Post("/refund", app.RefundCharge)
-		mux.Post("/cancel-subscription", app.CancelSubscription)
+		refunds := mux.With(app.RequireScope(models.KeyScopeRefundsWrite))
+		refunds.With(app.RequirePermission(models.PermRefund), app.Idempotent).Post("/refund", app.RefundCharge)
+		refunds.With(app.RequirePermission(models.PermCancelSubscription)).Post("/cancel-subscription", app.CancelSubscription)
 
-		mux.Post("/all-users", app.AllUsers)
-		mux.Post("/all-users/{id}", app.OneUser)
-		mux.Post("/all-users/edit/{id}", app.EditUser)
-		mux.Post("/all-users/delete/{id}", app.DeleteUser)
+		users := mux.With(app.RequireScope(models.KeyScopeUsersAdmin))
+		users.With(app.RequirePermission(models.PermViewUsers)).Post("/all-users", app.AllUsers)
+		users.With(app.RequirePermission(models.PermViewUsers)).Post("/all-users/{id}", app.OneUser)
+		users.With(app.RequirePermission(models.PermManageUsers)).Post("/all-users/edit/{id}", app.EditUser)
+		users.With(app.RequirePermission(models.PermManageUsers)).Post("/all-users/delete/{id}", app.DeleteUser)
+		users.With(app.RequirePermission(models.PermManageUsers)).Post("/all-users/two-factor-reset/{id}", app.ResetUserTwoFactor)
+		users.With(app.RequirePermission(models.PermManageUsers)).Post("/all-users/unlock/{id}", app.UnlockUser)
 	})
 
 	return mux
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/wtran29/go-ecommerce/internal/cards"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// testApp is the api running on the in-memory repository and the fake gateway
+type testApp struct {
+	*application
+	db      *models.MemoryModel
+	gateway *cards.FakeGateway
+	server  *httptest.Server
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	var cfg config
+	cfg.env = "test"
+	cfg.secretkey = "abcdefghijklmnopqrstuvwxyz012345"
+	cfg.idempotency.ttl = time.Hour
+	cfg.stripe.webhook = "whsec_test"
+	cfg.currency = "usd"
+
+	ta := &testApp{
+		db:      models.NewMemoryModel(),
+		gateway: cards.NewFakeGateway(),
+	}
+	ta.application = &application{
+		config:  cfg,
+		logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		version: version,
+		DB:      ta.db,
+		Gateway: ta.gateway,
+	}
+	ta.server = httptest.NewServer(ta.routes())
+	t.Cleanup(ta.server.Close)
+	return ta
+}
+
+// do sends a request to the api with a JSON body, unless body is nil, and the given
+// headers, which come in name, value pairs. The response body is decoded into out
+// when it is not nil.
+func (ta *testApp) do(t *testing.T, method, path string, body any, out any, headers ...string) *http.Response {
+	t.Helper()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, ta.server.URL+path, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			t.Fatalf("%s %s: decoding response: %s", method, path, err)
+		}
+	}
+	return resp
+}
+
+// signIn adds a user with the given role and returns them with an authentication token
+func (ta *testApp) signIn(t *testing.T, role string) (models.User, string) {
+	t.Helper()
+
+	email := fmt.Sprintf("%s-%d@example.com", role, time.Now().UnixNano())
+	err := ta.db.AddUser(models.User{FirstName: "Admin", LastName: role, Email: email, Role: role}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ta.db.GetUserByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := models.GenerateToken(user.ID, time.Hour, models.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ta.db.InsertToken(token, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, token.PlainText
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wtran29/go-ecommerce/internal/models"
+	"github.com/wtran29/go-ecommerce/internal/netutil"
+)
+
+// throttled answers 429 Too Many Requests when any of keys is locked out, and reports
+// whether it did
+func (app *application) throttled(w http.ResponseWriter, keys ...models.ThrottleKey) bool {
+	until, err := app.DB.LockedUntil(keys...)
+	if err != nil {
+		// never lock everyone out because the counters cannot be read
+		app.logger.Error(err.Error())
+		return false
+	}
+	if until.IsZero() {
+		return false
+	}
+
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	payload.Error = true
+	payload.Message = fmt.Sprintf("too many attempts, try again in %s", time.Until(until).Round(time.Second))
+	app.writeJSON(w, http.StatusTooManyRequests, payload)
+	return true
+}
+
+// loginKeys are the counters a login for email from the request is checked against
+func loginKeys(r *http.Request, email string) []models.ThrottleKey {
+	return []models.ThrottleKey{models.AccountKey(email), models.IPKey(netutil.ClientIP(r))}
+}
+
+// loginFailed counts a failed login against the account and the client address
+func (app *application) loginFailed(r *http.Request, email string) {
+	_, err := app.DB.RecordFailure(models.AccountKey(email), models.AccountPolicy)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+	_, err = app.DB.RecordFailure(models.IPKey(netutil.ClientIP(r)), models.IPPolicy)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+}
+
+// loginSucceeded forgets the failed logins of the account. Failures from the address
+// are left to expire, so one good password does not reset a guessing run.
+func (app *application) loginSucceeded(email string) {
+	err := app.DB.ClearFailures(models.AccountKey(email))
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+}
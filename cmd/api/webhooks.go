@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/stripe/stripe-go/v76"
+	"github.com/stripe/stripe-go/v76/webhook"
+	"github.com/wtran29/go-ecommerce/internal/events"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// maxWebhookBytes is the largest webhook payload we accept, as recommended by Stripe
+const maxWebhookBytes = 65536
+
+// webhookHandlers maps the Stripe event types we act on to their handler
+func (app *application) webhookHandlers() map[stripe.EventType]func(stripe.Event) error {
+	return map[stripe.EventType]func(stripe.Event) error{
+		stripe.EventTypePaymentIntentSucceeded:      app.handlePaymentIntentSucceeded,
+		stripe.EventTypePaymentIntentPaymentFailed:  app.handlePaymentIntentFailed,
+		stripe.EventTypeChargeRefunded:              app.handleChargeRefunded,
+		stripe.EventTypeChargeDisputeCreated:        app.handleDisputeCreated,
+		stripe.EventTypeChargeDisputeClosed:         app.handleDisputeClosed,
+		stripe.EventTypeInvoicePaid:                 app.handleInvoicePaid,
+		stripe.EventTypeInvoicePaymentFailed:        app.handleInvoicePaymentFailed,
+		stripe.EventTypeCustomerSubscriptionDeleted: app.handleSubscriptionDeleted,
+	}
+}
+
+// StripeWebhook receives events from Stripe, verifies the Stripe-Signature header,
+// stores the raw event and dispatches it to the matching handler
+func (app *application) StripeWebhook(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBytes))
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	event, err := webhook.ConstructEventWithOptions(payload, r.Header.Get("Stripe-Signature"), app.config.stripe.webhook,
+		webhook.ConstructEventOptions{IgnoreAPIVersionMismatch: true})
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("webhook signature verification failed: %s", err))
+		app.badRequest(w, r, errors.New("invalid webhook signature"))
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	isNew, err := app.DB.InsertWebhookEvent(models.WebhookEvent{
+		EventID:   event.ID,
+		EventType: string(event.Type),
+		Payload:   payload,
+	})
+	if errors.Is(err, models.ErrWebhookEventClaimed) {
+		// a non 2xx response makes Stripe try again, after the other delivery is done or
+		// its claim has lapsed
+		resp.Error = true
+		resp.Message = fmt.Sprintf("event %s is being processed", event.ID)
+		app.writeJSON(w, http.StatusConflict, resp)
+		return
+	}
+	if err != nil {
+		app.logger.Error(err.Error())
+		resp.Error = true
+		resp.Message = "could not store event"
+		app.writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+
+	if !isNew {
+		resp.Message = fmt.Sprintf("event %s already processed", event.ID)
+		app.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	errMsg := ""
+	if handler, ok := app.webhookHandlers()[event.Type]; ok {
+		err := handler(event)
+		if errors.Is(err, models.ErrInvalidTransition) {
+			// redelivering the event would not change the answer, so record it and move on
+			app.logger.Info(fmt.Sprintf("webhook %s (%s) ignored: %s", event.ID, event.Type, err))
+			err = app.DB.MarkWebhookEventProcessed(event.ID, err.Error())
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+			resp.Message = fmt.Sprintf("event %s ignored", event.ID)
+			app.writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		if err != nil {
+			app.logger.Error(fmt.Sprintf("webhook %s (%s): %s", event.ID, event.Type, err))
+			errMsg = err.Error()
+		} else {
+			app.publish(events.Event{Type: events.OrderUpdated})
+		}
+	}
+
+	if err := app.DB.MarkWebhookEventProcessed(event.ID, errMsg); err != nil {
+		app.logger.Error(err.Error())
+	}
+
+	if errMsg != "" {
+		// a non 2xx response makes Stripe redeliver the event later
+		resp.Error = true
+		resp.Message = errMsg
+		app.writeJSON(w, http.StatusInternalServerError, resp)
+		return
+	}
+
+	resp.Message = fmt.Sprintf("event %s processed", event.ID)
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+func (app *application) handlePaymentIntentSucceeded(e stripe.Event) error {
+	var pi stripe.PaymentIntent
+	if err := json.Unmarshal(e.Data.Raw, &pi); err != nil {
+		return err
+	}
+	return app.DB.UpdateTransactionStatusByPaymentIntent(pi.ID, TransactionCleared)
+}
+
+func (app *application) handlePaymentIntentFailed(e stripe.Event) error {
+	var pi stripe.PaymentIntent
+	if err := json.Unmarshal(e.Data.Raw, &pi); err != nil {
+		return err
+	}
+	if err := app.DB.UpdateTransactionStatusByPaymentIntent(pi.ID, TransactionDeclined); err != nil {
+		return err
+	}
+	return app.DB.UpdateOrderStatusByPaymentIntent(pi.ID, models.OrderCancelled, stripeChange(e))
+}
+
+func (app *application) handleChargeRefunded(e stripe.Event) error {
+	var charge stripe.Charge
+	if err := json.Unmarshal(e.Data.Raw, &charge); err != nil {
+		return err
+	}
+	if charge.PaymentIntent == nil {
+		return nil
+	}
+
+	// refunds made here are recorded already; this picks up ones made in the Stripe
+	// dashboard
+	var refunds []models.Refund
+	if charge.Refunds != nil {
+		for _, re := range charge.Refunds.Data {
+			if re.Status == stripe.RefundStatusFailed || re.Status == stripe.RefundStatusCanceled {
+				continue
+			}
+			refunds = append(refunds, models.Refund{
+				Amount:         int(re.Amount),
+				Currency:       string(re.Currency),
+				Reason:         strings.ReplaceAll(string(re.Reason), "_", " "),
+				StripeRefundID: re.ID,
+			})
+		}
+	}
+	return app.DB.SaveGatewayRefunds(charge.PaymentIntent.ID, int(charge.AmountRefunded), refunds, TransactionRefunded)
+}
+
+func (app *application) handleDisputeCreated(e stripe.Event) error {
+	var dispute stripe.Dispute
+	if err := json.Unmarshal(e.Data.Raw, &dispute); err != nil {
+		return err
+	}
+	if dispute.PaymentIntent == nil {
+		return nil
+	}
+	return app.DB.UpdateOrderStatusByPaymentIntent(dispute.PaymentIntent.ID, models.OrderDisputed, stripeChange(e))
+}
+
+func (app *application) handleDisputeClosed(e stripe.Event) error {
+	var dispute stripe.Dispute
+	if err := json.Unmarshal(e.Data.Raw, &dispute); err != nil {
+		return err
+	}
+	if dispute.PaymentIntent == nil {
+		return nil
+	}
+
+	switch dispute.Status {
+	case stripe.DisputeStatusWon, stripe.DisputeStatusWarningClosed:
+		return app.DB.RestoreDisputedOrdersByPaymentIntent(dispute.PaymentIntent.ID, stripeChange(e))
+	case stripe.DisputeStatusLost:
+		if err := app.DB.UpdateTransactionStatusByPaymentIntent(dispute.PaymentIntent.ID, TransactionRefunded); err != nil {
+			return err
+		}
+		return app.DB.UpdateOrderStatusByPaymentIntent(dispute.PaymentIntent.ID, models.OrderRefunded, stripeChange(e))
+	}
+	return nil
+}
+
+// handleInvoicePaid records a successful subscription renewal. Subscription orders
+// store the subscription id in transactions.payment_intent.
+func (app *application) handleInvoicePaid(e stripe.Event) error {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(e.Data.Raw, &inv); err != nil {
+		return err
+	}
+	if inv.Subscription == nil {
+		return nil
+	}
+	if err := app.DB.UpdateTransactionStatusByPaymentIntent(inv.Subscription.ID, TransactionCleared); err != nil {
+		return err
+	}
+	return app.DB.UpdateOrderStatusByPaymentIntent(inv.Subscription.ID, models.OrderPaid, stripeChange(e))
+}
+
+func (app *application) handleInvoicePaymentFailed(e stripe.Event) error {
+	var inv stripe.Invoice
+	if err := json.Unmarshal(e.Data.Raw, &inv); err != nil {
+		return err
+	}
+	if inv.Subscription == nil {
+		return nil
+	}
+	return app.DB.UpdateTransactionStatusByPaymentIntent(inv.Subscription.ID, TransactionDeclined)
+}
+
+func (app *application) handleSubscriptionDeleted(e stripe.Event) error {
+	var sub stripe.Subscription
+	if err := json.Unmarshal(e.Data.Raw, &sub); err != nil {
+		return err
+	}
+	return app.DB.UpdateOrderStatusByPaymentIntent(sub.ID, models.OrderCancelled, stripeChange(e))
+}
+
+// stripeChange is the status change an event from Stripe makes
+func stripeChange(e stripe.Event) models.StatusChange {
+	return models.StatusChange{Reason: fmt.Sprintf("Stripe %s", e.Type)}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stripe/stripe-go/v76/webhook"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// postWebhook sends a fixture from testdata/webhooks signed with secret, as Stripe would
+func postWebhook(t *testing.T, ta *testApp, fixture, secret string) (int, string) {
+	t.Helper()
+
+	payload, err := os.ReadFile(filepath.Join("testdata", "webhooks", fixture+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: secret})
+
+	req, err := http.NewRequest("POST", ta.server.URL+"/api/webhooks/stripe", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Stripe-Signature", signed.Header)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var out struct {
+		Message string `json:"message"`
+	}
+	json.NewDecoder(resp.Body).Decode(&out)
+	return resp.StatusCode, out.Message
+}
+
+// paidOrder records a paid order for the payment intent of the fixtures
+func paidOrder(t *testing.T, ta *testApp) int {
+	t.Helper()
+
+	itemID := ta.db.AddItem(models.Item{Name: "Widget", Price: 2500})
+	id, err := ta.db.SaveCheckout(
+		models.Customer{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"},
+		models.Transaction{Amount: 2500, Currency: "usd", PaymentIntent: "pi_fixture", TransactionStatusID: TransactionCleared},
+		models.Order{StatusID: models.OrderPaid, Amount: 2500},
+		[]models.OrderItem{{ItemID: itemID, Quantity: 1, UnitPrice: 2500, LineTotal: 2500}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func orderStatus(t *testing.T, ta *testApp, id int) models.OrderStatus {
+	t.Helper()
+	order, err := ta.db.GetOrderByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return order.StatusID
+}
+
+func TestStripeWebhookSignature(t *testing.T) {
+	ta := newTestApp(t)
+	id := paidOrder(t, ta)
+
+	status, _ := postWebhook(t, ta, "charge.dispute.created", "whsec_wrong")
+	if status != http.StatusBadRequest {
+		t.Fatalf("wrongly signed event: status %d, want 400", status)
+	}
+	if got := orderStatus(t, ta, id); got != models.OrderPaid {
+		t.Errorf("wrongly signed event moved the order to %s", got)
+	}
+}
+
+func TestStripeWebhookDispatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		fixtures []string
+		want     models.OrderStatus
+	}{
+		{"dispute opened", []string{"charge.dispute.created"}, models.OrderDisputed},
+		{"dispute lost", []string{"charge.dispute.created", "charge.dispute.closed"}, models.OrderRefunded},
+		{"dispute won", []string{"charge.dispute.created", "charge.dispute.won"}, models.OrderPaid},
+		{"refunded", []string{"charge.refunded"}, models.OrderRefunded},
+		{"partially refunded", []string{"charge.refunded.partial"}, models.OrderPartiallyRefunded},
+		{"payment failed", []string{"payment_intent.payment_failed"}, models.OrderCancelled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t)
+			id := paidOrder(t, ta)
+
+			for _, fixture := range tt.fixtures {
+				status, msg := postWebhook(t, ta, fixture, ta.config.stripe.webhook)
+				if status != http.StatusOK {
+					t.Fatalf("%s: status %d, %s", fixture, status, msg)
+				}
+			}
+			if got := orderStatus(t, ta, id); got != tt.want {
+				t.Errorf("order is %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripeWebhookDisputeWon(t *testing.T) {
+	ta := newTestApp(t)
+	id := paidOrder(t, ta)
+	for _, to := range []models.OrderStatus{models.OrderFulfilled, models.OrderShipped} {
+		if err := ta.db.UpdateOrderStatus(id, to, models.StatusChange{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, fixture := range []string{"charge.dispute.created", "charge.dispute.won"} {
+		if status, msg := postWebhook(t, ta, fixture, ta.config.stripe.webhook); status != http.StatusOK {
+			t.Fatalf("%s: status %d, %s", fixture, status, msg)
+		}
+	}
+	if got := orderStatus(t, ta, id); got != models.OrderShipped {
+		t.Errorf("after a won dispute the order is %s, want Shipped as before it", got)
+	}
+}
+
+func TestStripeWebhookDashboardRefunds(t *testing.T) {
+	ta := newTestApp(t)
+	id := paidOrder(t, ta)
+	secret := ta.config.stripe.webhook
+
+	if status, msg := postWebhook(t, ta, "charge.refunded.partial", secret); status != http.StatusOK {
+		t.Fatalf("partial refund: status %d, %s", status, msg)
+	}
+	refunds, err := ta.db.GetRefundsForOrder(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 1 || refunds[0].Amount != 1000 || refunds[0].StripeRefundID != "re_fixture" {
+		t.Fatalf("after a partial refund in Stripe the refunds are %+v, want one of 1000 as re_fixture", refunds)
+	}
+	if got := orderStatus(t, ta, id); got != models.OrderPartiallyRefunded {
+		t.Errorf("after a partial refund the order is %s, want Partially Refunded", got)
+	}
+
+	// the full refund event does not list its refunds, so the rest is recorded as one
+	if status, msg := postWebhook(t, ta, "charge.refunded", secret); status != http.StatusOK {
+		t.Fatalf("full refund: status %d, %s", status, msg)
+	}
+	refunds, err = ta.db.GetRefundsForOrder(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 2 || refunds[0].Amount != 1500 {
+		t.Errorf("after the full refund the refunds are %+v, want a second one of 1500", refunds)
+	}
+	order, err := ta.db.GetOrderByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.StatusID != models.OrderRefunded || order.Transaction.TransactionStatusID != TransactionRefunded {
+		t.Errorf("after the full refund the order is %s with transaction status %d, want Refunded and %d",
+			order.StatusID, order.Transaction.TransactionStatusID, TransactionRefunded)
+	}
+}
+
+func TestStripeWebhookRefundMadeHere(t *testing.T) {
+	ta := newTestApp(t)
+	id := paidOrder(t, ta)
+	order, err := ta.db.GetOrderByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an admin refund is recorded before Stripe reports it
+	_, err = ta.db.SaveRefund(models.Refund{
+		OrderID:        id,
+		TransactionID:  order.TransactionID,
+		Amount:         1000,
+		Currency:       "usd",
+		StripeRefundID: "re_fixture",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, msg := postWebhook(t, ta, "charge.refunded.partial", ta.config.stripe.webhook); status != http.StatusOK {
+		t.Fatalf("status %d, %s", status, msg)
+	}
+
+	refunds, err := ta.db.GetRefundsForOrder(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refunds) != 1 {
+		t.Errorf("a refund made here was recorded %d times, want once", len(refunds))
+	}
+	history, err := ta.db.GetOrderStatusHistory(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("a refund made here moved the order %d times, want once", len(history))
+	}
+}
+
+func TestStripeWebhookRedelivery(t *testing.T) {
+	ta := newTestApp(t)
+	paidOrder(t, ta)
+	secret := ta.config.stripe.webhook
+
+	if status, msg := postWebhook(t, ta, "charge.dispute.created", secret); status != http.StatusOK {
+		t.Fatalf("first delivery: status %d, %s", status, msg)
+	}
+	status, msg := postWebhook(t, ta, "charge.dispute.created", secret)
+	if status != http.StatusOK || msg != "event evt_dispute_created already processed" {
+		t.Errorf("redelivery: status %d, %q", status, msg)
+	}
+
+	history, err := ta.db.GetOrderStatusHistory(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("redelivery recorded %d status changes, want 1", len(history))
+	}
+}
+
+func TestStripeWebhookInvalidTransition(t *testing.T) {
+	ta := newTestApp(t)
+	id := paidOrder(t, ta)
+	secret := ta.config.stripe.webhook
+
+	postWebhook(t, ta, "charge.refunded", secret)
+	status, msg := postWebhook(t, ta, "payment_intent.payment_failed", secret)
+	if status != http.StatusOK || msg != "event evt_payment_failed ignored" {
+		t.Errorf("invalid transition: status %d, %q", status, msg)
+	}
+	if got := orderStatus(t, ta, id); got != models.OrderRefunded {
+		t.Errorf("order is %s, want Refunded", got)
+	}
+}
+
+func TestStripeWebhookClaimed(t *testing.T) {
+	ta := newTestApp(t)
+	id := paidOrder(t, ta)
+
+	// another delivery of the same event is still being processed
+	_, err := ta.db.InsertWebhookEvent(models.WebhookEvent{EventID: "evt_dispute_created", EventType: "charge.dispute.created"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, _ := postWebhook(t, ta, "charge.dispute.created", ta.config.stripe.webhook)
+	if status != http.StatusConflict {
+		t.Fatalf("event being processed: status %d, want 409", status)
+	}
+	if got := orderStatus(t, ta, id); got != models.OrderPaid {
+		t.Errorf("event being processed was dispatched again; order is %s", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wtran29/go-ecommerce/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// creditNoteEmail is the data of the credit note email templates
+type creditNoteEmail struct {
+	Number        string
+	InvoiceNumber string
+	Amount        string
+	Reason        string
+}
+
+// runCreditNoteJob issues the credit note for a refund against the invoice of its
+// order and emails it to the customer. The job id is the reference of the note, so a
+// job that is run again finds the note it already issued, and sends it only if that
+// did not happen the first time.
+func (app *application) runCreditNoteJob(job models.Job) (err error) {
+	// the pdf library panics on a broken template; fail the job rather than the worker
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("credit note job panicked: %v", p)
+		}
+	}()
+
+	var refund models.CreditNoteJob
+	err = json.Unmarshal(job.Payload, &refund)
+	if err != nil {
+		return err
+	}
+
+	inv, err := app.orderInvoice(refund.OrderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		// the invoice job of the order may not have run yet; try again later
+		return fmt.Errorf("order %d has no invoice to credit yet", refund.OrderID)
+	}
+	if err != nil {
+		return err
+	}
+
+	currency := refund.Currency
+	if currency == "" {
+		currency = inv.Currency
+	}
+
+	cn, err := app.DB.IssueCreditNote(models.CreditNote{
+		InvoiceID: inv.ID,
+		OrderID:   refund.OrderID,
+		Email:     inv.Email,
+		Currency:  currency,
+		Amount:    refund.Amount,
+		Reason:    refund.Reason,
+		Reference: fmt.Sprintf("job-%d", job.ID),
+		IssuedAt:  time.Now(),
+	}, app.config.invoice.credits)
+	if err != nil {
+		return err
+	}
+	if cn.Status == models.InvoiceSent {
+		return nil
+	}
+
+	o, err := app.DB.GetOrderByID(cn.OrderID)
+	if err != nil {
+		return err
+	}
+	order := Order{
+		ID:        o.ID,
+		FirstName: o.Customer.FirstName,
+		LastName:  o.Customer.LastName,
+		Email:     cn.Email,
+	}
+
+	pdf, err := renderCreditNote(app.config.invoice.layout, app.config.invoice.brand, order, cn)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	sum, err := app.Files.Put(ctx, pdf)
+	if err != nil {
+		return err
+	}
+	err = app.DB.SetCreditNoteChecksum(cn.ID, sum)
+	if err != nil {
+		return err
+	}
+
+	attachment := &mail.File{
+		Name:     cn.Number + ".pdf",
+		MimeType: "application/pdf",
+		Data:     pdf,
+	}
+	data := creditNoteEmail{
+		Number:        cn.Number,
+		InvoiceNumber: cn.InvoiceNumber,
+		Amount:        formatMoney(cn.Amount, cn.Currency),
+		Reason:        cn.Reason,
+	}
+	err = app.SendEmail("info@ecomm.com", cn.Email, fmt.Sprintf("Your credit note %s", cn.Number), "credit-note", []*mail.File{attachment}, data)
+	if err != nil {
+		return err
+	}
+	return app.DB.MarkCreditNoteSent(cn.ID)
+}
+
+// orderInvoice returns the invoice of an order that is not void
+func (app *application) orderInvoice(orderID int) (models.Invoice, error) {
+	invoices, err := app.DB.GetInvoicesForOrder(orderID)
+	if err != nil {
+		return models.Invoice{}, err
+	}
+	for _, inv := range invoices {
+		if inv.Status != models.InvoiceVoid {
+			return *inv, nil
+		}
+	}
+	return models.Invoice{}, sql.ErrNoRows
+}
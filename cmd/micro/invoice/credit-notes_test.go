@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// creditNoteJob is a credit note job for a refund of an order
+func creditNoteJob(t *testing.T, id, orderID, amount int) models.Job {
+	t.Helper()
+
+	job, err := models.NewJob(models.JobKindCreditNote, models.CreditNoteJob{OrderID: orderID, Amount: amount, Reason: "damaged"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.ID = id
+	return job
+}
+
+// creditNotes returns the credit notes of an order, oldest first
+func creditNotes(t *testing.T, ta *testApp, orderID int) []*models.CreditNote {
+	t.Helper()
+
+	notes, err := ta.db.GetCreditNotesForOrder(orderID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, j := 0, len(notes)-1; i < j; i, j = i+1, j-1 {
+		notes[i], notes[j] = notes[j], notes[i]
+	}
+	return notes
+}
+
+func TestCreditNoteJob(t *testing.T) {
+	ta := newTestApp(t)
+	year := time.Now().UTC().Year()
+
+	// the refund of an order that has no invoice yet waits for it
+	if err := ta.runCreditNoteJob(creditNoteJob(t, 1, 1, 1000)); err == nil {
+		t.Fatal("a credit note was issued for an order without an invoice")
+	}
+
+	inv := issuedInvoice(t, ta)
+
+	// there is no mail server here, so each run fails after the note is issued and stored
+	if err := ta.runCreditNoteJob(creditNoteJob(t, 1, inv.OrderID, 1000)); err == nil {
+		t.Fatal("sending the credit note did not fail")
+	}
+	notes := creditNotes(t, ta, inv.OrderID)
+	if len(notes) != 1 {
+		t.Fatalf("%d credit notes, want 1", len(notes))
+	}
+	cn := notes[0]
+	if want := ta.config.invoice.credits.Format(year, 1); cn.Number != want {
+		t.Errorf("credit note number %s, want %s", cn.Number, want)
+	}
+	if cn.Amount != 1000 || cn.Currency != "usd" || cn.InvoiceNumber != inv.Number || cn.Email != inv.Email || cn.Reason != "damaged" {
+		t.Errorf("credit note %+v, want 1000 usd against %s for %s", cn, inv.Number, inv.Email)
+	}
+
+	pdf, err := ta.Files.Get(context.Background(), cn.Checksum)
+	if err != nil {
+		t.Fatalf("the credit note pdf was not stored: %s", err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) || checksum(pdf) != cn.Checksum {
+		t.Errorf("stored credit note is not the pdf its checksum names")
+	}
+
+	// a retried job finds the note it issued
+	if err := ta.runCreditNoteJob(creditNoteJob(t, 1, inv.OrderID, 1000)); err == nil {
+		t.Fatal("sending the credit note did not fail")
+	}
+	if notes := creditNotes(t, ta, inv.OrderID); len(notes) != 1 {
+		t.Fatalf("a retried job issued %d credit notes, want 1", len(notes))
+	}
+
+	// the rest of the invoice
+	ta.runCreditNoteJob(creditNoteJob(t, 2, inv.OrderID, 1500))
+	notes = creditNotes(t, ta, inv.OrderID)
+	if len(notes) != 2 || notes[1].Number != ta.config.invoice.credits.Format(year, 2) {
+		t.Fatalf("credit notes after the second refund: %+v", notes)
+	}
+	if got, err := ta.db.GetInvoiceByNumber(inv.Number); err != nil || got.Status != models.InvoiceCredited {
+		t.Errorf("fully credited invoice is %q, %v; want %q", got.Status, err, models.InvoiceCredited)
+	}
+
+	// nothing is left to credit
+	err = ta.runCreditNoteJob(creditNoteJob(t, 3, inv.OrderID, 1))
+	if !errors.Is(err, models.ErrCreditExceedsInvoice) {
+		t.Errorf("crediting more than the invoice: error = %v, want ErrCreditExceedsInvoice", err)
+	}
+}
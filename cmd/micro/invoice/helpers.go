@@ -5,7 +5,6 @@ import (
 	"errors"
 	"io"
 	"net/http"
-	"os"
 )
 
 // writeJSON writes arbitrary data out as JSON
@@ -67,14 +66,41 @@ func (app *application) badRequest(w http.ResponseWriter, r *http.Request, err e
 	return nil
 }
 
-func (app *application) CreateDirIfNotExist(path string) error {
-	const mode = 0755
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err := os.Mkdir(path, mode)
-		if err != nil {
-			app.logger.Error(err.Error())
-			return err
-		}
+// forbidden tells the caller its link is not valid or has expired
+func (app *application) forbidden(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
 	}
-	return nil
+
+	payload.Error = true
+	payload.Message = "this link is not valid or has expired"
+
+	return app.writeJSON(w, http.StatusForbidden, payload)
+}
+
+// linkUsed tells the caller its single-use link has been used already
+func (app *application) linkUsed(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "this link has been used already"
+
+	return app.writeJSON(w, http.StatusGone, payload)
+}
+
+// notFound tells the caller there is no such invoice
+func (app *application) notFound(w http.ResponseWriter) error {
+	var payload struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+
+	payload.Error = true
+	payload.Message = "invoice not found"
+
+	return app.writeJSON(w, http.StatusNotFound, payload)
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/wtran29/go-ecommerce/internal/models"
+	"github.com/wtran29/go-ecommerce/internal/urlsigner"
+	mail "github.com/xhit/go-simple-mail/v2"
+)
+
+// invoiceEmail is the data of the invoice email templates
+type invoiceEmail struct {
+	Number      string
+	Link        string
+	LinkExpires time.Time
+}
+
+// DownloadInvoice serves the pdf of an invoice, given as ?number= or as ?order= for
+// the current invoice of an order. The link must be signed and not yet expired.
+func (app *application) DownloadInvoice(w http.ResponseWriter, r *http.Request) {
+	if !app.signer().ValidUntilExpiry(r.RequestURI) {
+		app.forbidden(w)
+		return
+	}
+
+	inv, err := app.findInvoice(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.notFound(w)
+		return
+	}
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	pdf, err := app.invoicePDF(inv)
+	if err != nil {
+		app.logger.Error(err.Error())
+		app.badRequest(w, r, errors.New("could not get the invoice pdf"))
+		return
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.pdf"`, inv.Number))
+	http.ServeContent(w, r, inv.Number+".pdf", inv.UpdatedAt, bytes.NewReader(pdf))
+}
+
+// ResendInvoice emails an invoice again, given as ?number= or ?order=, to ?email= or
+// else the address it was first sent to. The link must be signed and not yet expired,
+// and works once: ?resend= is how often the invoice had been resent when it was made.
+func (app *application) ResendInvoice(w http.ResponseWriter, r *http.Request) {
+	if !app.signer().ValidUntilExpiry(r.RequestURI) {
+		app.forbidden(w)
+		return
+	}
+
+	inv, err := app.findInvoice(r)
+	if errors.Is(err, sql.ErrNoRows) {
+		app.notFound(w)
+		return
+	}
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	seen, err := strconv.Atoi(r.URL.Query().Get("resend"))
+	if err != nil {
+		app.forbidden(w)
+		return
+	}
+	claimed, err := app.DB.ClaimInvoiceResend(inv.ID, seen)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+	if !claimed {
+		app.linkUsed(w)
+		return
+	}
+
+	to := r.URL.Query().Get("email")
+	if to == "" {
+		to = inv.Email
+	}
+
+	err = app.resendInvoice(inv, to)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	var resp struct {
+		Error   bool   `json:"error"`
+		Message string `json:"message"`
+	}
+	resp.Error = false
+	resp.Message = fmt.Sprintf("Invoice %s sent to %s", inv.Number, to)
+	app.writeJSON(w, http.StatusOK, resp)
+}
+
+// findInvoice returns the invoice asked for by number, or the invoice of an order
+// that is not void
+func (app *application) findInvoice(r *http.Request) (models.Invoice, error) {
+	q := r.URL.Query()
+	if number := q.Get("number"); number != "" {
+		return app.DB.GetInvoiceByNumber(number)
+	}
+
+	orderID, err := strconv.Atoi(q.Get("order"))
+	if err != nil {
+		return models.Invoice{}, errors.New("an invoice number or order id is required")
+	}
+	return app.orderInvoice(orderID)
+}
+
+// resendInvoice emails an issued invoice to an address. An invoice that was never
+// sent counts as sent once it reaches its own address.
+func (app *application) resendInvoice(inv models.Invoice, to string) error {
+	pdf, err := app.invoicePDF(inv)
+	if err != nil {
+		return err
+	}
+
+	err = app.SendEmail("info@ecomm.com", to, fmt.Sprintf("Your invoice %s", inv.Number), "invoice", []*mail.File{invoiceAttachment(inv, pdf)}, app.invoiceEmailData(inv))
+	if err != nil {
+		return err
+	}
+	if inv.Status == models.InvoiceIssued && to == inv.Email {
+		return app.DB.MarkInvoiceSent(inv.ID)
+	}
+	return nil
+}
+
+// invoicePDF returns the stored pdf of an invoice, checking it still matches the
+// checksum recorded when it was made. An invoice whose pdf was never made or is gone
+// gets a new one made from its order.
+func (app *application) invoicePDF(inv models.Invoice) (pdf []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if inv.Checksum != "" {
+		pdf, err = app.Files.Get(ctx, inv.Checksum)
+		if err == nil {
+			if checksum(pdf) != inv.Checksum {
+				return nil, fmt.Errorf("invoice %s: %w", inv.Number, errPDFTampered)
+			}
+			return pdf, nil
+		}
+		if !errors.Is(err, errPDFNotFound) {
+			return nil, err
+		}
+		app.logger.Info(fmt.Sprintf("pdf of invoice %s is missing, making it again", inv.Number))
+	}
+
+	// the pdf library panics on a broken template
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("creating invoice %s panicked: %v", inv.Number, p)
+		}
+	}()
+
+	o, err := app.DB.GetOrderByID(inv.OrderID)
+	if err != nil {
+		return nil, err
+	}
+
+	order := Order{
+		ID:        o.ID,
+		FirstName: o.Customer.FirstName,
+		LastName:  o.Customer.LastName,
+		Email:     inv.Email,
+		Amount:    o.Amount,
+		Discount:  o.Discount,
+		Tax:       o.Tax,
+		Currency:  inv.Currency,
+		CreatedAt: o.CreatedAt,
+	}
+	for _, l := range o.Items {
+		order.Products = append(order.Products, Product{Name: l.Item.Name, Amount: l.UnitPrice, Quantity: l.Quantity})
+	}
+
+	_, pdf, err = app.storeInvoicePDF(order, inv)
+	return pdf, err
+}
+
+// invoiceEmailData returns what the invoice email shows, including a signed link to
+// download the invoice that works for the configured number of days
+func (app *application) invoiceEmailData(inv models.Invoice) invoiceEmail {
+	expires := time.Now().AddDate(0, 0, app.config.invoice.linkDays)
+	link := fmt.Sprintf("/invoice/download?number=%s", url.QueryEscape(inv.Number))
+
+	return invoiceEmail{
+		Number:      inv.Number,
+		Link:        app.config.publicURL + app.signer().GenerateExpiringToken(link, expires),
+		LinkExpires: expires,
+	}
+}
+
+func (app *application) signer() *urlsigner.Signer {
+	return &urlsigner.Signer{
+		Secret: []byte(app.config.secretkey),
+	}
+}
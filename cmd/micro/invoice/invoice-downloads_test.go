@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestResendLinkWorksOnce(t *testing.T) {
+	ta := newTestApp(t)
+	inv := issuedInvoice(t, ta)
+
+	resend := func(seen int) int {
+		path := fmt.Sprintf("/invoice/resend?number=%s&resend=%d", inv.Number, seen)
+		link := ta.signer().GenerateExpiringToken(path, time.Now().Add(time.Minute))
+		rec := httptest.NewRecorder()
+		ta.routes().ServeHTTP(rec, httptest.NewRequest("POST", link, nil))
+		return rec.Code
+	}
+
+	// there is no mail server here, so sending fails, but the link is used up
+	if status := resend(0); status == http.StatusGone || status == http.StatusForbidden {
+		t.Fatalf("first use of the link: status %d", status)
+	}
+	if got, err := ta.db.GetInvoiceByNumber(inv.Number); err != nil || got.Resends != 1 {
+		t.Fatalf("after one use resends = %d, %v; want 1", got.Resends, err)
+	}
+	if status := resend(0); status != http.StatusGone {
+		t.Errorf("second use of the link: status %d, want 410", status)
+	}
+	if status := resend(1); status == http.StatusGone {
+		t.Errorf("a link made after the first was used: status %d", status)
+	}
+}
@@ -1,12 +1,11 @@
 package main
 
 import (
-	"fmt"
-	"net/http"
+	"context"
 	"time"
 
-	"github.com/phpdave11/gofpdf"
-	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+	"github.com/wtran29/go-ecommerce/internal/models"
+	mail "github.com/xhit/go-simple-mail/v2"
 )
 
 type Order struct {
@@ -14,7 +13,11 @@ type Order struct {
 	FirstName string    `json:"first_name"`
 	LastName  string    `json:"last_name"`
 	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"-"`
+	Amount    int       `json:"amount"`
+	Discount  int       `json:"discount"`
+	Tax       int       `json:"tax"`
+	Currency  string    `json:"currency"`
+	CreatedAt time.Time `json:"created_at"`
 	Products  []Product `json:"products"`
 }
 
@@ -24,107 +27,90 @@ type Product struct {
 	Quantity int
 }
 
-func (app *application) CreateAndSendInvoice(w http.ResponseWriter, r *http.Request) {
-	// receive json
-	var order Order
-
-	err := app.readJSON(w, r, &order)
+// sendInvoice issues the invoice of an order and emails it to the customer. An order
+// whose invoice was already sent gets no second email.
+func (app *application) sendInvoice(order Order) (models.Invoice, error) {
+	inv, err := app.issueInvoice(order)
 	if err != nil {
-		app.badRequest(w, r, err)
-		return
+		return inv, err
+	}
+	if inv.Status == models.InvoiceSent {
+		return inv, nil
 	}
 
-	// order.ID = 100
-	// order.Email = "me@here.com"
-	// order.FirstName = "John"
-	// order.LastName = "Smith"
-	// products := []Product{
-	// 	{Name: "item", Amount: 1000, Quantity: 1},
-	// 	{Name: "bottle", Amount: 1000, Quantity: 3},
-	// 	{Name: "machine gun", Amount: 1000, Quantity: 1},
-	// }
-
-	// order.Products = products
-	// order.CreatedAt = time.Now()
-
-	// order.Quantity = 1
-	// order.Amount = 1000
-	// order.Product = "Item"
-
-	// generate pdf invoice
-	err = app.createInvoicePDF(order)
+	inv, pdf, err := app.storeInvoicePDF(order, inv)
 	if err != nil {
-		app.badRequest(w, r, err)
-		return
+		return inv, err
 	}
-	// create mail
 
-	attachments := []string{
-		fmt.Sprintf("./invoices/%d.pdf", order.ID),
-	}
-	// send mail with attachment
-	err = app.SendEmail("info@ecomm.com", order.Email, "Your invoice", "invoice", attachments, nil)
+	err = app.SendEmail("info@ecomm.com", order.Email, "Your invoice", "invoice", []*mail.File{invoiceAttachment(inv, pdf)}, app.invoiceEmailData(inv))
 	if err != nil {
-		app.badRequest(w, r, err)
-		return
+		return inv, err
 	}
-	// send response
-	var resp struct {
-		Error   bool   `json:"error"`
-		Message string `json:"message"`
-	}
-	resp.Error = false
-	resp.Message = fmt.Sprintf("Invoice %d.pdf created and sent to %s", order.ID, order.Email)
-	app.writeJSON(w, http.StatusCreated, resp)
+	return inv, app.DB.MarkInvoiceSent(inv.ID)
 }
 
-func (app *application) createInvoicePDF(order Order) error {
-	pdf := gofpdf.New("P", "mm", "Letter", "")
-	pdf.SetMargins(10, 13, 10)
-	pdf.SetAutoPageBreak(true, 0)
-
-	importer := gofpdi.NewImporter()
-
-	t := importer.ImportPage(pdf, "./pdf-templates/invoice.pdf", 1, "/MediaBox")
-
-	pdf.AddPage()
-	importer.UseImportedTemplate(pdf, t, 0, 0, 215.9, 0)
-
-	// write info
-	pdf.SetY(50)
-	pdf.SetX(10)
-	pdf.SetFont("Times", "", 11)
-	pdf.CellFormat(97, 8, fmt.Sprintf("Attention: %s %s", order.FirstName, order.LastName), "", 0, "L", false, 0, "")
+// issueInvoice numbers and records the invoice of an order, or returns the one it
+// already has
+func (app *application) issueInvoice(order Order) (models.Invoice, error) {
+	subtotal := 0
+	for _, p := range order.Products {
+		subtotal += p.Amount * p.Quantity
+	}
+	// jobs queued before totals were recorded only have their lines
+	total := order.Amount
+	if total == 0 {
+		total = subtotal
+	}
+	currency := order.Currency
+	if currency == "" {
+		currency = "usd"
+	}
 
-	pdf.Ln(5)
-	pdf.CellFormat(97, 8, order.Email, "", 0, "L", false, 0, "")
-	pdf.Ln(5)
-	pdf.CellFormat(97, 8, order.CreatedAt.Format("01/02/2006"), "", 0, "L", false, 0, "")
+	issuedAt := time.Now()
+	return app.DB.IssueInvoice(models.Invoice{
+		OrderID:  order.ID,
+		Email:    order.Email,
+		Currency: currency,
+		Subtotal: subtotal,
+		Total:    total,
+		IssuedAt: issuedAt,
+		DueAt:    issuedAt.AddDate(0, 0, app.config.invoice.dueDays),
+	}, app.config.invoice.numbering)
+}
 
-	h := 0.0
-	total := 0.0
-	for _, product := range order.Products {
+// storeInvoicePDF makes the pdf of an invoice, saves it and records its checksum
+func (app *application) storeInvoicePDF(order Order, inv models.Invoice) (models.Invoice, []byte, error) {
+	pdf, err := app.createInvoicePDF(order, inv)
+	if err != nil {
+		return inv, nil, err
+	}
 
-		pdf.SetX(58)
-		pdf.SetY(93 + h)
-		pdf.CellFormat(155, 8, product.Name, "", 0, "L", false, 0, "")
-		pdf.SetX(166)
-		pdf.CellFormat(20, 8, fmt.Sprintf("%d", product.Quantity), "", 0, "C", false, 0, "")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
 
-		pdf.SetX(185)
-		pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", float32(product.Quantity*(product.Amount/100.00))), "", 0, "R", false, 0, "")
-		// pdf.Ln(10)
-		h += 5
-		total += (float64(product.Quantity * (product.Amount / 100.00)))
+	sum, err := app.Files.Put(ctx, pdf)
+	if err != nil {
+		return inv, nil, err
 	}
-	pdf.SetY(240)
-	pdf.SetX(185)
-	pdf.CellFormat(20, 8, fmt.Sprintf("$%.2f", total), "", 0, "R", false, 0, "")
-
-	invoicePath := fmt.Sprintf("./invoices/%d.pdf", order.ID)
-	err := pdf.OutputFileAndClose(invoicePath)
+	err = app.DB.SetInvoiceChecksum(inv.ID, sum)
 	if err != nil {
-		return err
+		return inv, nil, err
+	}
+	inv.Checksum = sum
+	return inv, pdf, nil
+}
+
+// invoiceAttachment is the pdf of an invoice as an email attachment
+func invoiceAttachment(inv models.Invoice, pdf []byte) *mail.File {
+	return &mail.File{
+		Name:     inv.Number + ".pdf",
+		MimeType: "application/pdf",
+		Data:     pdf,
 	}
-	return nil
+}
+
+// createInvoicePDF draws the invoice of an order with the configured layout and branding
+func (app *application) createInvoicePDF(order Order, inv models.Invoice) ([]byte, error) {
+	return renderInvoice(app.config.invoice.layout, app.config.invoice.brand, order, inv)
 }
@@ -18,7 +18,8 @@ func (app *application) routes() http.Handler {
 		MaxAge:           300,
 	}))
 
-	mux.Post("/invoice/create-and-send", app.CreateAndSendInvoice)
+	mux.Get("/invoice/download", app.DownloadInvoice)
+	mux.Post("/invoice/resend", app.ResendInvoice)
 
 	return mux
 
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -8,15 +10,21 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/wtran29/go-ecommerce/internal/driver"
+	"github.com/wtran29/go-ecommerce/internal/models"
 )
 
 const version = "1.0.0"
 
 type config struct {
 	port int
+	db   struct {
+		dsn string
+	}
 	smtp struct {
 		host     string
 		port     int
@@ -24,46 +32,146 @@ type config struct {
 		password string
 	}
 
-	frontend string
+	invoice struct {
+		numbering models.InvoiceNumbering
+		credits   models.InvoiceNumbering // numbering of credit notes
+		dueDays   int
+		linkDays  int // how long download links in invoice emails work
+		layout    Layout
+		brand     Branding
+	}
+
+	storage struct {
+		backend string
+		root    string
+		s3      struct {
+			endpoint  string
+			region    string
+			bucket    string
+			prefix    string
+			accessKey string
+			secretKey string
+		}
+	}
+
+	secretkey string
+	publicURL string // address customers download invoices from
+	frontend  string
+	workers   int
 }
 
 type application struct {
 	config  config
 	logger  *slog.Logger
 	version string
+	DB      models.Repository
+	Files   InvoiceStore
 }
 
 func main() {
 	var cfg config
 
 	flag.IntVar(&cfg.port, "port", 5000, "Server port to listen on")
+	flag.StringVar(&cfg.db.dsn, "dsn", fmt.Sprintf("host=%v port=%v user=%v password=%v dbname=%v sslmode=disable timezone=UTC connect_timeout=5",
+		os.Getenv("ECOMM_HOST"), os.Getenv("ECOMM_PORT"), os.Getenv("ECOMM_USER"), os.Getenv("ECOMM_PW"), os.Getenv("ECOMM_DBNAME")), "DSN")
+	flag.IntVar(&cfg.workers, "workers", 1, "Number of invoice jobs to work on at once")
+	flag.StringVar(&cfg.invoice.numbering.Prefix, "invoice-prefix", "INV", "Invoice number prefix")
+	flag.IntVar(&cfg.invoice.numbering.Digits, "invoice-digits", 6, "Digits in the yearly part of invoice numbers")
+	flag.StringVar(&cfg.invoice.credits.Prefix, "credit-note-prefix", "CN", "Credit note number prefix")
+	flag.IntVar(&cfg.invoice.dueDays, "invoice-due-days", 30, "Days after issue an invoice is due")
+	flag.IntVar(&cfg.invoice.linkDays, "invoice-link-days", 30, "Days the download link in an invoice email works")
 	flag.StringVar(&cfg.smtp.host, "smtphost", os.Getenv("SMTPHOST"), "smtp host")
 	flag.StringVar(&cfg.smtp.username, "smtpuser", os.Getenv("SMTPUSER"), "smtp user")
 	flag.StringVar(&cfg.smtp.password, "smtppass", os.Getenv("SMTPPW"), "smtp password")
 	smptport, _ := strconv.Atoi(os.Getenv("SMTPPORT"))
 	flag.IntVar(&cfg.smtp.port, "smtpport", smptport, "smtp port")
+	layoutFile := flag.String("invoice-layout", "", "JSON file with the invoice layout, over the default one")
+	flag.StringVar(&cfg.invoice.brand.Name, "brand-name", "Go Ecommerce", "Store name printed on invoices")
+	brandAddress := flag.String("brand-address", "", "Store address printed on invoices, lines separated by |")
+	flag.StringVar(&cfg.invoice.brand.Logo, "brand-logo", "", "PNG or JPEG logo printed on invoices")
+	flag.StringVar(&cfg.invoice.brand.Color, "brand-color", "#3869D4", "Hex color of invoice headings")
+	flag.StringVar(&cfg.invoice.brand.Footer, "brand-footer", "Thank you for your business", "Footer printed on invoices")
+	flag.StringVar(&cfg.storage.backend, "storage", "local", "Where invoice pdfs are kept {local|s3}")
+	flag.StringVar(&cfg.storage.root, "storage-root", "./invoices", "Directory of invoice pdfs for local storage")
+	flag.StringVar(&cfg.storage.s3.endpoint, "s3-endpoint", os.Getenv("S3_ENDPOINT"), "S3 compatible endpoint for invoice pdfs")
+	flag.StringVar(&cfg.storage.s3.region, "s3-region", "us-east-1", "S3 region")
+	flag.StringVar(&cfg.storage.s3.bucket, "s3-bucket", os.Getenv("S3_BUCKET"), "S3 bucket for invoice pdfs")
+	flag.StringVar(&cfg.storage.s3.prefix, "s3-prefix", "invoices/", "Prefix of invoice pdf keys in the bucket")
+	flag.StringVar(&cfg.storage.s3.accessKey, "s3-access-key", os.Getenv("S3_ACCESS_KEY"), "S3 access key")
+	flag.StringVar(&cfg.storage.s3.secretKey, "s3-secret-key", os.Getenv("S3_SECRET_KEY"), "S3 secret key")
+	flag.StringVar(&cfg.secretkey, "secret", os.Getenv("SKEY"), "secret key")
+	flag.StringVar(&cfg.publicURL, "public-url", "http://localhost:5000", "url customers download invoices from")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "url for frontend")
 
 	flag.Parse()
 
+	cfg.invoice.credits.Digits = cfg.invoice.numbering.Digits
+
+	if *brandAddress != "" {
+		cfg.invoice.brand.Address = strings.Split(*brandAddress, "|")
+	}
+	var err error
+	cfg.invoice.layout, err = LoadLayout(*layoutFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	jsonLogger := slog.NewJSONHandler(os.Stdout, nil)
 	logger := slog.New(jsonLogger)
 
+	conn, err := driver.OpenDB(cfg.db.dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	files, err := openInvoiceStore(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	app := &application{
 		config:  cfg,
 		logger:  logger,
 		version: version,
+		DB:      &models.DBModel{DB: conn},
+		Files:   files,
 	}
 
-	app.CreateDirIfNotExist("./invoices")
+	for i := 0; i < cfg.workers; i++ {
+		go app.runInvoiceWorker(context.Background())
+	}
 
-	err := app.serve()
+	err = app.serve()
 	if err != nil {
-		app.logger.Error("Error starting backend server", err)
+		app.logger.Error("Error starting backend server", "error", err)
 		log.Fatal(err)
 	}
 }
 
+// openInvoiceStore returns the store for invoice pdfs the config asks for
+func openInvoiceStore(cfg config) (InvoiceStore, error) {
+	switch cfg.storage.backend {
+	case "local":
+		return NewLocalStore(cfg.storage.root)
+	case "s3":
+		if cfg.storage.s3.endpoint == "" || cfg.storage.s3.bucket == "" {
+			return nil, errors.New("s3 storage needs -s3-endpoint and -s3-bucket")
+		}
+		return &S3Store{
+			Endpoint:  cfg.storage.s3.endpoint,
+			Region:    cfg.storage.s3.region,
+			Bucket:    cfg.storage.s3.bucket,
+			Prefix:    cfg.storage.s3.prefix,
+			AccessKey: cfg.storage.s3.accessKey,
+			SecretKey: cfg.storage.s3.secretKey,
+			Client:    &http.Client{Timeout: 20 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q", cfg.storage.backend)
+	}
+}
+
 func (app *application) serve() error {
 	srv := &http.Server{
 		Addr:              fmt.Sprintf(":%d", app.config.port),
@@ -71,7 +179,8 @@ func (app *application) serve() error {
 		IdleTimeout:       30 * time.Second,
 		ReadTimeout:       10 * time.Second,
 		ReadHeaderTimeout: 5 * time.Second,
-		WriteTimeout:      5 * time.Second,
+		// resending an invoice waits for the mail server
+		WriteTimeout: 30 * time.Second,
 	}
 
 	app.logger.Info(fmt.Sprintf("Starting invoice microservice on port %d", app.config.port))
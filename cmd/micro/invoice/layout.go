@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/phpdave11/gofpdf"
+	"github.com/phpdave11/gofpdf/contrib/gofpdi"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// Branding is how a store's invoices look
+type Branding struct {
+	Name    string   `json:"name"`
+	Address []string `json:"address"`
+	Logo    string   `json:"logo"`  // path of a png or jpeg printed in the header
+	Color   string   `json:"color"` // hex, such as #3869D4, for headings and the total
+	Footer  string   `json:"footer"`
+}
+
+// Layout describes an invoice page as bands stacked from the top: the header on every
+// page, the address block on the first, then the line table, which carries on over as
+// many pages as it needs with its heading repeated, then the totals. The footer with
+// the page number sits at the bottom of every page. Sizes are in millimetres.
+type Layout struct {
+	PageSize   string      `json:"page_size"` // A4, Letter or Legal
+	Margin     float64     `json:"margin"`
+	Font       string      `json:"font"` // Helvetica, Times or Courier
+	FontSize   float64     `json:"font_size"`
+	Background string      `json:"background"` // optional pdf whose first page is drawn under every page
+	Header     Band        `json:"header"`
+	Address    Band        `json:"address"`
+	Table      TableLayout `json:"table"`
+	Totals     Band        `json:"totals"`
+	Footer     Band        `json:"footer"`
+}
+
+// Band is a strip across the page
+type Band struct {
+	Height float64 `json:"height"`
+}
+
+// TableLayout is the table of invoice lines
+type TableLayout struct {
+	RowHeight float64  `json:"row_height"`
+	Columns   []Column `json:"columns"`
+}
+
+// Column is a column of the line table
+type Column struct {
+	Title string  `json:"title"`
+	Field string  `json:"field"` // name, quantity, unit_price or amount
+	Width float64 `json:"width"` // share of the table width
+	Align string  `json:"align"` // L, C or R
+}
+
+// DefaultLayout is the layout used unless -invoice-layout gives another
+func DefaultLayout() Layout {
+	return Layout{
+		PageSize: "Letter",
+		Margin:   15,
+		Font:     "Helvetica",
+		FontSize: 10,
+		Header:   Band{Height: 35},
+		Address:  Band{Height: 35},
+		Table: TableLayout{
+			RowHeight: 7,
+			Columns: []Column{
+				{Title: "Description", Field: "name", Width: 55, Align: "L"},
+				{Title: "Qty", Field: "quantity", Width: 10, Align: "C"},
+				{Title: "Unit price", Field: "unit_price", Width: 17, Align: "R"},
+				{Title: "Amount", Field: "amount", Width: 18, Align: "R"},
+			},
+		},
+		Totals: Band{Height: 35},
+		Footer: Band{Height: 15},
+	}
+}
+
+// LoadLayout reads a layout from a json file over the default one, so a file only
+// needs the parts it changes
+func LoadLayout(path string) (Layout, error) {
+	l := DefaultLayout()
+	if path == "" {
+		return l, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return l, err
+	}
+	err = json.Unmarshal(b, &l)
+	if err != nil {
+		return l, fmt.Errorf("invoice layout %s: %w", path, err)
+	}
+	if len(l.Table.Columns) == 0 || l.Table.RowHeight <= 0 {
+		return l, fmt.Errorf("invoice layout %s: the table needs columns and a row height", path)
+	}
+	return l, nil
+}
+
+// zeroDecimal are currencies whose amounts are in whole units rather than cents
+var zeroDecimal = map[string]bool{"jpy": true, "krw": true, "vnd": true, "clp": true}
+
+// formatMoney writes an amount in the smallest unit of its currency, usually cents,
+// as $1,234.50
+func formatMoney(amount int, currency string) string {
+	currency = strings.ToLower(currency)
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	units, fraction := amount/100, fmt.Sprintf(".%02d", amount%100)
+	if zeroDecimal[currency] {
+		units, fraction = amount, ""
+	}
+
+	whole := strconv.Itoa(units)
+	var b strings.Builder
+	for i, c := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+
+	switch currency {
+	case "", "usd", "cad", "aud":
+		return sign + "$" + b.String() + fraction
+	case "eur":
+		return sign + "€" + b.String() + fraction
+	case "gbp":
+		return sign + "£" + b.String() + fraction
+	default:
+		return sign + b.String() + fraction + " " + strings.ToUpper(currency)
+	}
+}
+
+// hexColor turns #rrggbb into its parts, or dark grey if it is not a color
+func hexColor(s string) (int, int, int) {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "#"), 16, 32)
+	if err != nil || len(strings.TrimPrefix(s, "#")) != 6 {
+		return 51, 51, 51
+	}
+	return int(v >> 16 & 0xff), int(v >> 8 & 0xff), int(v & 0xff)
+}
+
+// document is what goes on an invoice or credit note
+type document struct {
+	Title    string // INVOICE or CREDIT NOTE
+	Number   string
+	Name     string
+	Email    string
+	Currency string
+	Details  [][2]string // label and value pairs beside the address
+	Lines    []Product
+	Totals   [][2]string // label and value rows above the total
+	Total    [2]string
+}
+
+// invoiceRenderer draws one document with a layout and branding
+type invoiceRenderer struct {
+	layout Layout
+	brand  Branding
+	doc    document
+
+	pdf    *gofpdf.Fpdf
+	tr     func(string) string
+	width  float64 // between the margins
+	bottom float64 // where the footer starts
+}
+
+// renderInvoice draws the invoice of an order and returns the pdf
+func renderInvoice(layout Layout, brand Branding, order Order, inv models.Invoice) ([]byte, error) {
+	doc := document{
+		Title:    "INVOICE",
+		Number:   inv.Number,
+		Name:     strings.TrimSpace(order.FirstName + " " + order.LastName),
+		Email:    order.Email,
+		Currency: inv.Currency,
+		Details: [][2]string{
+			{"Issued", inv.IssuedAt.Format("January 2, 2006")},
+			{"Due", inv.DueAt.Format("January 2, 2006")},
+			{"Order", fmt.Sprintf("#%d", order.ID)},
+		},
+		Lines:  order.Products,
+		Totals: [][2]string{{"Subtotal", formatMoney(inv.Subtotal, inv.Currency)}},
+		Total:  [2]string{"Total", formatMoney(inv.Total, inv.Currency)},
+	}
+	if !order.CreatedAt.IsZero() {
+		doc.Details = append(doc.Details, [2]string{"Order date", order.CreatedAt.Format("January 2, 2006")})
+	}
+	if order.Discount > 0 {
+		doc.Totals = append(doc.Totals, [2]string{"Discount", formatMoney(-order.Discount, inv.Currency)})
+	}
+	if order.Tax > 0 {
+		doc.Totals = append(doc.Totals, [2]string{"Tax", formatMoney(order.Tax, inv.Currency)})
+	}
+	return renderDocument(layout, brand, doc)
+}
+
+// renderCreditNote draws a credit note against the invoice of an order and returns
+// the pdf. Its one line is the amount credited.
+func renderCreditNote(layout Layout, brand Branding, order Order, cn models.CreditNote) ([]byte, error) {
+	description := "Refund of invoice " + cn.InvoiceNumber
+	if cn.Reason != "" {
+		description += ": " + cn.Reason
+	}
+
+	doc := document{
+		Title:    "CREDIT NOTE",
+		Number:   cn.Number,
+		Name:     strings.TrimSpace(order.FirstName + " " + order.LastName),
+		Email:    cn.Email,
+		Currency: cn.Currency,
+		Details: [][2]string{
+			{"Issued", cn.IssuedAt.Format("January 2, 2006")},
+			{"Invoice", cn.InvoiceNumber},
+			{"Order", fmt.Sprintf("#%d", order.ID)},
+		},
+		Lines: []Product{{Name: description, Amount: cn.Amount, Quantity: 1}},
+		Total: [2]string{"Total credited", formatMoney(cn.Amount, cn.Currency)},
+	}
+	return renderDocument(layout, brand, doc)
+}
+
+// renderDocument draws a document and returns the pdf
+func renderDocument(layout Layout, brand Branding, doc document) ([]byte, error) {
+	r := newInvoiceRenderer(layout, brand, doc)
+
+	r.pdf.AddPage()
+	y := r.address(layout.Margin + layout.Header.Height)
+	y = r.lines(y)
+	r.totals(y)
+
+	var buf bytes.Buffer
+	err := r.pdf.Output(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// newInvoiceRenderer sets up a pdf for a document with its header and footer on every
+// page, before any page is added
+func newInvoiceRenderer(layout Layout, brand Branding, doc document) *invoiceRenderer {
+	r := &invoiceRenderer{layout: layout, brand: brand, doc: doc}
+	r.pdf = gofpdf.New("P", "mm", layout.PageSize, "")
+	r.pdf.SetMargins(layout.Margin, layout.Margin, layout.Margin)
+	r.pdf.SetAutoPageBreak(false, 0)
+	r.pdf.AliasNbPages("")
+	r.tr = r.pdf.UnicodeTranslatorFromDescriptor("")
+
+	pageW, pageH := r.pdf.GetPageSize()
+	r.width = pageW - 2*layout.Margin
+	r.bottom = pageH - layout.Margin - layout.Footer.Height
+
+	background := -1
+	var importer *gofpdi.Importer
+	if layout.Background != "" {
+		importer = gofpdi.NewImporter()
+		background = importer.ImportPage(r.pdf, layout.Background, 1, "/MediaBox")
+	}
+
+	r.pdf.SetHeaderFunc(func() {
+		if importer != nil {
+			importer.UseImportedTemplate(r.pdf, background, 0, 0, pageW, 0)
+		}
+		r.header()
+	})
+	r.pdf.SetFooterFunc(r.footer)
+	return r
+}
+
+func (r *invoiceRenderer) font(style string, scale float64) {
+	r.pdf.SetFont(r.layout.Font, style, r.layout.FontSize*scale)
+}
+
+func (r *invoiceRenderer) brandColor() {
+	r.pdf.SetTextColor(hexColor(r.brand.Color))
+}
+
+func (r *invoiceRenderer) text() {
+	r.pdf.SetTextColor(51, 51, 51)
+}
+
+// cell writes text at x, y, cut short with ... if it is wider than w
+func (r *invoiceRenderer) cell(x, y, w, h float64, s, align string) {
+	s = r.tr(s)
+	if r.pdf.GetStringWidth(s) > w-2 {
+		for len(s) > 0 && r.pdf.GetStringWidth(s+"...") > w-2 {
+			s = s[:len(s)-1]
+		}
+		s += "..."
+	}
+	r.pdf.SetXY(x, y)
+	r.pdf.CellFormat(w, h, s, "", 0, align, false, 0, "")
+}
+
+// header draws the logo, store name and address, and the document number
+func (r *invoiceRenderer) header() {
+	m := r.layout.Margin
+	x := m
+	if r.brand.Logo != "" {
+		r.pdf.ImageOptions(r.brand.Logo, m, m, 0, 18, false, gofpdf.ImageOptions{ReadDpi: true}, 0, "")
+		if info := r.pdf.GetImageInfo(r.brand.Logo); info != nil {
+			x += 18*info.Width()/info.Height() + 4
+		}
+	}
+
+	r.font("B", 1.6)
+	r.brandColor()
+	r.cell(x, m, r.width/2, 8, r.brand.Name, "L")
+	r.font("", 0.9)
+	r.text()
+	for i, line := range r.brand.Address {
+		r.cell(x, m+8+float64(i)*4.5, r.width/2, 4.5, line, "L")
+	}
+
+	r.font("B", 1.8)
+	r.brandColor()
+	r.cell(m+r.width/2, m, r.width/2, 9, r.doc.Title, "R")
+	r.font("", 1)
+	r.text()
+	r.cell(m+r.width/2, m+10, r.width/2, 5, r.doc.Number, "R")
+
+	r.pdf.SetDrawColor(hexColor(r.brand.Color))
+	r.pdf.Line(m, m+r.layout.Header.Height-4, m+r.width, m+r.layout.Header.Height-4)
+}
+
+// footer draws the footer text and page number
+func (r *invoiceRenderer) footer() {
+	m := r.layout.Margin
+	r.pdf.SetDrawColor(200, 200, 200)
+	r.pdf.Line(m, r.bottom+3, m+r.width, r.bottom+3)
+	r.font("", 0.8)
+	r.text()
+	r.cell(m, r.bottom+5, r.width*2/3, 5, r.brand.Footer, "L")
+	r.cell(m+r.width*2/3, r.bottom+5, r.width/3, 5, fmt.Sprintf("Page %d of {nb}", r.pdf.PageNo()), "R")
+}
+
+// address draws who the document is for and its details, and returns where it ends
+func (r *invoiceRenderer) address(y float64) float64 {
+	m := r.layout.Margin
+	half := r.width / 2
+
+	r.font("B", 0.9)
+	r.brandColor()
+	r.cell(m, y, half, 5, "BILL TO", "L")
+	r.font("", 1)
+	r.text()
+	r.cell(m, y+6, half, 5, r.doc.Name, "L")
+	r.cell(m, y+11, half, 5, r.doc.Email, "L")
+
+	for i, d := range r.doc.Details {
+		r.font("B", 1)
+		r.cell(m+half, y+float64(i)*5, half*0.55, 5, d[0], "R")
+		r.font("", 1)
+		r.cell(m+half*1.55, y+float64(i)*5, half*0.45, 5, d[1], "R")
+	}
+
+	return y + r.layout.Address.Height
+}
+
+// tableHeading draws the column titles and returns where the rows start
+func (r *invoiceRenderer) tableHeading(y float64) float64 {
+	h := r.layout.Table.RowHeight
+	r.pdf.SetFillColor(hexColor(r.brand.Color))
+	r.pdf.Rect(r.layout.Margin, y, r.width, h, "F")
+
+	r.font("B", 1)
+	r.pdf.SetTextColor(255, 255, 255)
+	x := r.layout.Margin
+	for _, c := range r.layout.Table.Columns {
+		w := r.columnWidth(c)
+		r.cell(x, y, w, h, c.Title, c.Align)
+		x += w
+	}
+	r.text()
+	return y + h
+}
+
+func (r *invoiceRenderer) columnWidth(c Column) float64 {
+	total := 0.0
+	for _, c := range r.layout.Table.Columns {
+		total += c.Width
+	}
+	return r.width * c.Width / total
+}
+
+// lines draws the line table, starting a new page when one is full, and returns where
+// the table ends
+func (r *invoiceRenderer) lines(y float64) float64 {
+	h := r.layout.Table.RowHeight
+	y = r.tableHeading(y)
+
+	for i, p := range r.doc.Lines {
+		if y+h > r.bottom {
+			r.pdf.AddPage()
+			y = r.tableHeading(r.layout.Margin + r.layout.Header.Height)
+		}
+
+		if i%2 == 1 {
+			r.pdf.SetFillColor(244, 244, 247)
+			r.pdf.Rect(r.layout.Margin, y, r.width, h, "F")
+		}
+
+		r.font("", 1)
+		x := r.layout.Margin
+		for _, c := range r.layout.Table.Columns {
+			w := r.columnWidth(c)
+			r.cell(x, y, w, h, r.field(p, c.Field), c.Align)
+			x += w
+		}
+		y += h
+	}
+	return y
+}
+
+// field is what a column shows for a line
+func (r *invoiceRenderer) field(p Product, field string) string {
+	switch field {
+	case "name":
+		return p.Name
+	case "quantity":
+		return strconv.Itoa(p.Quantity)
+	case "unit_price":
+		return formatMoney(p.Amount, r.doc.Currency)
+	case "amount":
+		return formatMoney(p.Amount*p.Quantity, r.doc.Currency)
+	default:
+		return ""
+	}
+}
+
+// totals draws the totals rows, such as subtotal, discount and tax, and the total under
+// the table, on a new page if they do not fit
+func (r *invoiceRenderer) totals(y float64) {
+	rows := r.doc.Totals
+
+	h := r.layout.Table.RowHeight
+	height := max(r.layout.Totals.Height, float64(len(rows)+1)*h+6)
+	if y+height > r.bottom {
+		r.pdf.AddPage()
+		y = r.layout.Margin + r.layout.Header.Height
+	}
+	y += 4
+
+	x := r.layout.Margin + r.width*0.55
+	w := r.width * 0.45
+	r.font("", 1)
+	for _, row := range rows {
+		r.cell(x, y, w*0.55, h, row[0], "R")
+		r.cell(x+w*0.55, y, w*0.45, h, row[1], "R")
+		y += h
+	}
+
+	r.pdf.SetDrawColor(hexColor(r.brand.Color))
+	r.pdf.Line(x, y+1, x+w, y+1)
+	r.font("B", 1.2)
+	r.brandColor()
+	r.cell(x, y+2, w*0.55, h, r.doc.Total[0], "R")
+	r.cell(x+w*0.55, y+2, w*0.45, h, r.doc.Total[1], "R")
+	r.text()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestFormatMoney(t *testing.T) {
+	tests := []struct {
+		amount   int
+		currency string
+		want     string
+	}{
+		{0, "usd", "$0.00"},
+		{5, "usd", "$0.05"},
+		{99, "usd", "$0.99"},
+		{100, "usd", "$1.00"},
+		{123450, "USD", "$1,234.50"},
+		{100000000, "usd", "$1,000,000.00"},
+		{-5, "usd", "-$0.05"},
+		{-123450, "usd", "-$1,234.50"},
+		{1999, "", "$19.99"},
+		{1999, "eur", "€19.99"},
+		{1999, "gbp", "£19.99"},
+		{1999, "chf", "19.99 CHF"},
+		{1500, "jpy", "1,500 JPY"},
+		{-1500, "jpy", "-1,500 JPY"},
+	}
+
+	for _, tt := range tests {
+		if got := formatMoney(tt.amount, tt.currency); got != tt.want {
+			t.Errorf("formatMoney(%d, %q) = %q, want %q", tt.amount, tt.currency, got, tt.want)
+		}
+	}
+}
+
+// linesDocument is an invoice with n lines
+func linesDocument(n int) document {
+	doc := document{Title: "INVOICE", Number: "INV-2026-000001", Currency: "usd", Total: [2]string{"Total", "$1.00"}}
+	for i := 0; i < n; i++ {
+		doc.Lines = append(doc.Lines, Product{Name: fmt.Sprintf("Widget %d", i+1), Amount: 100, Quantity: 1})
+	}
+	return doc
+}
+
+func TestLinesPageBreak(t *testing.T) {
+	// on the default Letter layout the footer starts 249.4mm down. The rows start 92mm
+	// down on the first page, under the address, so 22 rows of 7mm fit there, and 57mm
+	// down on the next pages, which take 27.
+	layout := DefaultLayout()
+	top := layout.Margin + layout.Header.Height
+
+	tests := []struct {
+		lines int
+		pages int
+		end   float64
+	}{
+		{1, 1, top + layout.Address.Height + 2*7},
+		{22, 1, top + layout.Address.Height + 23*7},
+		{23, 2, top + 2*7}, // the heading again, then the 23rd line
+		{49, 2, top + 28*7},
+		{50, 3, top + 2*7},
+	}
+
+	for _, tt := range tests {
+		r := newInvoiceRenderer(layout, Branding{}, linesDocument(tt.lines))
+		r.pdf.AddPage()
+		end := r.lines(r.address(top))
+		if got := r.pdf.PageNo(); got != tt.pages {
+			t.Errorf("%d lines: table ends on page %d, want %d", tt.lines, got, tt.pages)
+		}
+		if end != tt.end {
+			t.Errorf("%d lines: table ends at %.1fmm, want %.1fmm", tt.lines, end, tt.end)
+		}
+	}
+}
+
+func TestTotalsPageBreak(t *testing.T) {
+	// 22 lines fill the first page, leaving no room for the totals
+	for lines, pages := range map[int]int{17: 1, 22: 2} {
+		r := newInvoiceRenderer(DefaultLayout(), Branding{}, linesDocument(lines))
+		r.pdf.AddPage()
+		r.totals(r.lines(r.address(r.layout.Margin + r.layout.Header.Height)))
+		if got := r.pdf.PageCount(); got != pages {
+			t.Errorf("%d lines: %d pages, want %d", lines, got, pages)
+		}
+	}
+
+	pdf, err := renderDocument(DefaultLayout(), Branding{}, linesDocument(45))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pdf, []byte("%PDF-")) {
+		t.Errorf("rendered document is not a pdf")
+	}
+}
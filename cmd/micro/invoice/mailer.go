@@ -13,7 +13,7 @@ import (
 //go:embed email-templates
 var emailTemplateFS embed.FS
 
-func (app *application) SendEmail(from, to, subject, tmpl string, attachments []string, data interface{}) error {
+func (app *application) SendEmail(from, to, subject, tmpl string, attachments []*mail.File, data interface{}) error {
 	templateToRender := fmt.Sprintf("email-templates/%s.html.tmpl", tmpl)
 	t, err := template.New("email-html").ParseFS(emailTemplateFS, templateToRender)
 	if err != nil {
@@ -68,7 +68,7 @@ func (app *application) SendEmail(from, to, subject, tmpl string, attachments []
 
 	if len(attachments) > 0 {
 		for _, x := range attachments {
-			email.AddAttachment(x)
+			email.Attach(x)
 		}
 	}
 
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// testApp is the invoice service on the in-memory repository and a local store. No
+// mail server listens at its smtp address, so every email fails to send.
+type testApp struct {
+	*application
+	db *models.MemoryModel
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	var cfg config
+	cfg.secretkey = "test-secret"
+	cfg.smtp.host = "127.0.0.1"
+	cfg.smtp.port = 1
+	cfg.invoice.numbering = models.InvoiceNumbering{Prefix: "INV", Digits: 6}
+	cfg.invoice.credits = models.InvoiceNumbering{Prefix: "CN", Digits: 6}
+	cfg.invoice.layout = DefaultLayout()
+
+	files, err := NewLocalStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := models.NewMemoryModel()
+	return &testApp{
+		application: &application{
+			config:  cfg,
+			logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+			version: version,
+			DB:      db,
+			Files:   files,
+		},
+		db: db,
+	}
+}
+
+// issuedInvoice records a paid order and issues its invoice
+func issuedInvoice(t *testing.T, ta *testApp) models.Invoice {
+	t.Helper()
+
+	itemID := ta.db.AddItem(models.Item{Name: "Widget", Price: 2500})
+	orderID, err := ta.db.SaveCheckout(
+		models.Customer{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"},
+		models.Transaction{Amount: 2500, Currency: "usd", PaymentIntent: "pi_invoice"},
+		models.Order{StatusID: models.OrderPaid, Amount: 2500},
+		[]models.OrderItem{{ItemID: itemID, Quantity: 1, UnitPrice: 2500, LineTotal: 2500}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := ta.db.IssueInvoice(models.Invoice{
+		OrderID:  orderID,
+		Email:    "jane@example.com",
+		Currency: "usd",
+		Total:    2500,
+		IssuedAt: time.Now(),
+		DueAt:    time.Now(),
+	}, ta.config.invoice.numbering)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv
+}
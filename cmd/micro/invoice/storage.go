@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	// errPDFNotFound is returned by an InvoiceStore that has no pdf with a checksum
+	errPDFNotFound = errors.New("invoice pdf not found")
+	// errPDFTampered is returned for a stored pdf that no longer matches its checksum
+	errPDFTampered = errors.New("invoice pdf does not match its checksum")
+)
+
+// InvoiceStore keeps invoice pdfs under names made from their content, so a pdf is
+// found by the checksum recorded on its invoice and every instance of the service
+// sharing a store sees the same files
+type InvoiceStore interface {
+	// Put saves a pdf and returns its checksum
+	Put(ctx context.Context, pdf []byte) (string, error)
+	// Get returns the pdf with a checksum, or errPDFNotFound
+	Get(ctx context.Context, checksum string) ([]byte, error)
+}
+
+var (
+	_ InvoiceStore = (*LocalStore)(nil)
+	_ InvoiceStore = (*S3Store)(nil)
+)
+
+var checksumRE = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// checksum returns the hex sha256 of a pdf
+func checksum(pdf []byte) string {
+	sum := sha256.Sum256(pdf)
+	return hex.EncodeToString(sum[:])
+}
+
+// pdfName is the name a pdf is stored under
+func pdfName(checksum string) (string, error) {
+	if !checksumRE.MatchString(checksum) {
+		return "", fmt.Errorf("invalid invoice pdf checksum %q", checksum)
+	}
+	return fmt.Sprintf("%s/%s.pdf", checksum[:2], checksum), nil
+}
+
+// LocalStore is an InvoiceStore on the local filesystem
+type LocalStore struct {
+	Root string
+}
+
+// NewLocalStore returns a store under root, creating it if needed
+func NewLocalStore(root string) (*LocalStore, error) {
+	err := os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{Root: root}, nil
+}
+
+// Put writes a pdf, first to a temporary file so a reader never sees half of it
+func (s *LocalStore) Put(_ context.Context, pdf []byte) (string, error) {
+	sum := checksum(pdf)
+	name, _ := pdfName(sum)
+	path := filepath.Join(s.Root, filepath.FromSlash(name))
+
+	if _, err := os.Stat(path); err == nil {
+		return sum, nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".pdf-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(pdf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return sum, os.Rename(f.Name(), path)
+}
+
+// Get reads a pdf
+func (s *LocalStore) Get(_ context.Context, checksum string) ([]byte, error) {
+	name, err := pdfName(checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	pdf, err := os.ReadFile(filepath.Join(s.Root, filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errPDFNotFound
+	}
+	return pdf, err
+}
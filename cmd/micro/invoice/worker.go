@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+const (
+	// jobLease is how long a worker holds a job before another may take it over
+	jobLease = 2 * time.Minute
+	// jobPollInterval is how long an idle worker waits before looking for work again
+	jobPollInterval = 5 * time.Second
+)
+
+// runInvoiceWorker creates and sends the invoices queued with orders, and the credit
+// notes queued with refunds, until ctx is done. Any number of workers, in this process
+// or others, can share the queue.
+func (app *application) runInvoiceWorker(ctx context.Context) {
+	for {
+		worked, err := app.processJob(models.JobKindInvoice, app.runInvoiceJob)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+		if !worked {
+			// invoices go first, since a credit note needs the invoice it credits
+			worked, err = app.processJob(models.JobKindCreditNote, app.runCreditNoteJob)
+			if err != nil {
+				app.logger.Error(err.Error())
+			}
+		}
+		if worked {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// processJob claims and runs one job of a kind, reporting whether there was one
+func (app *application) processJob(kind string, run func(models.Job) error) (bool, error) {
+	job, err := app.DB.ClaimJob(kind, jobLease)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = run(job)
+	if err == nil {
+		return true, app.DB.CompleteJob(job)
+	}
+
+	status, ferr := app.DB.FailJob(job, err.Error(), time.Now().Add(models.JobBackoff(job.Attempts)))
+	if ferr != nil {
+		return true, ferr
+	}
+	if status == models.JobFailed {
+		app.logger.Error(fmt.Sprintf("%s job %d failed after %d attempts: %s", kind, job.ID, job.Attempts, err))
+	} else {
+		app.logger.Info(fmt.Sprintf("%s job %d attempt %d failed, will retry: %s", kind, job.ID, job.Attempts, err))
+	}
+	return true, nil
+}
+
+func (app *application) runInvoiceJob(job models.Job) (err error) {
+	// the pdf library panics on a broken template; fail the job rather than the worker
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("invoice job panicked: %v", p)
+		}
+	}()
+
+	var order Order
+	err = json.Unmarshal(job.Payload, &order)
+	if err != nil {
+		return err
+	}
+	_, err = app.sendInvoice(order)
+	return err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wtran29/go-ecommerce/internal/driver"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+const usage = `Usage: migrate [flags] command
+
+Commands:
+  up           apply all pending migrations
+  down N       roll back the last N migrations (default 1)
+  status       list migrations and when they were applied
+  create NAME  write empty up and down files for a new migration
+
+Flags:
+`
+
+var validName = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+func main() {
+	var dsn, dir string
+
+	flag.StringVar(&dsn, "dsn", fmt.Sprintf("host=%v port=%v user=%v password=%v dbname=%v sslmode=disable timezone=UTC connect_timeout=5",
+		os.Getenv("ECOMM_HOST"), os.Getenv("ECOMM_PORT"), os.Getenv("ECOMM_USER"), os.Getenv("ECOMM_PW"), os.Getenv("ECOMM_DBNAME")), "DSN")
+	flag.StringVar(&dir, "dir", filepath.Join("internal", "models", "migrations"), "Migrations directory used by create")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// create only writes files, so it does not need a database
+	if args[0] == "create" {
+		if len(args) != 2 {
+			log.Fatal("create needs a migration name")
+		}
+		err := create(dir, args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	conn, err := driver.OpenDB(dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	db := models.DBModel{DB: conn}
+
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp()
+		for _, mg := range applied {
+			fmt.Printf("applied  %06d_%s\n", mg.Version, mg.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("database is up to date")
+		}
+
+	case "down":
+		n := 1
+		if len(args) > 1 {
+			n, err = strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				log.Fatal("down needs a positive number of migrations")
+			}
+		}
+		reverted, err := db.MigrateDown(n)
+		for _, mg := range reverted {
+			fmt.Printf("reverted %06d_%s\n", mg.Version, mg.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "status":
+		statuses, err := db.MigrationStatus()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Printf("%06d_%-40s %s\n", s.Version, s.Name, applied)
+		}
+
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// create writes empty up and down files numbered after the newest migration in dir
+func create(dir, name string) error {
+	name = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), "-", "_"))
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid migration name %q, use letters, digits and underscores", name)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	next := 1
+	for _, e := range entries {
+		prefix, _, found := strings.Cut(e.Name(), "_")
+		if !found {
+			continue
+		}
+		if v, err := strconv.Atoi(prefix); err == nil && v >= next {
+			next = v + 1
+		}
+	}
+
+	for _, direction := range []string{"up", "down"} {
+		path := filepath.Join(dir, fmt.Sprintf("%06d_%s.%s.sql", next, name, direction))
+		err = os.WriteFile(path, []byte(fmt.Sprintf("-- %s migration for %s\n", direction, name)), 0o644)
+		if err != nil {
+			return err
+		}
+		fmt.Println("created", path)
+	}
+	return nil
+}
@@ -1,18 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v76"
 	"github.com/wtran29/go-ecommerce/internal/cards"
 	"github.com/wtran29/go-ecommerce/internal/encryption"
+	"github.com/wtran29/go-ecommerce/internal/events"
 	"github.com/wtran29/go-ecommerce/internal/models"
+	"github.com/wtran29/go-ecommerce/internal/netutil"
 	"github.com/wtran29/go-ecommerce/internal/urlsigner"
 )
 
@@ -59,27 +60,14 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 
 	paymentIntent := r.Form.Get("payment_intent")
 	paymentMethod := r.Form.Get("payment_method")
-	paymentAmount := r.Form.Get("payment_amount")
-	paymentCurrency := r.Form.Get("payment_currency")
 
-	amount, err := strconv.Atoi(paymentAmount)
+	pi, err := app.Gateway.RetrievePaymentIntent(paymentIntent)
 	if err != nil {
 		app.logger.Error(err.Error())
 		return txnData, err
 	}
 
-	card := cards.Card{
-		Secret: app.config.stripe.secret,
-		Key:    app.config.stripe.key,
-	}
-
-	pi, err := card.RetrievePaymentIntent(paymentIntent)
-	if err != nil {
-		app.logger.Error(err.Error())
-		return txnData, err
-	}
-
-	pm, err := card.GetPaymentMethod(paymentMethod)
+	pm, err := app.Gateway.GetPaymentMethod(paymentMethod)
 	if err != nil {
 		app.logger.Error(err.Error())
 		return txnData, err
@@ -89,55 +77,74 @@ func (app *application) GetTransactionData(r *http.Request) (TransactionData, er
 	expiryMonth := pm.Card.ExpMonth
 	expiryYear := pm.Card.ExpYear
 
+	bankReturnCode := ""
+	if pi.LatestCharge != nil {
+		bankReturnCode = pi.LatestCharge.ID
+	}
+
 	txnData = TransactionData{
 		FirstName:       firstName,
 		LastName:        lastName,
 		Email:           email,
 		PaymentIntentID: paymentIntent,
 		PaymentMethodID: paymentMethod,
-		PaymentAmount:   amount,
-		PaymentCurrency: paymentCurrency,
+		// the amount charged comes from the gateway, not from the posted form
+		PaymentAmount:   int(pi.Amount),
+		PaymentCurrency: string(pi.Currency),
 		LastFour:        lastFour,
 		ExpiryMonth:     int(expiryMonth),
 		ExpiryYear:      int(expiryYear),
-		BankReturnCode:  pi.LatestCharge.ID,
+		BankReturnCode:  bankReturnCode,
 	}
 	return txnData, nil
 
 }
 
-type Invoice struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	CreatedAt time.Time `json:"-"`
-	Products  []Product `json:"products"`
-}
-
-type Product struct {
-	Name     string
-	Amount   int
-	Quantity int
-}
-
-// PaymentSuccess displays the receipt page
+// PaymentSuccess records the order of a paid checkout and displays the receipt page.
+// The card has been charged by the time the browser posts here, so anything that
+// stops the order being recorded sends the customer to the payment problem page.
 func (app *application) PaymentSuccess(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseForm()
 	if err != nil {
 		app.logger.Error(err.Error())
+		app.paymentProblem(w, r, TransactionData{})
+		return
+	}
+	posted := TransactionData{
+		FirstName:       r.Form.Get("first_name"),
+		LastName:        r.Form.Get("last_name"),
+		Email:           r.Form.Get("email"),
+		PaymentIntentID: r.Form.Get("payment_intent"),
+	}
+
+	// a product_id means a single item checkout, otherwise the session cart is checked out
+	cartLines := app.getCart(r).Lines
+	if productID := r.Form.Get("product_id"); productID != "" {
+		itemID, err := strconv.Atoi(productID)
+		if err != nil {
+			app.logger.Error(err.Error())
+			app.paymentProblem(w, r, posted)
+			return
+		}
+		cartLines = []models.CartLine{{ItemID: itemID, Quantity: 1}}
+	}
+	if len(cartLines) == 0 {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
 		return
 	}
 
-	itemID, err := strconv.Atoi(r.Form.Get("product_id"))
+	quote, err := app.DB.QuoteForLines(cartLines, r.Form.Get("coupon"), app.config.taxRate)
 	if err != nil {
 		app.logger.Error(err.Error())
+		app.paymentProblem(w, r, posted)
 		return
 	}
+	lines := quote.Lines
 
 	txnData, err := app.GetTransactionData(r)
 	if err != nil {
 		app.logger.Error(err.Error())
+		app.paymentProblem(w, r, posted)
 		return
 	}
 
@@ -148,12 +155,6 @@ func (app *application) PaymentSuccess(w http.ResponseWriter, r *http.Request) {
 		Email:     txnData.Email,
 	}
 
-	customerID, err := app.SaveCustomer(customer)
-	if err != nil {
-		app.logger.Error(err.Error())
-		return
-	}
-
 	// create a new transaction
 	txn := models.Transaction{
 		Amount:              txnData.PaymentAmount,
@@ -167,74 +168,74 @@ func (app *application) PaymentSuccess(w http.ResponseWriter, r *http.Request) {
 		TransactionStatusID: 2,
 	}
 
-	txnID, err := app.SaveTransaction(txn)
+	// only record the order if the intent was paid for what we priced it at
+	pi, err := app.Gateway.RetrievePaymentIntent(txnData.PaymentIntentID)
 	if err != nil {
 		app.logger.Error(err.Error())
+		app.paymentProblem(w, r, txnData)
 		return
 	}
-
-	// Create new order
-	order := models.Order{
-		ItemID:        itemID,
-		TransactionID: txnID,
-		CustomerID:    customerID,
-		StatusID:      1,
-		Quantity:      1,
-		Amount:        txnData.PaymentAmount,
-		CreatedAt:     time.Now(),
-		UpdatedAt:     time.Now(),
+	err = cards.VerifyPaymentIntent(pi, quote.Total, app.config.currency)
+	if err == nil {
+		err = cards.VerifyMetadata(pi, quote.Metadata())
 	}
-
-	orderID, err := app.SaveOrder(order)
 	if err != nil {
 		app.logger.Error(err.Error())
+		if pi.Status == stripe.PaymentIntentStatusSucceeded {
+			// money was taken for something other than this order
+			if rerr := models.RecordUnsavedCharge(app.DB, txn, customer.Email, err); rerr != nil {
+				app.logger.Error(rerr.Error())
+			}
+		}
+		app.paymentProblem(w, r, txnData)
 		return
 	}
 
-	products := []Product{
-		{Name: "Some item", Amount: order.Amount, Quantity: order.Quantity},
-	}
-	// call microservice
-	inv := Invoice{
-		ID:        orderID,
-		Products:  products,
-		FirstName: txnData.FirstName,
-		LastName:  txnData.LastName,
-		Email:     txnData.Email,
+	// Create new order
+	order := models.Order{
+		StatusID:  models.OrderPaid,
+		Amount:    txnData.PaymentAmount,
+		Discount:  quote.Discount,
+		Tax:       quote.Tax,
 		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
 	}
 
-	err = app.callInvoiceMicro(inv)
+	// customer, transaction and order are saved, and the invoice queued, together or
+	// not at all
+	_, err = app.SaveCheckout(customer, txn, order, lines)
 	if err != nil {
-		app.logger.Error(err.Error())
+		app.paymentProblem(w, r, txnData)
+		return
 	}
 
 	// write data to session, redirect to new page
+	app.Session.Remove(r.Context(), "cart")
 	app.Session.Put(r.Context(), "receipt", txnData)
 	http.Redirect(w, r, "/receipt", http.StatusSeeOther)
 }
 
-func (app *application) callInvoiceMicro(inv Invoice) error {
-	url := os.Getenv("INVOICE_API")
-	out, err := json.MarshalIndent(inv, "", "\t")
-	if err != nil {
-		return err
-	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(out))
-	if err != nil {
-		return err
-	}
+// paymentProblem sends a customer whose order could not be recorded, after their card
+// may have been charged, to a page saying so with the reference to quote
+func (app *application) paymentProblem(w http.ResponseWriter, r *http.Request, txnData TransactionData) {
+	app.Session.Put(r.Context(), "payment-problem", txnData)
+	http.Redirect(w, r, "/payment-problem", http.StatusSeeOther)
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+// PaymentProblem displays the payment problem page
+func (app *application) PaymentProblem(w http.ResponseWriter, r *http.Request) {
+	txn, ok := app.Session.Pop(r.Context(), "payment-problem").(TransactionData)
+	if !ok {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	data := make(map[string]interface{})
+	data["txn"] = txn
+	if err := app.renderTemplate(w, r, "payment-problem", &templateData{
+		Data: data,
+	}); err != nil {
+		app.logger.Error(err.Error())
 	}
-	defer resp.Body.Close()
-
-	app.logger.Info(fmt.Sprint(resp.Body))
-	return nil
 }
 
 // VirtualTerminalPaymentSuccess displays the receipt page for virtual terminal transactions
@@ -259,7 +260,7 @@ func (app *application) VirtualTerminalPaymentSuccess(w http.ResponseWriter, r *
 		TransactionStatusID: 2,
 	}
 
-	_, err = app.SaveTransaction(txn)
+	_, err = app.SaveTransaction(txn, txnData.Email)
 	if err != nil {
 		app.logger.Error(err.Error())
 		return
@@ -295,33 +296,27 @@ func (app *application) VirtualTerminalReceipt(w http.ResponseWriter, r *http.Re
 	}
 }
 
-// SaveCustomer saves a customer and returns customer id
-func (app *application) SaveCustomer(customer models.Customer) (int, error) {
-	id, err := app.DB.InsertCustomer(customer)
+// SaveCheckout saves a paid checkout with models.SaveChargedCheckout and announces the
+// sale
+func (app *application) SaveCheckout(customer models.Customer, txn models.Transaction, order models.Order, lines []models.OrderItem) (int, error) {
+	id, err := models.SaveChargedCheckout(app.DB, customer, txn, order, lines)
 	if err != nil {
 		app.logger.Error(err.Error())
 		return 0, err
 	}
+	app.publish(events.Event{Type: events.SaleCreated, OrderID: id, Amount: txn.Amount, Currency: txn.Currency})
 	return id, nil
 }
 
-// SaveTransaction saves a transaction and returns txn id
-func (app *application) SaveTransaction(txn models.Transaction) (int, error) {
-	id, err := app.DB.InsertTransaction(txn)
-	if err != nil {
-		app.logger.Error(err.Error())
-		return 0, err
-	}
-	return id, nil
-}
-
-// SaveOrder saves a order and returns order id
-func (app *application) SaveOrder(order models.Order) (int, error) {
-	id, err := app.DB.InsertOrder(order)
+// SaveTransaction saves a charged transaction with models.SaveChargedTransaction and
+// announces the sale
+func (app *application) SaveTransaction(txn models.Transaction, email string) (int, error) {
+	id, err := models.SaveChargedTransaction(app.DB, txn, email)
 	if err != nil {
 		app.logger.Error(err.Error())
 		return 0, err
 	}
+	app.publish(events.Event{Type: events.SaleCreated, Amount: txn.Amount, Currency: txn.Currency})
 	return id, nil
 }
 
@@ -385,17 +380,67 @@ func (app *application) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
 
+	accountKey, ipKey := models.AccountKey(email), models.IPKey(netutil.ClientIP(r))
+	until, err := app.DB.LockedUntil(accountKey, ipKey)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+	if !until.IsZero() {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
 	id, err := app.DB.Authenticate(email, password)
 	if err != nil {
+		app.loginFailed(accountKey, ipKey)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// users with a second factor must also bring the api token they were given for it
+	user, err := app.DB.GetOneUser(id)
+	if err != nil || (user.TwoFactorEnabled && !app.passedTwoFactor(id, r.Form.Get("token"))) {
+		app.loginFailed(accountKey, ipKey)
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
+	err = app.DB.ClearFailures(accountKey)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+
 	app.Session.Put(r.Context(), "userID", id)
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 
 }
 
+// loginFailed counts a failed login against the account and the client address
+func (app *application) loginFailed(accountKey, ipKey models.ThrottleKey) {
+	_, err := app.DB.RecordFailure(accountKey, models.AccountPolicy)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+	_, err = app.DB.RecordFailure(ipKey, models.IPPolicy)
+	if err != nil {
+		app.logger.Error(err.Error())
+	}
+}
+
+// passedTwoFactor reports whether token is a session token the api issued to the user
+// in the last few minutes after checking their second factor
+func (app *application) passedTwoFactor(userID int, token string) bool {
+	if len(token) != 26 {
+		return false
+	}
+	u, t, err := app.DB.GetUserForToken(token)
+	if err != nil {
+		return false
+	}
+	return u.ID == userID && t.Scope == models.ScopeAuthentication && t.SecondFactor &&
+		time.Since(t.CreatedAt) < 5*time.Minute
+}
+
 func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
 	app.Session.Destroy(r.Context())
 	app.Session.RenewToken(r.Context())
@@ -452,6 +497,13 @@ func (app *application) ShowResetPassword(w http.ResponseWriter, r *http.Request
 
 }
 
+// Dashboard shows today's sales, kept up to date over the websocket
+func (app *application) Dashboard(w http.ResponseWriter, r *http.Request) {
+	if err := app.renderTemplate(w, r, "dashboard", &templateData{}); err != nil {
+		app.logger.Error(err.Error())
+	}
+}
+
 func (app *application) AllSales(w http.ResponseWriter, r *http.Request) {
 	if err := app.renderTemplate(w, r, "all-sales", &templateData{}); err != nil {
 		app.logger.Error(err.Error())
@@ -471,10 +523,17 @@ func (app *application) ShowSale(w http.ResponseWriter, r *http.Request) {
 	stringMap["refund-btn"] = "Refund Order"
 	stringMap["messages"] = "Charge refunded"
 	stringMap["text"] = "Your charge has been refunded."
-	stringMap["status"] = "Refunded"
-	stringMap["bg-status"] = "bg-danger"
+	stringMap["permission"] = models.PermRefund
+	stringMap["refunds"] = "true"
+
+	data := make(map[string]interface{})
+	data["statuses"] = models.OrderStatusNames()
+	data["actionable"] = models.OrderStatusesTo(models.OrderRefunded)
+	data["fulfilment"] = models.NextFulfilment()
+
 	if err := app.renderTemplate(w, r, "sale", &templateData{
 		StringMap: stringMap,
+		Data:      data,
 	}); err != nil {
 		app.logger.Error(err.Error())
 	}
@@ -488,11 +547,17 @@ func (app *application) ShowSubscription(w http.ResponseWriter, r *http.Request)
 	stringMap["refund-btn"] = "Cancel Subscription"
 	stringMap["messages"] = "Subscription Cancelled"
 	stringMap["text"] = "Your subscription has been cancelled."
-	stringMap["status"] = "Cancelled"
-	stringMap["bg-status"] = "bg-dark"
+	stringMap["permission"] = models.PermCancelSubscription
+
+	// subscriptions are not shipped, so they have no fulfilment steps
+	data := make(map[string]interface{})
+	data["statuses"] = models.OrderStatusNames()
+	data["actionable"] = models.OrderStatusesTo(models.OrderCancelled)
+	data["fulfilment"] = map[models.OrderStatus]models.OrderStatus{}
 
 	if err := app.renderTemplate(w, r, "sale", &templateData{
 		StringMap: stringMap,
+		Data:      data,
 	}); err != nil {
 		app.logger.Error(err.Error())
 	}
@@ -507,7 +572,119 @@ func (app *application) AllUsers(w http.ResponseWriter, r *http.Request) {
 
 // OneUser shows one admin user for add/edit/delete
 func (app *application) OneUser(w http.ResponseWriter, r *http.Request) {
-	if err := app.renderTemplate(w, r, "one-user", &templateData{}); err != nil {
+	data := make(map[string]interface{})
+	data["roles"] = models.Roles()
+	if err := app.renderTemplate(w, r, "one-user", &templateData{
+		Data: data,
+	}); err != nil {
+		app.logger.Error(err.Error())
+	}
+}
+
+// TwoFactor shows the signed in user's two-factor authentication settings
+func (app *application) TwoFactor(w http.ResponseWriter, r *http.Request) {
+	user, _ := r.Context().Value(userContextKey).(models.User)
+
+	data := make(map[string]interface{})
+	data["enabled"] = user.TwoFactorEnabled
+	if err := app.renderTemplate(w, r, "two-factor", &templateData{
+		Data: data,
+	}); err != nil {
 		app.logger.Error(err.Error())
 	}
 }
+
+// getCart returns the shopping cart stored in the session
+func (app *application) getCart(r *http.Request) models.Cart {
+	cart, ok := app.Session.Get(r.Context(), "cart").(models.Cart)
+	if !ok {
+		return models.Cart{}
+	}
+	return cart
+}
+
+// ShowCart displays the shopping cart with a checkout form
+func (app *application) ShowCart(w http.ResponseWriter, r *http.Request) {
+	cart := app.getCart(r)
+
+	data := make(map[string]interface{})
+	intMap := make(map[string]int)
+	stringMap := make(map[string]string)
+
+	if !cart.IsEmpty() {
+		quote, err := app.DB.QuoteForLines(cart.Lines, "", app.config.taxRate)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+		data["lines"] = quote.Lines
+		intMap["subtotal"] = quote.Subtotal
+		intMap["tax"] = quote.Tax
+		intMap["total"] = quote.Total
+
+		cartLines, err := json.Marshal(cart.Lines)
+		if err != nil {
+			app.logger.Error(err.Error())
+			return
+		}
+		stringMap["cart_lines"] = string(cartLines)
+	}
+
+	if err := app.renderTemplate(w, r, "cart", &templateData{
+		Data:      data,
+		IntMap:    intMap,
+		StringMap: stringMap,
+	}, "stripe-js"); err != nil {
+		app.logger.Error(err.Error())
+	}
+}
+
+// AddToCart adds a one time item to the session cart
+func (app *application) AddToCart(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+
+	itemID, err := strconv.Atoi(r.Form.Get("item_id"))
+	if err != nil {
+		app.logger.Error(err.Error())
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+	quantity, err := strconv.Atoi(r.Form.Get("quantity"))
+	if err != nil || quantity < 1 {
+		quantity = 1
+	}
+
+	item, err := app.DB.GetItem(itemID)
+	if err != nil || item.IsRecurring {
+		http.Redirect(w, r, "/cart", http.StatusSeeOther)
+		return
+	}
+
+	cart := app.getCart(r)
+	cart.Add(item.ID, quantity)
+	app.Session.Put(r.Context(), "cart", cart)
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
+
+// RemoveFromCart removes an item from the session cart
+func (app *application) RemoveFromCart(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.logger.Error(err.Error())
+		return
+	}
+
+	itemID, err := strconv.Atoi(r.Form.Get("item_id"))
+	if err == nil {
+		cart := app.getCart(r)
+		cart.Remove(itemID)
+		app.Session.Put(r.Context(), "cart", cart)
+	}
+
+	http.Redirect(w, r, "/cart", http.StatusSeeOther)
+}
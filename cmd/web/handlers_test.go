@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/wtran29/go-ecommerce/internal/cards"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+func TestCart(t *testing.T) {
+	ta := newTestApp(t)
+	widget := ta.db.AddItem(models.Item{Name: "Widget", Price: 1250})
+	plan := ta.db.AddItem(models.Item{Name: "Bronze Plan", Price: 2000, IsRecurring: true, PlanID: "price_bronze"})
+	token := ta.csrfToken(t)
+
+	resp := ta.post(t, "/cart/add", form("item_id", strconv.Itoa(widget), "quantity", "2", "csrf_token", token))
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/cart" {
+		t.Fatalf("add: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	// subscription plans are never added to the cart
+	ta.post(t, "/cart/add", form("item_id", strconv.Itoa(plan), "csrf_token", token))
+
+	_, body := ta.get(t, "/cart")
+	if !strings.Contains(body, "Widget") || !strings.Contains(body, "$25.00") {
+		t.Errorf("cart does not show two widgets for $25.00")
+	}
+	if strings.Contains(body, "Bronze Plan") {
+		t.Errorf("cart shows a subscription plan")
+	}
+
+	ta.post(t, "/cart/remove", form("item_id", strconv.Itoa(widget), "csrf_token", token))
+	_, body = ta.get(t, "/cart")
+	if strings.Contains(body, "Widget") {
+		t.Errorf("removed item is still in the cart")
+	}
+}
+
+// unsavedCheckouts is a repository that loses every checkout
+type unsavedCheckouts struct {
+	*models.MemoryModel
+}
+
+func (unsavedCheckouts) SaveCheckout(models.Customer, models.Transaction, models.Order, []models.OrderItem) (int, error) {
+	return 0, errors.New("database is down")
+}
+
+func TestPaymentSuccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		amount  int
+		items   string
+		unsaved bool
+		receipt bool
+	}{
+		{"paid for the cart", 2500, "", false, true},
+		{"paid less than the cart", 2000, "", false, false},
+		{"paid for other items", 2500, "99:1", false, false},
+		{"order not saved", 2500, "", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t)
+			widget := ta.db.AddItem(models.Item{Name: "Widget", Price: 1250})
+			token := ta.csrfToken(t)
+			ta.post(t, "/cart/add", form("item_id", strconv.Itoa(widget), "quantity", "2", "csrf_token", token))
+			if tt.unsaved {
+				ta.DB = unsavedCheckouts{ta.db}
+			}
+
+			quote, err := ta.db.QuoteForLines([]models.CartLine{{ItemID: widget, Quantity: 2}}, "", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			metadata := quote.Metadata()
+			if tt.items != "" {
+				metadata["items"] = tt.items
+			}
+			pi, _, err := ta.gateway.CreatePaymentIntent("usd", tt.amount, metadata, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := ta.gateway.ConfirmPaymentIntent(pi.ID, cards.FakeCardVisa); err != nil {
+				t.Fatal(err)
+			}
+
+			resp := ta.post(t, "/payment-succeeded", form(
+				"first_name", "Jane",
+				"last_name", "Doe",
+				"email", "jane@example.com",
+				"payment_intent", pi.ID,
+				"payment_method", cards.FakeCardVisa,
+				"csrf_token", token,
+			))
+			want := "/payment-problem"
+			if tt.receipt {
+				want = "/receipt"
+			}
+			if got := resp.Header.Get("Location"); resp.StatusCode != http.StatusSeeOther || got != want {
+				t.Errorf("status %d, location %q; want a redirect to %s", resp.StatusCode, got, want)
+			}
+
+			orders, _, _, err := ta.db.GetAllOrdersPaginated(false, 10, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.receipt != (len(orders) == 1) {
+				t.Errorf("%d orders recorded", len(orders))
+			}
+			if tt.receipt && orders[0].Amount != 2500 {
+				t.Errorf("order amount = %d, want 2500", orders[0].Amount)
+			}
+
+			// a charge with no order is left for someone to reconcile
+			recs, err := ta.db.GetUnresolvedReconciliations()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.receipt != (len(recs) == 0) {
+				t.Errorf("%d charges to reconcile", len(recs))
+			}
+			if len(recs) == 1 && (recs[0].PaymentIntent != pi.ID || recs[0].Amount != tt.amount || recs[0].Kind != models.ReconcileCharge) {
+				t.Errorf("reconciliation = %+v, want the %d charged on %s", recs[0], tt.amount, pi.ID)
+			}
+
+			if !tt.receipt {
+				resp, body := ta.get(t, want)
+				if resp.StatusCode != http.StatusOK || !strings.Contains(body, pi.ID) {
+					t.Errorf("payment problem page: status %d, reference %s not shown", resp.StatusCode, pi.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestAdminPages(t *testing.T) {
+	ta := newTestApp(t)
+
+	resp, _ := ta.get(t, "/admin/dashboard")
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "/login" {
+		t.Errorf("signed out: status %d, location %q; want a redirect to /login", resp.StatusCode, resp.Header.Get("Location"))
+	}
+
+	ta.signIn(t, models.RoleSupport)
+	if resp, _ := ta.get(t, "/admin/dashboard"); resp.StatusCode != http.StatusOK {
+		t.Errorf("support on the dashboard: status %d, want 200", resp.StatusCode)
+	}
+	if resp, _ := ta.get(t, "/admin/virtual-terminal"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("support on the virtual terminal: status %d, want 403", resp.StatusCode)
+	}
+}
+
+func TestLoginTwoFactor(t *testing.T) {
+	tests := []struct {
+		name         string
+		secondFactor bool
+		location     string
+	}{
+		{"token issued on password alone", false, "/login"},
+		{"token issued after the second factor", true, "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestApp(t)
+			hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ta.db.AddUser(models.User{Email: "owner@example.com", Role: models.RoleOwner}, string(hash))
+			user, _ := ta.db.GetUserByEmail("owner@example.com")
+			if err := ta.db.EnableTwoFactor(user.ID, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			token, err := models.GenerateToken(user.ID, time.Hour, models.ScopeAuthentication)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token.SecondFactor = tt.secondFactor
+			if err := ta.db.InsertToken(token, user); err != nil {
+				t.Fatal(err)
+			}
+
+			resp := ta.post(t, "/login", form(
+				"email", user.Email,
+				"password", "password",
+				"token", token.PlainText,
+				"csrf_token", ta.csrfToken(t),
+			))
+			if got := resp.Header.Get("Location"); got != tt.location {
+				t.Errorf("login went to %q, want %q", got, tt.location)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/gob"
 	"flag"
 	"fmt"
@@ -15,7 +16,9 @@ import (
 	"github.com/alexedwards/scs/v2"
 	_ "github.com/joho/godotenv/autoload"
 
+	"github.com/wtran29/go-ecommerce/internal/cards"
 	"github.com/wtran29/go-ecommerce/internal/driver"
+	"github.com/wtran29/go-ecommerce/internal/events"
 	"github.com/wtran29/go-ecommerce/internal/models"
 )
 
@@ -32,9 +35,12 @@ type config struct {
 		dsn string
 	}
 	stripe struct {
-		secret string
-		key    string
+		secret  string
+		key     string
+		gateway string
 	}
+	taxRate   int    // basis points, 825 is 8.25%
+	currency  string // currency every payment is taken in
 	secretkey string
 	frontend  string
 }
@@ -44,8 +50,11 @@ type application struct {
 	logger        *slog.Logger
 	templateCache map[string]*template.Template
 	version       string
-	DB            models.DBModel
+	DB            models.Repository
 	Session       *scs.SessionManager
+	Gateway       cards.PaymentReader
+	Hub           *Hub
+	Events        events.Bus
 }
 
 func (app *application) serve() error {
@@ -61,8 +70,14 @@ func (app *application) serve() error {
 	app.logger.Info(fmt.Sprintf("Starting HTTP server in %s mode on port %d", app.config.env, app.config.port))
 	return srv.ListenAndServe()
 }
-func main() {
+
+// the session stores these values, so gob must know them before any session is read
+func init() {
 	gob.Register(TransactionData{})
+	gob.Register(models.Cart{})
+}
+
+func main() {
 	var cfg config
 	flag.IntVar(&cfg.port, "port", 4000, "Server port to listen on")
 	flag.StringVar(&cfg.env, "env", "development", "Application environment {development|production}")
@@ -71,6 +86,9 @@ func main() {
 		os.Getenv("ECOMM_HOST"), os.Getenv("ECOMM_PORT"), os.Getenv("ECOMM_USER"), os.Getenv("ECOMM_PW"), os.Getenv("ECOMM_DBNAME")), "DSN")
 	flag.StringVar(&cfg.secretkey, "secret", fmt.Sprintf("%v", os.Getenv("SKEY")), "secret key")
 	flag.StringVar(&cfg.frontend, "frontend", "http://localhost:4000", "url for frontend")
+	flag.IntVar(&cfg.taxRate, "taxrate", 0, "Sales tax rate in basis points")
+	flag.StringVar(&cfg.currency, "currency", "usd", "Currency payments are taken in")
+	flag.StringVar(&cfg.stripe.gateway, "gateway", "stripe", "Payment gateway {stripe|fake}")
 
 	flag.Parse()
 
@@ -80,6 +98,16 @@ func main() {
 	jsonLogger := slog.NewJSONHandler(os.Stdout, nil)
 	logger := slog.New(jsonLogger)
 
+	// the fake gateway keeps its payments in the api process, so read them from there
+	var gateway cards.PaymentReader = cards.NewFakeClient(cfg.api + "/api/fake-gateway")
+	if cfg.stripe.gateway != "fake" {
+		var err error
+		gateway, err = cards.NewGateway(cfg.stripe.gateway, cfg.stripe.secret, cfg.stripe.key)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	conn, err := driver.OpenDB(cfg.db.dsn)
 	if err != nil {
 		log.Fatal(err)
@@ -98,17 +126,19 @@ func main() {
 		logger:        logger,
 		templateCache: tc,
 		version:       version,
-		DB:            models.DBModel{DB: conn},
+		DB:            &models.DBModel{DB: conn},
 		Session:       session,
+		Gateway:       gateway,
+		Hub:           NewHub(logger),
+		Events:        events.NewPostgres(conn, logger),
 	}
 
-	go app.ListenToWsChannel()
-
-	// app.DB.CreateTables()
+	go app.Hub.Run()
+	go app.relayEvents(context.Background())
 
 	err = app.serve()
 	if err != nil {
-		app.logger.Error("Error starting http server", err)
+		app.logger.Error("Error starting http server", "error", err)
 		log.Fatal(err)
 	}
 
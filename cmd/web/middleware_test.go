@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// postRoutes lists every POST route of the web app
+func postRoutes(t *testing.T, ta *testApp) []string {
+	t.Helper()
+
+	params := regexp.MustCompile(`\{[^}]*\}`)
+	var paths []string
+	err := chi.Walk(ta.routes().(chi.Routes), func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		if method == http.MethodPost {
+			paths = append(paths, params.ReplaceAllString(route, "1"))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no POST routes found")
+	}
+	return paths
+}
+
+func TestCSRF(t *testing.T) {
+	for _, path := range postRoutes(t, newTestApp(t)) {
+		t.Run(path, func(t *testing.T) {
+			ta := newTestApp(t)
+
+			// a session that never rendered a form has no token to match, even an empty one
+			if resp := ta.post(t, path, form("csrf_token", "")); resp.StatusCode != http.StatusForbidden {
+				t.Errorf("no session token: status %d, want 403", resp.StatusCode)
+			}
+
+			token := ta.csrfToken(t)
+			if resp := ta.post(t, path, form()); resp.StatusCode != http.StatusForbidden {
+				t.Errorf("missing token: status %d, want 403", resp.StatusCode)
+			}
+			if resp := ta.post(t, path, form("csrf_token", token+"x")); resp.StatusCode != http.StatusForbidden {
+				t.Errorf("wrong token: status %d, want 403", resp.StatusCode)
+			}
+			if resp := ta.post(t, path, form("csrf_token", token)); resp.StatusCode == http.StatusForbidden {
+				t.Errorf("valid token: status 403")
+			}
+
+			req, err := http.NewRequest(http.MethodPost, ta.server.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-CSRF-Token", token)
+			resp, err := ta.client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusForbidden {
+				t.Errorf("valid token in the header: status 403")
+			}
+		})
+	}
+}
+
+func TestCSRFTokenOnlyForForms(t *testing.T) {
+	ta := newTestApp(t)
+
+	if resp, _ := ta.get(t, "/"); resp.Header.Get("Set-Cookie") != "" {
+		t.Errorf("a page without a form started a session")
+	}
+	if resp, _ := ta.get(t, "/login"); resp.Header.Get("Set-Cookie") == "" {
+		t.Errorf("the login form did not start a session")
+	}
+}
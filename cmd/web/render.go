@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"embed"
 	"fmt"
 	"html/template"
 	"net/http"
 	"strings"
+
+	"github.com/wtran29/go-ecommerce/internal/models"
 )
 
 type templateData struct {
@@ -13,16 +16,33 @@ type templateData struct {
 	IntMap          map[string]int
 	FloatMap        map[string]float32
 	Data            map[string]interface{}
-	CSRFToken       string
 	Flash           string
 	Warning         string
 	Error           string
 	IsAuthenticated int
 	UserID          int
+	UserRole        string
 	API             string
 	CSSVersion      string
 	StripeSecretKey string
 	StripePubKey    string
+
+	csrfToken func() string
+}
+
+// CSRFToken is the token a form sends back. The session is only given one when a page
+// renders a form, so browsing pages without forms does not start a session.
+func (td *templateData) CSRFToken() string {
+	if td.csrfToken == nil {
+		return ""
+	}
+	return td.csrfToken()
+}
+
+// Can reports whether the logged in user may do something, so templates can hide
+// actions with {{if .Can "sales:refund"}}
+func (td *templateData) Can(permission string) bool {
+	return models.RoleCan(td.UserRole, permission)
 }
 
 var functions = template.FuncMap{
@@ -41,9 +61,21 @@ func (app *application) addDefaultData(td *templateData, r *http.Request) *templ
 	td.API = app.config.api
 	td.StripeSecretKey = app.config.stripe.secret
 	td.StripePubKey = app.config.stripe.key
+	td.csrfToken = func() string {
+		token, err := app.csrfToken(r)
+		if err != nil {
+			app.logger.Error(err.Error())
+		}
+		return token
+	}
 	if app.Session.Exists(r.Context(), "userID") {
 		td.IsAuthenticated = 1
 		td.UserID = app.Session.GetInt(r.Context(), "userID")
+		if user, ok := r.Context().Value(userContextKey).(models.User); ok {
+			td.UserRole = user.Role
+		} else if user, err := app.DB.GetOneUser(td.UserID); err == nil {
+			td.UserRole = user.Role
+		}
 	} else {
 		td.IsAuthenticated = 0
 		td.UserID = 0
@@ -70,12 +102,17 @@ func (app *application) renderTemplate(w http.ResponseWriter, r *http.Request, p
 		td = &templateData{}
 	}
 	td = app.addDefaultData(td, r)
-	err = t.Execute(w, td)
+
+	// render before writing anything, as the session is saved with the first write and
+	// rendering a form may give it a CSRF token
+	var buf bytes.Buffer
+	err = t.Execute(&buf, td)
 	if err != nil {
 		app.logger.Error(err.Error())
 		return err
 	}
-	return nil
+	_, err = buf.WriteTo(w)
+	return err
 }
 
 func (app *application) parseTemplate(partials []string, page, templateToRender string) (*template.Template, error) {
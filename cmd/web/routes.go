@@ -4,32 +4,46 @@ import (
 	"net/http"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/wtran29/go-ecommerce/internal/models"
 )
 
 func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(SessionLoad)
+	// every unsafe request must carry the session's CSRF token; list paths here to
+	// exempt them
+	mux.Use(app.CSRF())
 
 	mux.Get("/", app.Home)
 	mux.Get("/ws", app.WsEndPoint)
 
 	mux.Route("/admin", func(mux chi.Router) {
 		mux.Use(app.Auth)
-		mux.Get("/virtual-terminal", app.VirtualTerminal)
-		mux.Get("/all-sales", app.AllSales)
-		mux.Get("/all-subscriptions", app.AllSubscriptions)
-		mux.Get("/sales/{id}", app.ShowSale)
-		mux.Get("/subscriptions/{id}", app.ShowSubscription)
-		mux.Get("/all-users", app.AllUsers)
-		mux.Get("/all-users/{id}", app.OneUser)
+		mux.Get("/two-factor", app.TwoFactor)
+		mux.With(app.RequirePermission(models.PermChargeCards)).Get("/virtual-terminal", app.VirtualTerminal)
+
+		sales := mux.With(app.RequirePermission(models.PermViewSales))
+		sales.Get("/dashboard", app.Dashboard)
+		sales.Get("/all-sales", app.AllSales)
+		sales.Get("/all-subscriptions", app.AllSubscriptions)
+		sales.Get("/sales/{id}", app.ShowSale)
+		sales.Get("/subscriptions/{id}", app.ShowSubscription)
+
+		users := mux.With(app.RequirePermission(models.PermViewUsers))
+		users.Get("/all-users", app.AllUsers)
+		users.Get("/all-users/{id}", app.OneUser)
 
 	})
 	// mux.Post("/virtual-terminal-payment-succeeded", app.VirtualTerminalPaymentSuccess)
 	// mux.Get("/virtual-terminal-receipt", app.VirtualTerminalReceipt)
 
 	mux.Get("/item/{id}", app.ChargeOneTime)
+	mux.Get("/cart", app.ShowCart)
+	mux.Post("/cart/add", app.AddToCart)
+	mux.Post("/cart/remove", app.RemoveFromCart)
 	mux.Post("/payment-succeeded", app.PaymentSuccess)
 	mux.Get("/receipt", app.Receipt)
+	mux.Get("/payment-problem", app.PaymentProblem)
 
 	mux.Get("/plans/bronze", app.BronzePlan)
 	mux.Get("/receipt/bronze", app.BronzePlanReceipt)
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/wtran29/go-ecommerce/internal/cards"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// testApp is the web app running on the in-memory repository and the fake gateway,
+// with a client that keeps its session cookie and does not follow redirects
+type testApp struct {
+	*application
+	db      *models.MemoryModel
+	gateway *cards.FakeGateway
+	server  *httptest.Server
+	client  *http.Client
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	var cfg config
+	cfg.env = "test"
+	cfg.api = "http://localhost:4001"
+	cfg.currency = "usd"
+
+	// SessionLoad uses the package session
+	session = scs.New()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ta := &testApp{
+		db:      models.NewMemoryModel(),
+		gateway: cards.NewFakeGateway(),
+	}
+	ta.application = &application{
+		config:        cfg,
+		logger:        logger,
+		templateCache: make(map[string]*template.Template),
+		version:       version,
+		DB:            ta.db,
+		Session:       session,
+		Gateway:       ta.gateway,
+		Hub:           NewHub(logger),
+	}
+	ta.server = httptest.NewServer(ta.routes())
+	t.Cleanup(ta.server.Close)
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ta.client = &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return ta
+}
+
+// get requests path and returns the response and its body
+func (ta *testApp) get(t *testing.T, path string) (*http.Response, string) {
+	t.Helper()
+
+	resp, err := ta.client.Get(ta.server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// post submits form to path as a browser would; the CSRF token is up to the caller
+func (ta *testApp) post(t *testing.T, path string, form url.Values) *http.Response {
+	t.Helper()
+
+	resp, err := ta.client.PostForm(ta.server.URL+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+
+// csrfToken returns the token the login form of the client's session carries
+func (ta *testApp) csrfToken(t *testing.T) string {
+	t.Helper()
+
+	_, body := ta.get(t, "/login")
+	m := csrfField.FindStringSubmatch(body)
+	if m == nil || m[1] == "" {
+		t.Fatal("login page has no CSRF token")
+	}
+	return m[1]
+}
+
+// signIn adds a user with the given role and logs the client in as them
+func (ta *testApp) signIn(t *testing.T, role string) models.User {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := fmt.Sprintf("%s-%d@example.com", role, time.Now().UnixNano())
+	err = ta.db.AddUser(models.User{FirstName: "Admin", LastName: role, Email: email, Role: role}, string(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := ta.db.GetUserByEmail(email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := ta.post(t, "/login", url.Values{
+		"email":      {email},
+		"password":   {"password"},
+		"csrf_token": {ta.csrfToken(t)},
+	})
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/" {
+		t.Fatalf("login: status %d, location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	return user
+}
+
+// form builds form values from name, value pairs
+func form(pairs ...string) url.Values {
+	v := url.Values{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		v.Add(pairs[i], pairs[i+1])
+	}
+	return v
+}
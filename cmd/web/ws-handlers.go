@@ -1,23 +1,25 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/wtran29/go-ecommerce/internal/events"
+	"github.com/wtran29/go-ecommerce/internal/models"
 )
 
-type WebSocketConnection struct {
-	*websocket.Conn
-}
-
 type WsPayload struct {
-	Action      string              `json:"action"`
-	Message     string              `json:"message"`
-	Username    string              `json:"username"`
-	MessageType string              `json:"message_type"`
-	UserID      int                 `json:"user_id"`
-	Conn        WebSocketConnection `json:"-"`
+	Action      string `json:"action"`
+	Message     string `json:"message"`
+	Username    string `json:"username"`
+	MessageType string `json:"message_type"`
+	UserID      int    `json:"user_id"`
 }
 
 type WsJsonResponse struct {
@@ -26,92 +28,135 @@ type WsJsonResponse struct {
 	UserID  int    `json:"user_id"`
 }
 
-var upgradeConnection = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin:     func(r *http.Request) bool { return true },
+// checkOrigin only accepts websocket connections from pages served by the frontend.
+// Requests without an Origin header do not come from a browser and are let through.
+func (app *application) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	o, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	f, err := url.Parse(app.config.frontend)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(o.Scheme, f.Scheme) && strings.EqualFold(o.Host, f.Host)
 }
 
-var clients = make(map[WebSocketConnection]string)
-
-var wsChan = make(chan WsPayload)
-
+// WsEndPoint upgrades the request of a signed in user to a websocket
 func (app *application) WsEndPoint(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+	if userID == 0 {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	user, err := app.DB.GetOneUser(userID)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
 	wsUpgrade := w
 	if upgrade, ok := w.(interface{ Unwrap() http.ResponseWriter }); ok {
 		wsUpgrade = upgrade.Unwrap()
 	}
-	app.logger.Debug(fmt.Sprintf("w's type is %T\n", w))
-	ws, err := upgradeConnection.Upgrade(wsUpgrade, r, nil)
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     app.checkOrigin,
+	}
+	ws, err := upgrader.Upgrade(wsUpgrade, r, nil)
 	if err != nil {
 		app.logger.Error(err.Error())
 		return
 	}
 
-	app.logger.Info(fmt.Sprintf("Client connected from %s", r.RemoteAddr))
-	var response WsJsonResponse
-	response.Message = "Connected to server"
+	app.logger.Info(fmt.Sprintf("Client connected from %s for user %d", r.RemoteAddr, user.ID))
 
-	err = ws.WriteJSON(response)
-	if err != nil {
-		app.logger.Error(err.Error())
-		return
+	client := &Client{
+		hub:    app.Hub,
+		conn:   ws,
+		send:   make(chan []byte, sendBuffer),
+		userID: user.ID,
+		role:   user.Role,
 	}
+	app.Hub.register <- client
 
-	conn := WebSocketConnection{Conn: ws}
-	clients[conn] = ""
+	hello, _ := json.Marshal(WsJsonResponse{Message: "Connected to server"})
+	client.send <- hello
 
-	go app.ListenForWS(&conn)
+	go client.writePump()
+	go client.readPump(app.handleWsPayload)
 }
 
-func (app *application) ListenForWS(conn *WebSocketConnection) {
-	defer func() {
-		if r := recover(); r != nil {
-			app.logger.Error(fmt.Sprintf("%v", r))
-		}
-	}()
-
-	var payload WsPayload
-	for {
-		err := conn.ReadJSON(&payload)
-		if err != nil {
-			// do nothing
-			_ = conn.Close()
-			delete(clients, *conn)
-			break
-		} else {
-			payload.Conn = *conn
-			app.logger.Info(fmt.Sprintf("ListenForWS: %v", payload.Action))
-			wsChan <- payload
-		}
+// handleWsPayload acts on a message sent by a browser. Browsers only listen for now:
+// anything that changes state goes through the api, which publishes an event.
+func (app *application) handleWsPayload(c *Client, payload WsPayload) {
+	app.logger.Info(fmt.Sprintf("ListenForWS: %v", payload.Action))
+}
 
+// relayEvents passes events published by any instance to the sockets they concern
+// until ctx is done
+func (app *application) relayEvents(ctx context.Context) {
+	err := app.Events.Subscribe(ctx, app.relayEvent)
+	if err != nil && ctx.Err() == nil {
+		app.logger.Error(err.Error())
 	}
 }
 
-func (app *application) ListenToWsChannel() {
-	var response WsJsonResponse
-	for {
-		e := <-wsChan
-		switch e.Action {
-		case "deleteUser":
-			response.Action = "logout"
-			response.Message = "Your account has been deleted."
-			response.UserID = e.UserID
-			app.broadcastToAll(response)
-
-		default:
-		}
+func (app *application) relayEvent(e events.Event) {
+	switch e.Type {
+	case events.UserDeleted:
+		app.Hub.SendToUser(e.UserID, WsJsonResponse{
+			Action:  "logout",
+			Message: "Your account has been deleted.",
+			UserID:  e.UserID,
+		})
+
+	case events.PasswordChanged:
+		app.Hub.SendToUser(e.UserID, WsJsonResponse{
+			Action:  "logout",
+			Message: "Your password has been changed.",
+			UserID:  e.UserID,
+		})
+
+	case events.TokenRevoked:
+		app.Hub.SendToUser(e.UserID, WsJsonResponse{
+			Action:  "tokenRevoked",
+			Message: "A token has been revoked.",
+			UserID:  e.UserID,
+		})
+
+	case events.SaleCreated:
+		app.Hub.SendToPermission(models.PermViewSales, WsJsonResponse{
+			Action:  "newSale",
+			Message: fmt.Sprintf("New sale of %s", formatCurrency(e.Amount)),
+		})
+
+	case events.OrderUpdated:
+		app.Hub.SendToPermission(models.PermViewSales, WsJsonResponse{
+			Action:  "orderUpdated",
+			Message: "An order has changed.",
+		})
+
+	default:
 	}
 }
 
-func (app *application) broadcastToAll(response WsJsonResponse) {
-	for client := range clients {
-		// broadcast to all connected client
-		err := client.WriteJSON(response)
-		if err != nil {
-			app.logger.Error(fmt.Sprintf("Websocket err on %s: %s", response.Action, err))
-			_ = client.Close()
-			delete(clients, client)
-		}
+// publish sends an event to every instance. Events are notifications only, so a
+// failure is logged rather than failing the request that caused it.
+func (app *application) publish(e events.Event) {
+	if app.Events == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := app.Events.Publish(ctx, e)
+	if err != nil {
+		app.logger.Error(fmt.Sprintf("publish %s: %s", e.Type, err))
 	}
 }
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/wtran29/go-ecommerce/internal/events"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+func TestRelayOrderUpdated(t *testing.T) {
+	h := NewHub(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	go h.Run()
+	app := &application{Hub: h}
+
+	viewer := hubClient(h, 1, models.RoleReadOnly, sendBuffer)
+	// a role that is not known may not see sales
+	outsider := hubClient(h, 2, "", sendBuffer)
+
+	app.relayEvent(events.Event{Type: events.OrderUpdated, OrderID: 7, StatusID: int(models.OrderRefunded)})
+	h.Broadcast(WsJsonResponse{Action: "marker"})
+
+	if got, _ := nextMessage(t, viewer); got.Action != "orderUpdated" {
+		t.Errorf("a user who may view sales got %q, want orderUpdated", got.Action)
+	}
+	if got, _ := nextMessage(t, outsider); got.Action != "marker" {
+		t.Errorf("a user who may not view sales got %q", got.Action)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+const (
+	// writeWait is how long a write to a socket may take
+	writeWait = 10 * time.Second
+	// pongWait is how long a socket may stay silent before it is dropped
+	pongWait = 60 * time.Second
+	// pingPeriod is how often sockets are pinged; it must be less than pongWait
+	pingPeriod = pongWait * 9 / 10
+	// maxMessageSize is the largest message a browser may send
+	maxMessageSize = 4096
+	// sendBuffer is how many messages may wait for a slow socket before it is dropped
+	sendBuffer = 16
+)
+
+// Client is one websocket connection of a signed in user
+type Client struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	send   chan []byte
+	userID int
+	role   string
+}
+
+// envelope is a message and the sockets it is addressed to. A zero userID, an empty
+// role and an empty permission reach everyone.
+type envelope struct {
+	userID     int
+	role       string
+	permission string
+	message    WsJsonResponse
+}
+
+func (e envelope) reaches(c *Client) bool {
+	return (e.userID == 0 || e.userID == c.userID) &&
+		(e.role == "" || e.role == c.role) &&
+		(e.permission == "" || models.RoleCan(c.role, e.permission))
+}
+
+// Hub owns the set of connected clients. Only its Run goroutine touches the set;
+// everything else talks to it over channels.
+type Hub struct {
+	logger     *slog.Logger
+	clients    map[*Client]bool
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan envelope
+}
+
+// NewHub returns a hub; call Run to start it
+func NewHub(logger *slog.Logger) *Hub {
+	return &Hub{
+		logger:     logger,
+		clients:    make(map[*Client]bool),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan envelope, 64),
+	}
+}
+
+// Run registers and unregisters clients and delivers messages until the program ends
+func (h *Hub) Run() {
+	for {
+		select {
+		case c := <-h.register:
+			h.clients[c] = true
+
+		case c := <-h.unregister:
+			if h.clients[c] {
+				delete(h.clients, c)
+				close(c.send)
+			}
+
+		case e := <-h.broadcast:
+			msg, err := json.Marshal(e.message)
+			if err != nil {
+				h.logger.Error(err.Error())
+				continue
+			}
+			for c := range h.clients {
+				if !e.reaches(c) {
+					continue
+				}
+				select {
+				case c.send <- msg:
+				default:
+					// the socket is not keeping up, drop it
+					delete(h.clients, c)
+					close(c.send)
+				}
+			}
+		}
+	}
+}
+
+// SendToUser delivers a message to every socket of one user
+func (h *Hub) SendToUser(userID int, message WsJsonResponse) {
+	h.broadcast <- envelope{userID: userID, message: message}
+}
+
+// SendToRole delivers a message to every socket of users with a role
+func (h *Hub) SendToRole(role string, message WsJsonResponse) {
+	h.broadcast <- envelope{role: role, message: message}
+}
+
+// SendToPermission delivers a message to every socket of users whose role has a permission
+func (h *Hub) SendToPermission(permission string, message WsJsonResponse) {
+	h.broadcast <- envelope{permission: permission, message: message}
+}
+
+// Broadcast delivers a message to every socket
+func (h *Hub) Broadcast(message WsJsonResponse) {
+	h.broadcast <- envelope{message: message}
+}
+
+// readPump reads messages from the browser and hands them to handle. It keeps the
+// connection alive by extending the read deadline on every pong.
+func (c *Client) readPump(handle func(*Client, WsPayload)) {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		var payload WsPayload
+		err := c.conn.ReadJSON(&payload)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				c.hub.logger.Error(fmt.Sprintf("Websocket read from user %d: %s", c.userID, err))
+			}
+			return
+		}
+		handle(c, payload)
+	}
+}
+
+// writePump writes queued messages to the browser and pings it every pingPeriod. It
+// is the only goroutine that writes to the connection.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// the hub closed the channel
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			err := c.conn.WriteMessage(websocket.TextMessage, msg)
+			if err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			err := c.conn.WriteMessage(websocket.PingMessage, nil)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/wtran29/go-ecommerce/internal/models"
+)
+
+// hubClient registers a client on the hub. The hub never touches the connection, so
+// there is none; messages are read from send.
+func hubClient(h *Hub, userID int, role string, buffer int) *Client {
+	c := &Client{hub: h, send: make(chan []byte, buffer), userID: userID, role: role}
+	h.register <- c
+	return c
+}
+
+// nextMessage returns the next message queued for a client, and false once the hub
+// has closed its channel
+func nextMessage(t *testing.T, c *Client) (WsJsonResponse, bool) {
+	t.Helper()
+
+	select {
+	case msg, ok := <-c.send:
+		if !ok {
+			return WsJsonResponse{}, false
+		}
+		var resp WsJsonResponse
+		if err := json.Unmarshal(msg, &resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp, true
+	case <-time.After(time.Second):
+		t.Fatalf("user %d got no message", c.userID)
+		return WsJsonResponse{}, false
+	}
+}
+
+func TestHub(t *testing.T) {
+	h := NewHub(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	go h.Run()
+
+	owner := hubClient(h, 1, models.RoleOwner, sendBuffer)
+	support := hubClient(h, 2, models.RoleSupport, sendBuffer)
+	readOnly := hubClient(h, 3, models.RoleReadOnly, sendBuffer)
+	clients := []*Client{owner, support, readOnly}
+
+	// each send is followed by a broadcast, so a client the send did not reach gets
+	// the broadcast next
+	tests := []struct {
+		name    string
+		send    func(WsJsonResponse)
+		reaches []*Client
+	}{
+		{"broadcast", h.Broadcast, clients},
+		{"to user", func(m WsJsonResponse) { h.SendToUser(2, m) }, []*Client{support}},
+		{"to role", func(m WsJsonResponse) { h.SendToRole(models.RoleReadOnly, m) }, []*Client{readOnly}},
+		{"to permission", func(m WsJsonResponse) { h.SendToPermission(models.PermSendInvoices, m) }, []*Client{owner, support}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.send(WsJsonResponse{Action: tt.name})
+			h.Broadcast(WsJsonResponse{Action: "marker"})
+
+			for _, c := range clients {
+				want := "marker"
+				for _, r := range tt.reaches {
+					if r == c {
+						want = tt.name
+					}
+				}
+				if got, _ := nextMessage(t, c); got.Action != want {
+					t.Errorf("user %d got %q, want %q", c.userID, got.Action, want)
+				}
+				if want != "marker" {
+					nextMessage(t, c)
+				}
+			}
+		})
+	}
+
+	t.Run("unregister", func(t *testing.T) {
+		h.unregister <- support
+		if _, ok := nextMessage(t, support); ok {
+			t.Fatal("an unregistered client's channel is still open")
+		}
+		// unregistering twice is harmless
+		h.unregister <- support
+
+		h.Broadcast(WsJsonResponse{Action: "after"})
+		for _, c := range []*Client{owner, readOnly} {
+			if got, _ := nextMessage(t, c); got.Action != "after" {
+				t.Errorf("user %d got %q, want %q", c.userID, got.Action, "after")
+			}
+		}
+	})
+
+	t.Run("slow client dropped", func(t *testing.T) {
+		// a client whose buffer is full
+		slow := hubClient(h, 4, models.RoleOwner, 1)
+		slow.send <- []byte(`{"action":"unread"}`)
+
+		h.Broadcast(WsJsonResponse{Action: "too fast"})
+		if got, _ := nextMessage(t, owner); got.Action != "too fast" {
+			t.Fatalf("owner got %q", got.Action)
+		}
+		nextMessage(t, slow)
+		if _, ok := nextMessage(t, slow); ok {
+			t.Error("a client that could not take a message was kept")
+		}
+	})
+}
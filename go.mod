@@ -8,12 +8,12 @@ require (
 	github.com/jackc/pgconn v1.14.1
 	github.com/jackc/pgx/v5 v5.5.1
 	github.com/joho/godotenv v1.5.1
+	github.com/phpdave11/gofpdf v1.4.2
 	github.com/stripe/stripe-go/v76 v76.10.0
 )
 
 require (
 	github.com/go-test/deep v1.1.0 // indirect
-	github.com/phpdave11/gofpdf v1.4.2 // indirect
 	github.com/phpdave11/gofpdi v1.0.12 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 )
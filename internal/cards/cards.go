@@ -1,6 +1,10 @@
 package cards
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
 	"github.com/stripe/stripe-go/v76"
 	"github.com/stripe/stripe-go/v76/customer"
 	"github.com/stripe/stripe-go/v76/paymentintent"
@@ -9,12 +13,34 @@ import (
 	"github.com/stripe/stripe-go/v76/subscription"
 )
 
+// PaymentGateway is the set of payment provider operations used by the application.
+// A non-empty idempotencyKey is forwarded to the provider so retried calls do not
+// create duplicate objects.
+type PaymentGateway interface {
+	PaymentReader
+	CreatePaymentIntent(currency string, amount int, metadata map[string]string, idempotencyKey string) (*stripe.PaymentIntent, string, error)
+	CreateCustomer(pm, email, idempotencyKey string) (*stripe.Customer, string, error)
+	SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType, idempotencyKey string) (*stripe.Subscription, error)
+	Refund(pi string, amount int, idempotencyKey string) (*stripe.Refund, error)
+	CancelSubscription(subID string) error
+}
+
+// PaymentReader is the part of PaymentGateway that looks payments up, which is all
+// cmd/web needs to check a checkout
+type PaymentReader interface {
+	RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error)
+	GetPaymentMethod(id string) (*stripe.PaymentMethod, error)
+}
+
+// Card is the Stripe implementation of PaymentGateway
 type Card struct {
 	Secret   string
 	Key      string
 	Currency string
 }
 
+var _ PaymentGateway = (*Card)(nil)
+
 type Transaction struct {
 	TransactionStatusID int
 	Amount              int
@@ -23,18 +49,35 @@ type Transaction struct {
 	BankReturnCode      string
 }
 
+// NewGateway returns the payment gateway for the named provider
+func NewGateway(provider, secret, key string) (PaymentGateway, error) {
+	switch provider {
+	case "", "stripe":
+		return &Card{Secret: secret, Key: key}, nil
+	case "fake":
+		return NewFakeGateway(), nil
+	default:
+		return nil, fmt.Errorf("unknown payment gateway %q", provider)
+	}
+}
+
 func (c *Card) Charge(currency string, amount int) (*stripe.PaymentIntent, string, error) {
-	return c.CreatePaymentIntent(currency, amount)
+	return c.CreatePaymentIntent(currency, amount, nil, "")
 }
 
-func (c *Card) CreatePaymentIntent(currency string, amount int) (*stripe.PaymentIntent, string, error) {
+func (c *Card) CreatePaymentIntent(currency string, amount int, metadata map[string]string, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
 	stripe.Key = c.Secret
 	// payment intent
 	params := &stripe.PaymentIntentParams{
 		Amount:   stripe.Int64(int64(amount)),
 		Currency: stripe.String(currency),
 	}
-	// params.AddMetadata("key", "value")
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
+	for k, v := range metadata {
+		params.AddMetadata(k, v)
+	}
 	pi, err := paymentintent.New(params)
 	if err != nil {
 		msg := ""
@@ -67,7 +110,8 @@ func (c *Card) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
 	return pi, nil
 }
 
-func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType string) (*stripe.Subscription, error) {
+func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType, idempotencyKey string) (*stripe.Subscription, error) {
+	stripe.Key = c.Secret
 	stripeCustomerID := cust.ID
 	items := []*stripe.SubscriptionItemsParams{
 		{Plan: stripe.String(plan)},
@@ -81,6 +125,9 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 	params.AddMetadata("last_four", last4)
 	params.AddMetadata("card-type", cardType)
 	params.AddExpand("latest_invoice.payment_intent")
+	if idempotencyKey != "" {
+		params.SetIdempotencyKey(idempotencyKey)
+	}
 	subscription, err := subscription.New(params)
 	if err != nil {
 		return nil, err
@@ -88,7 +135,7 @@ func (c *Card) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardTy
 	return subscription, nil
 }
 
-func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error) {
+func (c *Card) CreateCustomer(pm, email, idempotencyKey string) (*stripe.Customer, string, error) {
 	stripe.Key = c.Secret
 	customerParams := &stripe.CustomerParams{
 		PaymentMethod: stripe.String(pm),
@@ -97,18 +144,22 @@ func (c *Card) CreateCustomer(pm, email string) (*stripe.Customer, string, error
 			DefaultPaymentMethod: stripe.String(pm),
 		},
 	}
+	if idempotencyKey != "" {
+		customerParams.SetIdempotencyKey(idempotencyKey)
+	}
 	cust, err := customer.New(customerParams)
 	if err != nil {
 		msg := ""
 		if stripeErr, ok := err.(*stripe.Error); ok {
 			msg = cardErrorMessage(stripeErr.Code)
 		}
-		return nil, msg, nil
+		return nil, msg, err
 	}
 	return cust, "", nil
 }
 
-func (c *Card) Refund(pi string, amount int) error {
+// Refund gives back amount of what was charged on a payment intent
+func (c *Card) Refund(pi string, amount int, idempotencyKey string) (*stripe.Refund, error) {
 	stripe.Key = c.Secret
 	amountToRefund := int64(amount)
 
@@ -116,11 +167,14 @@ func (c *Card) Refund(pi string, amount int) error {
 		Amount:        &amountToRefund,
 		PaymentIntent: &pi,
 	}
-	_, err := refund.New(refundParams)
+	if idempotencyKey != "" {
+		refundParams.SetIdempotencyKey(idempotencyKey)
+	}
+	re, err := refund.New(refundParams)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return re, nil
 }
 
 func (c *Card) CancelSubscription(subID string) error {
@@ -137,6 +191,50 @@ func (c *Card) CancelSubscription(subID string) error {
 	return nil
 }
 
+// VerifyPaymentIntent checks that a payment intent has succeeded for exactly the expected
+// amount and currency
+func VerifyPaymentIntent(pi *stripe.PaymentIntent, amount int, currency string) error {
+	if pi == nil {
+		return errors.New("payment intent not found")
+	}
+	if pi.Status != stripe.PaymentIntentStatusSucceeded {
+		return fmt.Errorf("payment intent %s has status %s", pi.ID, pi.Status)
+	}
+	if int(pi.Amount) != amount {
+		return fmt.Errorf("payment intent %s is for %d but the order total is %d", pi.ID, pi.Amount, amount)
+	}
+	if !strings.EqualFold(string(pi.Currency), currency) {
+		return fmt.Errorf("payment intent %s is in %s, expected %s", pi.ID, pi.Currency, currency)
+	}
+	return nil
+}
+
+// VerifyMetadata checks that a payment intent was created for what is being bought,
+// comparing every key of want with the intent's metadata
+func VerifyMetadata(pi *stripe.PaymentIntent, want map[string]string) error {
+	for k, v := range want {
+		if pi.Metadata[k] != v {
+			return fmt.Errorf("payment intent %s was created for another order", pi.ID)
+		}
+	}
+	return nil
+}
+
+// VerifySubscription checks that a new subscription is active and that its first
+// invoice, which is charged when the subscription is created, has been paid
+func VerifySubscription(sub *stripe.Subscription) error {
+	if sub == nil {
+		return errors.New("subscription not found")
+	}
+	if sub.Status != stripe.SubscriptionStatusActive && sub.Status != stripe.SubscriptionStatusTrialing {
+		return fmt.Errorf("subscription %s has status %s", sub.ID, sub.Status)
+	}
+	if sub.LatestInvoice == nil || sub.LatestInvoice.Status != stripe.InvoiceStatusPaid {
+		return fmt.Errorf("the first invoice of subscription %s has not been paid", sub.ID)
+	}
+	return nil
+}
+
 func cardErrorMessage(code stripe.ErrorCode) string {
 	var msg = ""
 	switch code {
@@ -0,0 +1,391 @@
+package cards
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Test payment methods understood by FakeGateway. They mirror the Stripe test tokens
+// so the same fixtures work against the fake and against Stripe test mode.
+const (
+	FakeCardVisa              = "pm_card_visa"
+	FakeCardDeclined          = "pm_card_chargeDeclined"
+	FakeCardExpired           = "pm_card_chargeDeclinedExpiredCard"
+	FakeCardIncorrectCVC      = "pm_card_chargeDeclinedIncorrectCvc"
+	FakeCardInsufficientFunds = "pm_card_chargeDeclinedInsufficientFunds"
+	// FakeCardChargeCustomerFail can be saved on a customer, but charging it is declined
+	FakeCardChargeCustomerFail = "pm_card_chargeCustomerFail"
+)
+
+const (
+	fakeMinAmount = 50
+	fakeMaxAmount = 99999999
+)
+
+// fakeDeclines maps a test payment method to the card error it triggers when it is
+// saved or charged
+var fakeDeclines = map[string]stripe.ErrorCode{
+	FakeCardDeclined:          stripe.ErrorCodeCardDeclined,
+	FakeCardExpired:           stripe.ErrorCodeExpiredCard,
+	FakeCardIncorrectCVC:      stripe.ErrorCodeIncorrectCVC,
+	FakeCardInsufficientFunds: stripe.ErrorCodeBalanceInsufficient,
+}
+
+// FakeGateway is a deterministic in-memory PaymentGateway. It never talks to Stripe,
+// so checkout, refund and subscription flows can be exercised offline.
+type FakeGateway struct {
+	mu            sync.Mutex
+	seq           int
+	intents       map[string]*stripe.PaymentIntent
+	customers     map[string]*stripe.Customer
+	subscriptions map[string]*stripe.Subscription
+	refunded      map[string]int
+	refunds       map[string]*stripe.Refund
+	idempotent    map[string]fakeRequest
+}
+
+// fakeRequest is what an idempotency key was first used for
+type fakeRequest struct {
+	id     string
+	params string
+}
+
+var _ PaymentGateway = (*FakeGateway)(nil)
+
+// NewFakeGateway returns an empty fake gateway
+func NewFakeGateway() *FakeGateway {
+	return &FakeGateway{
+		intents:       make(map[string]*stripe.PaymentIntent),
+		customers:     make(map[string]*stripe.Customer),
+		subscriptions: make(map[string]*stripe.Subscription),
+		refunded:      make(map[string]int),
+		refunds:       make(map[string]*stripe.Refund),
+		idempotent:    make(map[string]fakeRequest),
+	}
+}
+
+func (f *FakeGateway) nextID(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_fake_%06d", prefix, f.seq)
+}
+
+func (f *FakeGateway) CreatePaymentIntent(currency string, amount int, metadata map[string]string, idempotencyKey string) (*stripe.PaymentIntent, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	params := fmt.Sprint("payment_intent", currency, amount, metadata)
+	id, err := f.replay(idempotencyKey, params)
+	if err != nil {
+		return nil, "", err
+	}
+	if pi, ok := f.intents[id]; ok {
+		return copyIntent(pi), "", nil
+	}
+
+	switch {
+	case amount < fakeMinAmount:
+		return nil, cardErrorMessage(stripe.ErrorCodeAmountTooSmall), fakeError(stripe.ErrorCodeAmountTooSmall, stripe.ErrorTypeInvalidRequest)
+	case amount > fakeMaxAmount:
+		return nil, cardErrorMessage(stripe.ErrorCodeAmountTooLarge), fakeError(stripe.ErrorCodeAmountTooLarge, stripe.ErrorTypeInvalidRequest)
+	}
+
+	id = f.nextID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:           id,
+		Amount:       int64(amount),
+		Currency:     stripe.Currency(currency),
+		ClientSecret: id + "_secret",
+		Status:       stripe.PaymentIntentStatusRequiresPaymentMethod,
+		Metadata:     metadata,
+		Created:      time.Now().Unix(),
+	}
+	f.intents[id] = pi
+	f.remember(idempotencyKey, id, params)
+
+	return copyIntent(pi), "", nil
+}
+
+// ConfirmPaymentIntent simulates the browser confirming a payment intent with a payment
+// method, which Stripe.js does against the real gateway. Declining test cards leave the
+// intent unpaid and return the card error message.
+func (f *FakeGateway) ConfirmPaymentIntent(id, pm string) (*stripe.PaymentIntent, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.intents[id]
+	if !ok {
+		return nil, "", fakeMissing("payment_intent", id)
+	}
+
+	if code, declined := fakeChargeDecline(pm); declined {
+		return nil, cardErrorMessage(code), fakeError(code, stripe.ErrorTypeCard)
+	}
+
+	pi.PaymentMethod = &stripe.PaymentMethod{ID: pm}
+	pi.LatestCharge = &stripe.Charge{ID: f.nextID("ch")}
+	pi.Status = stripe.PaymentIntentStatusSucceeded
+
+	return copyIntent(pi), "", nil
+}
+
+func (f *FakeGateway) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pi, ok := f.intents[id]
+	if !ok {
+		return nil, fakeMissing("payment_intent", id)
+	}
+	return copyIntent(pi), nil
+}
+
+func (f *FakeGateway) GetPaymentMethod(id string) (*stripe.PaymentMethod, error) {
+	if id == "" {
+		return nil, fakeMissing("payment_method", id)
+	}
+
+	card := &stripe.PaymentMethodCard{
+		Brand:    stripe.PaymentMethodCardBrandVisa,
+		ExpMonth: 12,
+		ExpYear:  2030,
+		Last4:    "4242",
+	}
+	switch id {
+	case FakeCardDeclined:
+		card.Last4 = "0002"
+	case FakeCardExpired:
+		card.Last4 = "0069"
+	case FakeCardIncorrectCVC:
+		card.Last4 = "0127"
+	case FakeCardInsufficientFunds:
+		card.Last4 = "9995"
+	}
+
+	return &stripe.PaymentMethod{ID: id, Type: stripe.PaymentMethodTypeCard, Card: card}, nil
+}
+
+func (f *FakeGateway) CreateCustomer(pm, email, idempotencyKey string) (*stripe.Customer, string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	params := fmt.Sprint("customer", pm, email)
+	id, err := f.replay(idempotencyKey, params)
+	if err != nil {
+		return nil, "", err
+	}
+	if cust, ok := f.customers[id]; ok {
+		return cust, "", nil
+	}
+
+	if code, declined := fakeDeclines[pm]; declined {
+		return nil, cardErrorMessage(code), fakeError(code, stripe.ErrorTypeCard)
+	}
+
+	cust := &stripe.Customer{
+		ID:    f.nextID("cus"),
+		Email: email,
+		InvoiceSettings: &stripe.CustomerInvoiceSettings{
+			DefaultPaymentMethod: &stripe.PaymentMethod{ID: pm},
+		},
+	}
+	f.customers[cust.ID] = cust
+	f.remember(idempotencyKey, cust.ID, params)
+
+	return cust, "", nil
+}
+
+func (f *FakeGateway) SubscribeToPlan(cust *stripe.Customer, plan, email, last4, cardType, idempotencyKey string) (*stripe.Subscription, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if cust == nil {
+		return nil, fakeMissing("customer", "")
+	}
+
+	params := fmt.Sprint("subscription", cust.ID, plan, email, last4, cardType)
+	id, err := f.replay(idempotencyKey, params)
+	if err != nil {
+		return nil, err
+	}
+	if sub, ok := f.subscriptions[id]; ok {
+		return sub, nil
+	}
+
+	if _, ok := f.customers[cust.ID]; !ok {
+		return nil, fakeMissing("customer", cust.ID)
+	}
+	if plan == "" {
+		return nil, fakeMissing("plan", plan)
+	}
+
+	// the first invoice is charged straight away; when that is declined Stripe leaves
+	// the subscription incomplete
+	invoice := &stripe.Invoice{
+		ID:     f.nextID("in"),
+		Status: stripe.InvoiceStatusPaid,
+		Paid:   true,
+		PaymentIntent: &stripe.PaymentIntent{
+			ID:     f.nextID("pi"),
+			Status: stripe.PaymentIntentStatusSucceeded,
+		},
+	}
+	status := stripe.SubscriptionStatusActive
+	if _, declined := fakeChargeDecline(cust.InvoiceSettings.DefaultPaymentMethod.ID); declined {
+		invoice.Status, invoice.Paid = stripe.InvoiceStatusOpen, false
+		invoice.PaymentIntent.Status = stripe.PaymentIntentStatusRequiresPaymentMethod
+		status = stripe.SubscriptionStatusIncomplete
+	}
+
+	sub := &stripe.Subscription{
+		ID:            f.nextID("sub"),
+		Customer:      cust,
+		Status:        status,
+		LatestInvoice: invoice,
+		Metadata: map[string]string{
+			"last_four": last4,
+			"card-type": cardType,
+		},
+	}
+	f.subscriptions[sub.ID] = sub
+	f.remember(idempotencyKey, sub.ID, params)
+
+	return sub, nil
+}
+
+func (f *FakeGateway) Refund(pi string, amount int, idempotencyKey string) (*stripe.Refund, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	params := fmt.Sprint("refund", pi, amount)
+	id, err := f.replay(idempotencyKey, params)
+	if err != nil {
+		return nil, err
+	}
+	if re, ok := f.refunds[id]; ok {
+		refund := *re
+		return &refund, nil
+	}
+
+	intent, ok := f.intents[pi]
+	if !ok {
+		return nil, fakeMissing("payment_intent", pi)
+	}
+	if intent.Status != stripe.PaymentIntentStatusSucceeded {
+		return nil, &stripe.Error{
+			Code:           stripe.ErrorCodeChargeNotRefundable,
+			Type:           stripe.ErrorTypeInvalidRequest,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("payment intent %s has not been charged", pi),
+		}
+	}
+	if f.refunded[pi]+amount > int(intent.Amount) {
+		return nil, &stripe.Error{
+			Code:           stripe.ErrorCodeAmountTooLarge,
+			Type:           stripe.ErrorTypeInvalidRequest,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("refund amount exceeds the remaining balance of %s", pi),
+		}
+	}
+
+	f.refunded[pi] += amount
+	re := &stripe.Refund{
+		ID:            f.nextID("re"),
+		Amount:        int64(amount),
+		Currency:      intent.Currency,
+		PaymentIntent: &stripe.PaymentIntent{ID: pi},
+		Status:        stripe.RefundStatusSucceeded,
+		Created:       time.Now().Unix(),
+	}
+	f.refunds[re.ID] = re
+	f.remember(idempotencyKey, re.ID, params)
+
+	refund := *re
+	return &refund, nil
+}
+
+func (f *FakeGateway) CancelSubscription(subID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sub, ok := f.subscriptions[subID]
+	if !ok {
+		return fakeMissing("subscription", subID)
+	}
+	sub.CancelAtPeriodEnd = true
+	return nil
+}
+
+// Refunded returns the total amount refunded against a payment intent
+func (f *FakeGateway) Refunded(pi string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.refunded[pi]
+}
+
+// Cancelled reports whether a subscription was cancelled
+func (f *FakeGateway) Cancelled(subID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sub, ok := f.subscriptions[subID]
+	return ok && sub.CancelAtPeriodEnd
+}
+
+// replay returns the id of the object created for an idempotency key, if any. Like
+// Stripe, it refuses a key that is used again with different parameters.
+func (f *FakeGateway) replay(idempotencyKey, params string) (string, error) {
+	req, ok := f.idempotent[idempotencyKey]
+	if idempotencyKey == "" || !ok {
+		return "", nil
+	}
+	if req.params != params {
+		return "", &stripe.Error{
+			Type:           stripe.ErrorTypeIdempotency,
+			HTTPStatusCode: http.StatusBadRequest,
+			Msg:            fmt.Sprintf("Keys for idempotent requests can only be used with the same parameters they were first used with. Try using a key other than '%s'", idempotencyKey),
+		}
+	}
+	return req.id, nil
+}
+
+// remember records the object created for an idempotency key so retries return it
+func (f *FakeGateway) remember(idempotencyKey, id, params string) {
+	if idempotencyKey != "" {
+		f.idempotent[idempotencyKey] = fakeRequest{id: id, params: params}
+	}
+}
+
+// fakeChargeDecline returns the card error charging a test payment method triggers
+func fakeChargeDecline(pm string) (stripe.ErrorCode, bool) {
+	if pm == FakeCardChargeCustomerFail {
+		return stripe.ErrorCodeCardDeclined, true
+	}
+	code, declined := fakeDeclines[pm]
+	return code, declined
+}
+
+func copyIntent(pi *stripe.PaymentIntent) *stripe.PaymentIntent {
+	c := *pi
+	return &c
+}
+
+func fakeError(code stripe.ErrorCode, errType stripe.ErrorType) *stripe.Error {
+	return &stripe.Error{
+		Code:           code,
+		Type:           errType,
+		HTTPStatusCode: http.StatusPaymentRequired,
+		Msg:            cardErrorMessage(code),
+	}
+}
+
+func fakeMissing(resource, id string) *stripe.Error {
+	return &stripe.Error{
+		Code:           stripe.ErrorCodeResourceMissing,
+		Type:           stripe.ErrorTypeInvalidRequest,
+		HTTPStatusCode: http.StatusNotFound,
+		Msg:            fmt.Sprintf("No such %s: '%s'", resource, id),
+	}
+}
@@ -0,0 +1,147 @@
+package cards
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stripe/stripe-go/v76"
+)
+
+func TestFakeConfirmPaymentIntent(t *testing.T) {
+	tests := []struct {
+		name   string
+		pm     string
+		code   stripe.ErrorCode
+		msg    string
+		status stripe.PaymentIntentStatus
+	}{
+		{"visa", FakeCardVisa, "", "", stripe.PaymentIntentStatusSucceeded},
+		{"declined", FakeCardDeclined, stripe.ErrorCodeCardDeclined, "Your card was declined", stripe.PaymentIntentStatusRequiresPaymentMethod},
+		{"expired", FakeCardExpired, stripe.ErrorCodeExpiredCard, "Your card is expired", stripe.PaymentIntentStatusRequiresPaymentMethod},
+		{"incorrect cvc", FakeCardIncorrectCVC, stripe.ErrorCodeIncorrectCVC, "Invalid CVC code", stripe.PaymentIntentStatusRequiresPaymentMethod},
+		{"insufficient funds", FakeCardInsufficientFunds, stripe.ErrorCodeBalanceInsufficient, "Insufficient balance", stripe.PaymentIntentStatusRequiresPaymentMethod},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFakeGateway()
+			pi, _, err := f.CreatePaymentIntent("usd", 1000, nil, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, msg, err := f.ConfirmPaymentIntent(pi.ID, tt.pm)
+			var stripeErr *stripe.Error
+			if tt.code == "" && err != nil {
+				t.Fatalf("confirm: %s", err)
+			}
+			if tt.code != "" && (!errors.As(err, &stripeErr) || stripeErr.Code != tt.code) {
+				t.Fatalf("confirm error = %v, want code %s", err, tt.code)
+			}
+			if msg != tt.msg {
+				t.Errorf("message = %q, want %q", msg, tt.msg)
+			}
+
+			pi, err = f.RetrievePaymentIntent(pi.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pi.Status != tt.status {
+				t.Errorf("status = %s, want %s", pi.Status, tt.status)
+			}
+		})
+	}
+}
+
+func TestFakeIdempotencyKeys(t *testing.T) {
+	f := NewFakeGateway()
+	meta := map[string]string{"items": "1:2"}
+
+	first, _, err := f.CreatePaymentIntent("usd", 1000, meta, "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _, err := f.CreatePaymentIntent("usd", 1000, meta, "key-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != first.ID {
+		t.Errorf("retry created %s, want %s", again.ID, first.ID)
+	}
+
+	_, _, err = f.CreatePaymentIntent("usd", 9999, meta, "key-1")
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) || stripeErr.Type != stripe.ErrorTypeIdempotency {
+		t.Fatalf("reused key with other params: error = %v, want an idempotency error", err)
+	}
+
+	_, err = f.Refund(first.ID, 100, "key-1")
+	if !errors.As(err, &stripeErr) || stripeErr.Type != stripe.ErrorTypeIdempotency {
+		t.Fatalf("reused key for a refund: error = %v, want an idempotency error", err)
+	}
+}
+
+func TestFakeRefundLimits(t *testing.T) {
+	f := NewFakeGateway()
+	pi, _, _ := f.CreatePaymentIntent("usd", 1000, nil, "")
+
+	if _, err := f.Refund(pi.ID, 100, ""); err == nil {
+		t.Fatal("refunded an intent that was never charged")
+	}
+	if _, _, err := f.ConfirmPaymentIntent(pi.ID, FakeCardVisa); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Refund(pi.ID, 600, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Refund(pi.ID, 500, ""); err == nil {
+		t.Fatal("refunded more than was charged")
+	}
+	if got := f.Refunded(pi.ID); got != 600 {
+		t.Errorf("refunded = %d, want 600", got)
+	}
+}
+
+func TestFakeClient(t *testing.T) {
+	f := NewFakeGateway()
+	srv := httptest.NewServer(f.Handler())
+	defer srv.Close()
+
+	pi, _, _ := f.CreatePaymentIntent("usd", 1500, nil, "")
+
+	resp, err := http.Post(srv.URL+"/payment-intents/"+pi.ID+"/confirm", "application/json",
+		strings.NewReader(`{"payment_method": "`+FakeCardVisa+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("confirm status = %d", resp.StatusCode)
+	}
+
+	c := NewFakeClient(srv.URL)
+	got, err := c.RetrievePaymentIntent(pi.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyPaymentIntent(got, 1500, "usd"); err != nil {
+		t.Errorf("verify: %s", err)
+	}
+
+	pm, err := c.GetPaymentMethod(FakeCardVisa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pm.Card == nil || pm.Card.Last4 != "4242" {
+		t.Errorf("payment method card = %+v", pm.Card)
+	}
+
+	_, err = c.RetrievePaymentIntent("pi_missing")
+	var stripeErr *stripe.Error
+	if !errors.As(err, &stripeErr) || stripeErr.Code != stripe.ErrorCodeResourceMissing {
+		t.Errorf("missing intent: error = %v, want resource_missing", err)
+	}
+}
@@ -0,0 +1,121 @@
+package cards
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stripe/stripe-go/v76"
+)
+
+// Handler serves the payments of the fake gateway to other processes. It lets cmd/web
+// read the intents cmd/api created, and stands in for Stripe.js confirming an intent
+// with a test card:
+//
+//	GET  /payment-intents/{id}
+//	POST /payment-intents/{id}/confirm  {"payment_method": "pm_card_visa"}
+//	GET  /payment-methods/{id}
+func (f *FakeGateway) Handler() http.Handler {
+	mux := chi.NewRouter()
+
+	mux.Get("/payment-intents/{id}", func(w http.ResponseWriter, r *http.Request) {
+		pi, err := f.RetrievePaymentIntent(chi.URLParam(r, "id"))
+		writeFake(w, pi, err)
+	})
+
+	mux.Post("/payment-intents/{id}/confirm", func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			PaymentMethod string `json:"payment_method"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&payload)
+		if err != nil {
+			writeFake(w, nil, &stripe.Error{
+				Type:           stripe.ErrorTypeInvalidRequest,
+				HTTPStatusCode: http.StatusBadRequest,
+				Msg:            err.Error(),
+			})
+			return
+		}
+		pi, _, err := f.ConfirmPaymentIntent(chi.URLParam(r, "id"), payload.PaymentMethod)
+		writeFake(w, pi, err)
+	})
+
+	mux.Get("/payment-methods/{id}", func(w http.ResponseWriter, r *http.Request) {
+		pm, err := f.GetPaymentMethod(chi.URLParam(r, "id"))
+		writeFake(w, pm, err)
+	})
+
+	return mux
+}
+
+// writeFake writes an object, or the Stripe error in its place, as JSON
+func writeFake(w http.ResponseWriter, v any, err error) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) {
+		w.WriteHeader(stripeErr.HTTPStatusCode)
+		json.NewEncoder(w).Encode(stripeErr)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(stripe.Error{Type: stripe.ErrorTypeAPI, Msg: err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// FakeClient is a PaymentReader for a FakeGateway served by another process with
+// Handler, so cmd/web sees the payments made against the fake in cmd/api
+type FakeClient struct {
+	URL    string
+	Client *http.Client
+}
+
+var _ PaymentReader = (*FakeClient)(nil)
+
+// NewFakeClient returns a client for the fake gateway served at baseURL
+func NewFakeClient(baseURL string) *FakeClient {
+	return &FakeClient{URL: baseURL, Client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (c *FakeClient) RetrievePaymentIntent(id string) (*stripe.PaymentIntent, error) {
+	var pi stripe.PaymentIntent
+	err := c.get("/payment-intents/"+url.PathEscape(id), &pi)
+	if err != nil {
+		return nil, err
+	}
+	return &pi, nil
+}
+
+func (c *FakeClient) GetPaymentMethod(id string) (*stripe.PaymentMethod, error) {
+	var pm stripe.PaymentMethod
+	err := c.get("/payment-methods/"+url.PathEscape(id), &pm)
+	if err != nil {
+		return nil, err
+	}
+	return &pm, nil
+}
+
+// get reads an object from the fake gateway, returning its Stripe error if it sent one
+func (c *FakeClient) get(path string, v any) error {
+	resp, err := c.Client.Get(c.URL + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		stripeErr := &stripe.Error{HTTPStatusCode: resp.StatusCode}
+		if json.NewDecoder(resp.Body).Decode(stripeErr) != nil || stripeErr.Msg == "" {
+			stripeErr.Msg = fmt.Sprintf("fake gateway returned %s for %s", resp.Status, path)
+		}
+		return stripeErr
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,135 @@
+// Package events carries notifications between the api and every web instance, so a
+// change made by one process reaches the browsers connected to all of them.
+package events
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+)
+
+// Channel is the Postgres notification channel events are sent on
+const Channel = "ecommerce_events"
+
+// Event types
+const (
+	UserDeleted     = "user.deleted"
+	PasswordChanged = "user.password_changed"
+	TokenRevoked    = "token.revoked"
+	SaleCreated     = "sale.created"
+	OrderUpdated    = "order.updated"
+)
+
+// Event is one thing that happened. UserID is the user it concerns, if any.
+type Event struct {
+	Type     string    `json:"type"`
+	UserID   int       `json:"user_id,omitempty"`
+	OrderID  int       `json:"order_id,omitempty"`
+	StatusID int       `json:"status_id,omitempty"`
+	TokenID  int       `json:"token_id,omitempty"`
+	Amount   int       `json:"amount,omitempty"`
+	Currency string    `json:"currency,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// Bus publishes events and delivers them to subscribers. Delivery is best effort: a
+// subscriber that is disconnected when an event is published does not see it.
+type Bus interface {
+	Publish(ctx context.Context, e Event) error
+	// Subscribe calls handle for every event until ctx is done
+	Subscribe(ctx context.Context, handle func(Event)) error
+}
+
+var _ Bus = (*Postgres)(nil)
+
+// Postgres is a Bus on Postgres LISTEN/NOTIFY, shared by every process using the database
+type Postgres struct {
+	DB     *sql.DB
+	Logger *slog.Logger
+}
+
+// NewPostgres returns a bus on the database
+func NewPostgres(db *sql.DB, logger *slog.Logger) *Postgres {
+	return &Postgres{DB: db, Logger: logger}
+}
+
+// Publish sends an event to every subscriber
+func (p *Postgres) Publish(ctx context.Context, e Event) error {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = p.DB.ExecContext(ctx, `SELECT pg_notify($1, $2)`, Channel, string(payload))
+	return err
+}
+
+// Subscribe listens on a dedicated connection, reconnecting after errors, and calls
+// handle for every event until ctx is done
+func (p *Postgres) Subscribe(ctx context.Context, handle func(Event)) error {
+	const firstDelay = time.Second
+	delay := firstDelay
+	for {
+		listened, err := p.listen(ctx, handle)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if listened {
+			// the connection worked until now, so this is a new run of failures
+			delay = firstDelay
+		}
+		p.Logger.Error(fmt.Sprintf("event listener stopped, retrying in %s: %s", delay, err))
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay = min(delay*2, time.Minute)
+	}
+}
+
+// listen holds one connection in LISTEN until it fails, and reports whether it got as
+// far as listening
+func (p *Postgres) listen(ctx context.Context, handle func(Event)) (bool, error) {
+	conn, err := p.DB.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `LISTEN `+Channel)
+	if err != nil {
+		return false, err
+	}
+	p.Logger.Info("listening for events on " + Channel)
+
+	return true, conn.Raw(func(driverConn any) error {
+		c, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("events: unsupported driver connection %T", driverConn)
+		}
+		for {
+			n, err := c.Conn().WaitForNotification(ctx)
+			if err != nil {
+				// the connection is still listening, so do not hand it back to the pool
+				return fmt.Errorf("%w: %w", driver.ErrBadConn, err)
+			}
+			var e Event
+			err = json.Unmarshal([]byte(n.Payload), &e)
+			if err != nil {
+				p.Logger.Error(fmt.Sprintf("bad event payload %q: %s", n.Payload, err))
+				continue
+			}
+			handle(e)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"time"
+)
+
+// CartLine type for one item in a shopping cart
+type CartLine struct {
+	ItemID   int `json:"item_id"`
+	Quantity int `json:"quantity"`
+}
+
+// Cart type for shopping carts held in the web session or stored by token for the api
+type Cart struct {
+	Token     string     `json:"token,omitempty"`
+	Lines     []CartLine `json:"lines"`
+	CreatedAt time.Time  `json:"-"`
+	UpdatedAt time.Time  `json:"-"`
+}
+
+// Add adds quantity of an item to the cart, merging with an existing line
+func (c *Cart) Add(itemID, quantity int) {
+	for i := range c.Lines {
+		if c.Lines[i].ItemID == itemID {
+			c.Lines[i].Quantity += quantity
+			return
+		}
+	}
+	c.Lines = append(c.Lines, CartLine{ItemID: itemID, Quantity: quantity})
+}
+
+// Remove removes an item from the cart
+func (c *Cart) Remove(itemID int) {
+	for i := range c.Lines {
+		if c.Lines[i].ItemID == itemID {
+			c.Lines = append(c.Lines[:i], c.Lines[i+1:]...)
+			return
+		}
+	}
+}
+
+// IsEmpty reports whether the cart has no lines
+func (c *Cart) IsEmpty() bool {
+	return len(c.Lines) == 0
+}
+
+// NewCartToken returns a random token identifying an api cart
+func NewCartToken() (string, error) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+// SaveCart inserts or updates a cart by its token
+func (m *DBModel) SaveCart(c Cart) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	lines, err := json.Marshal(c.Lines)
+	if err != nil {
+		return err
+	}
+
+	stmt := `
+		INSERT INTO carts (token, lines, created_at, updated_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (token) DO UPDATE SET lines = EXCLUDED.lines, updated_at = EXCLUDED.updated_at
+	`
+
+	_, err = m.DB.ExecContext(ctx, stmt, c.Token, lines, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetCart gets a cart by token
+func (m *DBModel) GetCart(token string) (Cart, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var c Cart
+	var lines []byte
+
+	row := m.DB.QueryRowContext(ctx, `SELECT token, lines, created_at, updated_at FROM carts WHERE token = $1`, token)
+	err := row.Scan(&c.Token, &lines, &c.CreatedAt, &c.UpdatedAt)
+	if err != nil {
+		return c, err
+	}
+
+	err = json.Unmarshal(lines, &c.Lines)
+	if err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// DeleteCart deletes a cart by token
+func (m *DBModel) DeleteCart(token string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM carts WHERE token = $1`, token)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// OrderItemsForCart prices each cart line from the items table
+func (m *DBModel) OrderItemsForCart(c Cart) ([]OrderItem, error) {
+	return orderItemsForCart(m, c)
+}
+
+// orderItemsForCart prices each cart line from an item store
+func orderItemsForCart(items ItemStore, c Cart) ([]OrderItem, error) {
+	var lines []OrderItem
+	for _, l := range c.Lines {
+		item, err := items.GetItem(l.ItemID)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, OrderItem{
+			ItemID:    item.ID,
+			Quantity:  l.Quantity,
+			UnitPrice: item.Price,
+			LineTotal: item.Price * l.Quantity,
+			Item:      item,
+		})
+	}
+	return lines, nil
+}
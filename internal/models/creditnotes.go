@@ -0,0 +1,239 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// JobKindCreditNote is a job to issue and email a credit note for a refund; its payload
+// is a CreditNoteJob
+const JobKindCreditNote = "credit-note"
+
+// ErrCreditExceedsInvoice is returned for a credit note that would credit more than
+// what is left of its invoice
+var ErrCreditExceedsInvoice = errors.New("credit note is more than the invoice has left to credit")
+
+// CreditNoteJob is what the invoice service needs to issue a credit note for a refund
+type CreditNoteJob struct {
+	OrderID  int    `json:"order_id"`
+	Amount   int    `json:"amount"`
+	Currency string `json:"currency"`
+	Reason   string `json:"reason"`
+}
+
+// CreditNote type for a document crediting all or part of an invoice
+type CreditNote struct {
+	ID            int        `json:"id"`
+	Number        string     `json:"number"`
+	Year          int        `json:"year"`
+	Sequence      int        `json:"sequence"`
+	InvoiceID     int        `json:"invoice_id"`
+	InvoiceNumber string     `json:"invoice_number"`
+	OrderID       int        `json:"order_id"`
+	Email         string     `json:"email"`
+	Currency      string     `json:"currency"`
+	Amount        int        `json:"amount"`
+	Reason        string     `json:"reason"`
+	Reference     string     `json:"-"`
+	Status        string     `json:"status"`
+	IssuedAt      time.Time  `json:"issued_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+	Checksum      string     `json:"checksum"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"-"`
+}
+
+// creditNoteColumns are the columns scanned by scanCreditNote
+const creditNoteColumns = `cn.id, cn.number, cn.year, cn.sequence, cn.invoice_id, i.number, cn.order_id, cn.email,
+	cn.currency, cn.amount, cn.reason, cn.reference, cn.status, cn.issued_at, cn.sent_at, cn.pdf_checksum,
+	cn.created_at, cn.updated_at`
+
+func scanCreditNote(row interface{ Scan(...any) error }) (CreditNote, error) {
+	var cn CreditNote
+	var sentAt sql.NullTime
+	err := row.Scan(
+		&cn.ID,
+		&cn.Number,
+		&cn.Year,
+		&cn.Sequence,
+		&cn.InvoiceID,
+		&cn.InvoiceNumber,
+		&cn.OrderID,
+		&cn.Email,
+		&cn.Currency,
+		&cn.Amount,
+		&cn.Reason,
+		&cn.Reference,
+		&cn.Status,
+		&cn.IssuedAt,
+		&sentAt,
+		&cn.Checksum,
+		&cn.CreatedAt,
+		&cn.UpdatedAt,
+	)
+	if err != nil {
+		return cn, err
+	}
+	if sentAt.Valid {
+		cn.SentAt = &sentAt.Time
+	}
+	return cn, nil
+}
+
+// IssueCreditNote numbers and saves a credit note against its invoice, in the series
+// of n, which should have a prefix of its own. A credit note with the same reference
+// is returned instead of issuing another, so issuing is safe to retry. Once the notes
+// of an invoice add up to its total the invoice is marked credited.
+func (m *DBModel) IssueCreditNote(cn CreditNote, n InvoiceNumbering) (CreditNote, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var issued CreditNote
+	err := m.WithTx(ctx, func(tx *DBModel) error {
+		// lock the invoice so concurrent credit notes cannot overspend it
+		var total int
+		err := tx.DB.QueryRowContext(ctx, `
+			SELECT total FROM invoices WHERE id = $1 FOR UPDATE
+		`, cn.InvoiceID).Scan(&total)
+		if err != nil {
+			return err
+		}
+
+		issued, err = scanCreditNote(tx.DB.QueryRowContext(ctx, `
+			SELECT `+creditNoteColumns+`
+			FROM credit_notes cn JOIN invoices i ON (cn.invoice_id = i.id)
+			WHERE cn.reference = $1
+		`, cn.Reference))
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		var credited int
+		err = tx.DB.QueryRowContext(ctx, `
+			SELECT coalesce(sum(amount), 0) FROM credit_notes WHERE invoice_id = $1
+		`, cn.InvoiceID).Scan(&credited)
+		if err != nil {
+			return err
+		}
+		if cn.Amount <= 0 || credited+cn.Amount > total {
+			return ErrCreditExceedsInvoice
+		}
+
+		year := cn.IssuedAt.UTC().Year()
+		var number int
+		err = tx.DB.QueryRowContext(ctx, `
+			INSERT INTO invoice_sequences (prefix, year, last_number) VALUES ($1, $2, 1)
+			ON CONFLICT (prefix, year) DO UPDATE SET last_number = invoice_sequences.last_number + 1
+			RETURNING last_number
+		`, n.Prefix, year).Scan(&number)
+		if err != nil {
+			return err
+		}
+
+		var id int
+		err = tx.DB.QueryRowContext(ctx, `
+			INSERT INTO credit_notes
+				(number, year, sequence, invoice_id, order_id, email, currency, amount, reason,
+				reference, status, issued_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $13)
+			RETURNING id`,
+			n.Format(year, number),
+			year,
+			number,
+			cn.InvoiceID,
+			cn.OrderID,
+			cn.Email,
+			cn.Currency,
+			cn.Amount,
+			cn.Reason,
+			cn.Reference,
+			InvoiceIssued,
+			cn.IssuedAt,
+			time.Now(),
+		).Scan(&id)
+		if err != nil {
+			return err
+		}
+
+		if credited+cn.Amount == total {
+			_, err = tx.DB.ExecContext(ctx, `
+				UPDATE invoices SET status = $1, updated_at = $2 WHERE id = $3
+			`, InvoiceCredited, time.Now(), cn.InvoiceID)
+			if err != nil {
+				return err
+			}
+		}
+
+		issued, err = scanCreditNote(tx.DB.QueryRowContext(ctx, `
+			SELECT `+creditNoteColumns+`
+			FROM credit_notes cn JOIN invoices i ON (cn.invoice_id = i.id)
+			WHERE cn.id = $1
+		`, id))
+		return err
+	})
+	if err != nil {
+		return CreditNote{}, err
+	}
+	return issued, nil
+}
+
+// MarkCreditNoteSent records that a credit note was emailed to the customer
+func (m *DBModel) MarkCreditNoteSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		UPDATE credit_notes SET status = $1, sent_at = $2, updated_at = $2 WHERE id = $3 AND status = $4
+	`, InvoiceSent, time.Now(), id, InvoiceIssued)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetCreditNoteChecksum records the checksum of the pdf of a credit note
+func (m *DBModel) SetCreditNoteChecksum(id int, checksum string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		UPDATE credit_notes SET pdf_checksum = $1, updated_at = $2 WHERE id = $3
+	`, checksum, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetCreditNotesForOrder returns the credit notes of an order, newest first
+func (m *DBModel) GetCreditNotesForOrder(orderID int) ([]*CreditNote, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var notes []*CreditNote
+
+	rows, err := m.DB.QueryContext(ctx, `
+		SELECT `+creditNoteColumns+`
+		FROM credit_notes cn JOIN invoices i ON (cn.invoice_id = i.id)
+		WHERE cn.order_id = $1
+		ORDER BY cn.id DESC
+	`, orderID)
+	if err != nil {
+		return notes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		cn, err := scanCreditNote(rows)
+		if err != nil {
+			return notes, err
+		}
+		notes = append(notes, &cn)
+	}
+	return notes, rows.Err()
+}
@@ -0,0 +1,50 @@
+package models
+
+import (
+	"context"
+	"time"
+)
+
+// DashboardStats sums up sales since a point in time, usually the start of today.
+// Revenue counts every order placed in the period, refunded or not; refunds are
+// counted by when they happened, whenever the order was placed.
+type DashboardStats struct {
+	Since            time.Time `json:"since"`
+	Revenue          int       `json:"revenue"`
+	Orders           int       `json:"orders"`
+	Refunds          int       `json:"refunds"`
+	RefundedAmount   int       `json:"refunded_amount"`
+	NewSubscriptions int       `json:"new_subscriptions"`
+}
+
+// GetDashboardStats sums up orders, refunds and new subscriptions since a time
+func (m *DBModel) GetDashboardStats(since time.Time) (DashboardStats, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	s := DashboardStats{Since: since}
+
+	query := `
+		SELECT
+			coalesce(sum(o.amount) FILTER (WHERE o.created_at >= $1), 0),
+			count(*) FILTER (WHERE o.created_at >= $1 AND NOT i.is_recurring),
+			count(*) FILTER (WHERE o.status_id = $2 AND o.updated_at >= $1),
+			coalesce(sum(o.amount) FILTER (WHERE o.status_id = $2 AND o.updated_at >= $1), 0),
+			count(*) FILTER (WHERE o.created_at >= $1 AND i.is_recurring)
+		FROM orders o
+		JOIN items i ON (o.item_id = i.id)
+		WHERE o.created_at >= $1 OR o.updated_at >= $1
+	`
+
+	err := m.DB.QueryRowContext(ctx, query, since, int(OrderRefunded)).Scan(
+		&s.Revenue,
+		&s.Orders,
+		&s.Refunds,
+		&s.RefundedAmount,
+		&s.NewSubscriptions,
+	)
+	if err != nil {
+		return s, err
+	}
+	return s, nil
+}
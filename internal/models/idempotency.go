@@ -0,0 +1,100 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// IdempotencyKey is the type for stored responses of idempotent requests. A zero
+// StatusCode means the first request with the key is still being processed. Owner is
+// who sent the request, so clients that happen to pick the same key never see each
+// other's responses.
+type IdempotencyKey struct {
+	Key          string    `json:"key"`
+	Route        string    `json:"route"`
+	Owner        string    `json:"owner"`
+	RequestHash  string    `json:"request_hash"`
+	StatusCode   int       `json:"status_code"`
+	ResponseBody []byte    `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+// ReserveIdempotencyKey claims a key for its route and owner. It returns true when the key was not in
+// use and has been reserved for this request; otherwise it returns the stored key so
+// the caller can replay or reject the request.
+func (m *DBModel) ReserveIdempotencyKey(k IdempotencyKey) (IdempotencyKey, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	// drop expired keys so they can be reused
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE expires_at < $1`, time.Now())
+	if err != nil {
+		return k, false, err
+	}
+
+	query := `
+		INSERT INTO idempotency_keys (key, route, owner, request_hash, status_code, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, 0, $5, $6)
+		ON CONFLICT (key, route, owner) DO NOTHING
+		RETURNING key
+	`
+	var key string
+	err = m.DB.QueryRowContext(ctx, query, k.Key, k.Route, k.Owner, k.RequestHash, time.Now(), k.ExpiresAt).Scan(&key)
+	if err == nil {
+		return k, true, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return k, false, err
+	}
+
+	var stored IdempotencyKey
+	row := m.DB.QueryRowContext(ctx, `
+		SELECT key, route, owner, request_hash, status_code, COALESCE(response_body, ''), created_at, expires_at
+		FROM idempotency_keys
+		WHERE key = $1 AND route = $2 AND owner = $3
+	`, k.Key, k.Route, k.Owner)
+	err = row.Scan(
+		&stored.Key,
+		&stored.Route,
+		&stored.Owner,
+		&stored.RequestHash,
+		&stored.StatusCode,
+		&stored.ResponseBody,
+		&stored.CreatedAt,
+		&stored.ExpiresAt,
+	)
+	if err != nil {
+		return k, false, err
+	}
+
+	return stored, false, nil
+}
+
+// SaveIdempotentResponse stores the response for a reserved key so retries can be replayed
+func (m *DBModel) SaveIdempotentResponse(k IdempotencyKey, statusCode int, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE idempotency_keys SET status_code = $1, response_body = $2 WHERE key = $3 AND route = $4 AND owner = $5`
+
+	_, err := m.DB.ExecContext(ctx, stmt, statusCode, body, k.Key, k.Route, k.Owner)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey removes a reserved key, allowing the request to be retried
+func (m *DBModel) ReleaseIdempotencyKey(k IdempotencyKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = $1 AND route = $2 AND owner = $3`,
+		k.Key, k.Route, k.Owner)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Invoice statuses. Credit notes use issued and sent too. A credited invoice has been
+// refunded in full by its credit notes.
+const (
+	InvoiceIssued   = "issued"
+	InvoiceSent     = "sent"
+	InvoiceVoid     = "void"
+	InvoiceCredited = "credited"
+)
+
+// InvoiceNumbering is how invoice numbers look: Prefix-YEAR-000123, with the number
+// padded to Digits. Each prefix counts from 1 again every year.
+type InvoiceNumbering struct {
+	Prefix string
+	Digits int
+}
+
+// Format returns the invoice number for the nth invoice of a year
+func (n InvoiceNumbering) Format(year, number int) string {
+	return fmt.Sprintf("%s-%d-%0*d", n.Prefix, year, n.Digits, number)
+}
+
+// Invoice type for the invoice issued for an order
+type Invoice struct {
+	ID        int        `json:"id"`
+	Number    string     `json:"number"`
+	Year      int        `json:"year"`
+	Sequence  int        `json:"sequence"`
+	OrderID   int        `json:"order_id"`
+	Email     string     `json:"email"`
+	Currency  string     `json:"currency"`
+	Subtotal  int        `json:"subtotal"`
+	Total     int        `json:"total"`
+	Status    string     `json:"status"`
+	IssuedAt  time.Time  `json:"issued_at"`
+	DueAt     time.Time  `json:"due_at"`
+	SentAt    *time.Time `json:"sent_at,omitempty"`
+	Checksum  string     `json:"checksum"` // sha256 of the pdf, empty until it is made
+	Resends   int        `json:"resends"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"-"`
+}
+
+// invoiceColumns are the columns scanned by scanInvoice
+const invoiceColumns = `id, number, year, sequence, order_id, email, currency, subtotal, total, status,
+	issued_at, due_at, sent_at, pdf_checksum, resends, created_at, updated_at`
+
+func scanInvoice(row interface{ Scan(...any) error }) (Invoice, error) {
+	var inv Invoice
+	var sentAt sql.NullTime
+	err := row.Scan(
+		&inv.ID,
+		&inv.Number,
+		&inv.Year,
+		&inv.Sequence,
+		&inv.OrderID,
+		&inv.Email,
+		&inv.Currency,
+		&inv.Subtotal,
+		&inv.Total,
+		&inv.Status,
+		&inv.IssuedAt,
+		&inv.DueAt,
+		&sentAt,
+		&inv.Checksum,
+		&inv.Resends,
+		&inv.CreatedAt,
+		&inv.UpdatedAt,
+	)
+	if err != nil {
+		return inv, err
+	}
+	if sentAt.Valid {
+		inv.SentAt = &sentAt.Time
+	}
+	return inv, nil
+}
+
+// IssueInvoice gives an order its invoice and number, numbered in the year of IssuedAt.
+// An order that already has an invoice that is not void gets that one back instead,
+// so issuing is safe to retry. The number is taken in the same transaction as the
+// invoice is saved, so a failed save does not leave a gap in the numbers.
+func (m *DBModel) IssueInvoice(inv Invoice, n InvoiceNumbering) (Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var issued Invoice
+	err := m.WithTx(ctx, func(tx *DBModel) error {
+		// lock the order so two workers cannot issue it an invoice each
+		_, err := tx.DB.ExecContext(ctx, `SELECT id FROM orders WHERE id = $1 FOR UPDATE`, inv.OrderID)
+		if err != nil {
+			return err
+		}
+
+		issued, err = scanInvoice(tx.DB.QueryRowContext(ctx, `
+			SELECT `+invoiceColumns+` FROM invoices WHERE order_id = $1 AND status <> $2
+		`, inv.OrderID, InvoiceVoid))
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		// the row lock on the counter makes concurrent issuers take turns
+		year := inv.IssuedAt.UTC().Year()
+		var number int
+		err = tx.DB.QueryRowContext(ctx, `
+			INSERT INTO invoice_sequences (prefix, year, last_number) VALUES ($1, $2, 1)
+			ON CONFLICT (prefix, year) DO UPDATE SET last_number = invoice_sequences.last_number + 1
+			RETURNING last_number
+		`, n.Prefix, year).Scan(&number)
+		if err != nil {
+			return err
+		}
+
+		issued, err = scanInvoice(tx.DB.QueryRowContext(ctx, `
+			INSERT INTO invoices
+				(number, year, sequence, order_id, email, currency, subtotal, total, status,
+				issued_at, due_at, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $12)
+			RETURNING `+invoiceColumns,
+			n.Format(year, number),
+			year,
+			number,
+			inv.OrderID,
+			inv.Email,
+			inv.Currency,
+			inv.Subtotal,
+			inv.Total,
+			InvoiceIssued,
+			inv.IssuedAt,
+			inv.DueAt,
+			time.Now(),
+		))
+		return err
+	})
+	if err != nil {
+		return Invoice{}, err
+	}
+	return issued, nil
+}
+
+// MarkInvoiceSent records that an invoice was emailed to the customer
+func (m *DBModel) MarkInvoiceSent(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		UPDATE invoices SET status = $1, sent_at = $2, updated_at = $2 WHERE id = $3 AND status = $4
+	`, InvoiceSent, time.Now(), id, InvoiceIssued)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ClaimInvoiceResend counts a resend of an invoice if it has been resent seen times so
+// far, and reports whether it did. A resend link is made with the count of the time, so
+// once it is used, it and any other link made before it stop working.
+func (m *DBModel) ClaimInvoiceResend(id, seen int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `
+		UPDATE invoices SET resends = resends + 1, updated_at = $1 WHERE id = $2 AND resends = $3
+	`, time.Now(), id, seen)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// SetInvoiceChecksum records the checksum of the pdf of an invoice
+func (m *DBModel) SetInvoiceChecksum(id int, checksum string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		UPDATE invoices SET pdf_checksum = $1, updated_at = $2 WHERE id = $3
+	`, checksum, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetInvoicesForOrder returns every invoice of an order, void ones included, newest first
+func (m *DBModel) GetInvoicesForOrder(orderID int) ([]*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var invoices []*Invoice
+
+	rows, err := m.DB.QueryContext(ctx, `
+		SELECT `+invoiceColumns+` FROM invoices WHERE order_id = $1 ORDER BY id DESC
+	`, orderID)
+	if err != nil {
+		return invoices, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		inv, err := scanInvoice(rows)
+		if err != nil {
+			return invoices, err
+		}
+		invoices = append(invoices, &inv)
+	}
+	return invoices, rows.Err()
+}
+
+// GetInvoiceByNumber returns the invoice with a number
+func (m *DBModel) GetInvoiceByNumber(number string) (Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return scanInvoice(m.DB.QueryRowContext(ctx, `
+		SELECT `+invoiceColumns+` FROM invoices WHERE number = $1
+	`, number))
+}
@@ -0,0 +1,109 @@
+package models
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testNumbering = InvoiceNumbering{Prefix: "INV", Digits: 6}
+
+// issue gives a new order an invoice issued at a time
+func issue(t *testing.T, m *MemoryModel, at time.Time) Invoice {
+	t.Helper()
+
+	orderID, err := m.InsertOrder(Order{StatusID: OrderPaid, Amount: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv, err := m.IssueInvoice(Invoice{OrderID: orderID, Total: 1000, IssuedAt: at}, testNumbering)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inv
+}
+
+func TestInvoiceNumberingYearBoundary(t *testing.T) {
+	m := NewMemoryModel()
+	chicago, err := time.LoadLocation("America/Chicago")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		at   time.Time
+		want string
+	}{
+		{"first of the year", time.Date(2025, 12, 31, 12, 0, 0, 0, time.UTC), "INV-2025-000001"},
+		{"last second of the year", time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC), "INV-2025-000002"},
+		{"first second of the next", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), "INV-2026-000001"},
+		// years are counted in UTC, where this is already the new year
+		{"new year's eve in Chicago", time.Date(2025, 12, 31, 20, 0, 0, 0, chicago), "INV-2026-000002"},
+		{"late invoice for the old year", time.Date(2025, 12, 30, 9, 0, 0, 0, time.UTC), "INV-2025-000003"},
+	}
+	for _, tt := range tests {
+		if got := issue(t, m, tt.at); got.Number != tt.want {
+			t.Errorf("%s: number %s, want %s", tt.name, got.Number, tt.want)
+		}
+	}
+}
+
+func TestInvoiceNumberingConcurrent(t *testing.T) {
+	m := NewMemoryModel()
+	at := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	const n = 50
+	orderIDs := make([]int, n)
+	for i := range orderIDs {
+		id, err := m.InsertOrder(Order{StatusID: OrderPaid, Amount: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+		orderIDs[i] = id
+	}
+
+	// every order is issued twice at once, as two workers picking up the same job would
+	var wg sync.WaitGroup
+	results := make(chan Invoice, 2*n)
+	for _, id := range orderIDs {
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(id int) {
+				defer wg.Done()
+				inv, err := m.IssueInvoice(Invoice{OrderID: id, Total: 1000, IssuedAt: at}, testNumbering)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				results <- inv
+			}(id)
+		}
+	}
+	wg.Wait()
+	close(results)
+
+	byOrder := make(map[int]string)
+	for inv := range results {
+		if number, ok := byOrder[inv.OrderID]; ok && number != inv.Number {
+			t.Errorf("order %d was issued %s and %s", inv.OrderID, number, inv.Number)
+		}
+		byOrder[inv.OrderID] = inv.Number
+	}
+
+	var numbers []string
+	for _, number := range byOrder {
+		numbers = append(numbers, number)
+	}
+	sort.Strings(numbers)
+	if len(numbers) != n {
+		t.Fatalf("%d orders got %d invoices", n, len(numbers))
+	}
+	// unique and without gaps
+	for i, number := range numbers {
+		if want := testNumbering.Format(2026, i+1); number != want {
+			t.Fatalf("invoice numbers %v, want %s to %s", numbers, testNumbering.Format(2026, 1), testNumbering.Format(2026, n))
+		}
+	}
+}
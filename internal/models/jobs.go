@@ -0,0 +1,319 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Job statuses. A failed job has used up its attempts and waits for someone to retry it.
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// JobKindInvoice is a job to create and email the invoice of an order; its payload is an InvoiceJob
+const JobKindInvoice = "invoice"
+
+// DefaultJobAttempts is how many times a job is tried before it is dead-lettered
+const DefaultJobAttempts = 8
+
+// Job type for background work saved in the jobs table, so it survives restarts and
+// outages of whatever does the work
+type Job struct {
+	ID          int             `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	RunAt       time.Time       `json:"run_at"`
+	LockedUntil *time.Time      `json:"locked_until,omitempty"`
+	LastError   string          `json:"last_error"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// NewJob returns a pending job of a kind with its payload encoded as JSON
+func NewJob(kind string, payload any) (Job, error) {
+	out, err := json.Marshal(payload)
+	if err != nil {
+		return Job{}, err
+	}
+	return Job{
+		Kind:        kind,
+		Payload:     out,
+		Status:      JobPending,
+		MaxAttempts: DefaultJobAttempts,
+		RunAt:       time.Now(),
+	}, nil
+}
+
+// JobBackoff is how long to wait before trying a job again after its nth failed
+// attempt: 30 seconds, doubling each time, up to an hour
+func JobBackoff(attempts int) time.Duration {
+	d := 30 * time.Second
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, time.Hour)
+}
+
+// InvoiceJob is what the invoice service needs to create and send the invoice of an order
+type InvoiceJob struct {
+	ID        int              `json:"id"`
+	FirstName string           `json:"first_name"`
+	LastName  string           `json:"last_name"`
+	Email     string           `json:"email"`
+	Amount    int              `json:"amount"`
+	Discount  int              `json:"discount"`
+	Tax       int              `json:"tax"`
+	Currency  string           `json:"currency"`
+	CreatedAt time.Time        `json:"created_at"`
+	Products  []InvoiceProduct `json:"products"`
+}
+
+// InvoiceProduct is one line of an invoice
+type InvoiceProduct struct {
+	Name     string `json:"name"`
+	Amount   int    `json:"amount"`
+	Quantity int    `json:"quantity"`
+}
+
+// NewInvoiceJob returns the invoice job of a saved order paid by a transaction. The
+// lines must carry their item.
+func NewInvoiceJob(order Order, c Customer, txn Transaction, lines []OrderItem) InvoiceJob {
+	inv := InvoiceJob{
+		ID:        order.ID,
+		FirstName: c.FirstName,
+		LastName:  c.LastName,
+		Email:     c.Email,
+		Amount:    txn.Amount,
+		Discount:  order.Discount,
+		Tax:       order.Tax,
+		Currency:  txn.Currency,
+		CreatedAt: time.Now(),
+	}
+	for _, l := range lines {
+		inv.Products = append(inv.Products, InvoiceProduct{Name: l.Item.Name, Amount: l.UnitPrice, Quantity: l.Quantity})
+	}
+	return inv
+}
+
+// EnqueueJob saves a job for a worker to pick up and returns its id
+func (m *DBModel) EnqueueJob(j Job) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if j.MaxAttempts == 0 {
+		j.MaxAttempts = DefaultJobAttempts
+	}
+	if j.RunAt.IsZero() {
+		j.RunAt = time.Now()
+	}
+
+	var id int
+	query := `
+		INSERT INTO jobs (kind, payload, status, max_attempts, run_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+
+	err := m.DB.QueryRowContext(ctx, query,
+		j.Kind,
+		string(j.Payload),
+		JobPending,
+		j.MaxAttempts,
+		j.RunAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// jobColumns are the columns scanned by scanJob
+const jobColumns = `id, kind, payload, status, attempts, max_attempts, run_at, locked_until, last_error, created_at, updated_at`
+
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var j Job
+	var payload []byte
+	var lockedUntil sql.NullTime
+	err := row.Scan(
+		&j.ID,
+		&j.Kind,
+		&payload,
+		&j.Status,
+		&j.Attempts,
+		&j.MaxAttempts,
+		&j.RunAt,
+		&lockedUntil,
+		&j.LastError,
+		&j.CreatedAt,
+		&j.UpdatedAt,
+	)
+	if err != nil {
+		return j, err
+	}
+	j.Payload = payload
+	if lockedUntil.Valid {
+		j.LockedUntil = &lockedUntil.Time
+	}
+	return j, nil
+}
+
+// errJobLeaseExpired is the last error of a job whose worker stopped without finishing
+// its final attempt
+const errJobLeaseExpired = "lease expired before the job finished"
+
+// ClaimJob takes the next due job of a kind and holds it for lease, counting the
+// attempt. Jobs held by a worker that died are taken again once their lease runs
+// out, unless that was their last attempt, when they are marked failed instead, so a
+// job that crashes its worker cannot be retried forever. Concurrent workers skip each
+// other's jobs rather than wait for them. It returns sql.ErrNoRows when there is
+// nothing to do.
+func (m *DBModel) ClaimJob(kind string, lease time.Duration) (Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	_, err := m.DB.ExecContext(ctx, `
+		UPDATE jobs SET status = $1, locked_until = NULL, last_error = $2, updated_at = $3
+		WHERE kind = $4 AND status = $5 AND locked_until < $3 AND attempts >= max_attempts
+	`, JobFailed, errJobLeaseExpired, now, kind, JobRunning)
+	if err != nil {
+		return Job{}, err
+	}
+
+	query := `
+		UPDATE jobs SET status = $1, attempts = attempts + 1, locked_until = $2, updated_at = $3
+		WHERE id = (
+			SELECT id FROM jobs
+			WHERE kind = $4
+				AND ((status = $5 AND run_at <= $3)
+					OR (status = $1 AND locked_until < $3 AND attempts < max_attempts))
+			ORDER BY run_at, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + jobColumns
+
+	return scanJob(m.DB.QueryRowContext(ctx, query, JobRunning, now.Add(lease), now, kind, JobPending))
+}
+
+// ErrJobLeaseLost is returned when a worker finishes a job after its lease ran out and
+// another worker claimed it, so the outcome belongs to the other worker
+var ErrJobLeaseLost = errors.New("job lease lost to another worker")
+
+// CompleteJob marks a claimed job as done, provided the claim j came from still holds
+func (m *DBModel) CompleteJob(j Job) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if j.LockedUntil == nil {
+		return ErrJobLeaseLost
+	}
+	res, err := m.DB.ExecContext(ctx, `
+		UPDATE jobs SET status = $1, locked_until = NULL, last_error = '', updated_at = $2
+		WHERE id = $3 AND status = $4 AND locked_until = $5
+	`, JobDone, time.Now(), j.ID, JobRunning, *j.LockedUntil)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobLeaseLost
+	}
+	return nil
+}
+
+// FailJob records a failed attempt at a claimed job, provided the claim j came from
+// still holds. The job runs again at retryAt, unless it has used up its attempts, when
+// it is marked failed. It returns the new status.
+func (m *DBModel) FailJob(j Job, errMsg string, retryAt time.Time) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if j.LockedUntil == nil {
+		return "", ErrJobLeaseLost
+	}
+	var status string
+	query := `
+		UPDATE jobs SET
+			status = CASE WHEN attempts >= max_attempts THEN $1 ELSE $2 END,
+			run_at = $3, locked_until = NULL, last_error = $4, updated_at = $5
+		WHERE id = $6 AND status = $7 AND locked_until = $8
+		RETURNING status
+	`
+
+	err := m.DB.QueryRowContext(ctx, query, JobFailed, JobPending, retryAt, errMsg, time.Now(), j.ID, JobRunning, *j.LockedUntil).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrJobLeaseLost
+	}
+	if err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+// GetJobs returns the 100 most recently updated jobs with a status, or of any status
+// when it is empty
+func (m *DBModel) GetJobs(status string) ([]*Job, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var jobs []*Job
+
+	rows, err := m.DB.QueryContext(ctx, `
+		SELECT `+jobColumns+`
+		FROM jobs
+		WHERE $1 = '' OR status = $1
+		ORDER BY updated_at DESC, id DESC
+		LIMIT 100
+	`, status)
+	if err != nil {
+		return jobs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, &j)
+	}
+	return jobs, rows.Err()
+}
+
+// RetryJob gives a failed job a fresh set of attempts, starting now. It returns
+// sql.ErrNoRows if there is no failed job with the id.
+func (m *DBModel) RetryJob(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	res, err := m.DB.ExecContext(ctx, `
+		UPDATE jobs SET status = $1, attempts = 0, run_at = $2, updated_at = $2
+		WHERE id = $3 AND status = $4
+	`, JobPending, time.Now(), id, JobFailed)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,1479 @@
+package models
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MemoryModel is a thread-safe in-memory Repository for tests and local development.
+// Lookups that find nothing return sql.ErrNoRows, like DBModel does.
+type MemoryModel struct {
+	mu              sync.RWMutex
+	seq             map[string]int
+	items           map[int]Item
+	customers       map[int]Customer
+	transactions    map[int]Transaction
+	orders          map[int]Order
+	orderItems      map[int][]OrderItem
+	users           map[int]User
+	tokens          []memoryToken
+	twoFactor       map[int]TwoFactor
+	recoveryCodes   map[int][][]byte
+	loginAttempts   map[ThrottleKey]LoginAttempt
+	carts           map[string]Cart
+	coupons         map[string]Coupon
+	webhookEvents   map[string]WebhookEvent
+	idempotencyKeys map[string]IdempotencyKey
+	reconciliations map[int]Reconciliation
+	jobs            map[int]Job
+	invoices        map[int]Invoice
+	invoiceSeq      map[string]int
+	creditNotes     map[int]CreditNote
+	refunds         map[int]Refund
+	statusHistory   map[int]OrderStatusHistory
+}
+
+type memoryToken struct {
+	Token
+	userID int
+}
+
+// active reports whether the token is unrevoked and, unless it never expires, unexpired
+func (t memoryToken) active(now time.Time) bool {
+	return t.RevokedAt == nil && (t.Expiry.IsZero() || t.Expiry.After(now))
+}
+
+// NewMemoryModel returns an empty in-memory repository
+func NewMemoryModel() *MemoryModel {
+	return &MemoryModel{
+		seq:             make(map[string]int),
+		items:           make(map[int]Item),
+		customers:       make(map[int]Customer),
+		transactions:    make(map[int]Transaction),
+		orders:          make(map[int]Order),
+		orderItems:      make(map[int][]OrderItem),
+		users:           make(map[int]User),
+		twoFactor:       make(map[int]TwoFactor),
+		recoveryCodes:   make(map[int][][]byte),
+		loginAttempts:   make(map[ThrottleKey]LoginAttempt),
+		carts:           make(map[string]Cart),
+		coupons:         make(map[string]Coupon),
+		webhookEvents:   make(map[string]WebhookEvent),
+		idempotencyKeys: make(map[string]IdempotencyKey),
+		reconciliations: make(map[int]Reconciliation),
+		jobs:            make(map[int]Job),
+		invoices:        make(map[int]Invoice),
+		invoiceSeq:      make(map[string]int),
+		creditNotes:     make(map[int]CreditNote),
+		refunds:         make(map[int]Refund),
+		statusHistory:   make(map[int]OrderStatusHistory),
+	}
+}
+
+// nextID returns the next id for a table; the caller must hold the write lock
+func (m *MemoryModel) nextID(table string) int {
+	m.seq[table]++
+	return m.seq[table]
+}
+
+// AddItem adds an item to the catalogue and returns its id. A zero ID is assigned.
+func (m *MemoryModel) AddItem(i Item) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if i.ID == 0 {
+		i.ID = m.nextID("items")
+	} else if i.ID > m.seq["items"] {
+		m.seq["items"] = i.ID
+	}
+	i.CreatedAt, i.UpdatedAt = time.Now(), time.Now()
+	m.items[i.ID] = i
+	return i.ID
+}
+
+// AddCoupon adds a coupon and returns its id
+func (m *MemoryModel) AddCoupon(c Coupon) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c.ID = m.nextID("coupons")
+	c.Code = strings.ToUpper(strings.TrimSpace(c.Code))
+	c.CreatedAt, c.UpdatedAt = time.Now(), time.Now()
+	m.coupons[c.Code] = c
+	return c.ID
+}
+
+func (m *MemoryModel) GetItem(id int) (Item, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	i, ok := m.items[id]
+	if !ok {
+		return Item{}, sql.ErrNoRows
+	}
+	return i, nil
+}
+
+func (m *MemoryModel) InsertCustomer(c Customer) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insertCustomer(c), nil
+}
+
+func (m *MemoryModel) insertCustomer(c Customer) int {
+	c.ID = m.nextID("customers")
+	c.CreatedAt, c.UpdatedAt = time.Now(), time.Now()
+	m.customers[c.ID] = c
+	return c.ID
+}
+
+func (m *MemoryModel) InsertTransaction(txn Transaction) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insertTransaction(txn)
+}
+
+func (m *MemoryModel) insertTransaction(txn Transaction) (int, error) {
+	for _, t := range m.transactions {
+		if txn.PaymentIntent != "" && t.PaymentIntent == txn.PaymentIntent {
+			return 0, ErrPaymentIntentUsed
+		}
+	}
+	txn.ID = m.nextID("transactions")
+	txn.CreatedAt, txn.UpdatedAt = time.Now(), time.Now()
+	m.transactions[txn.ID] = txn
+	return txn.ID, nil
+}
+
+func (m *MemoryModel) UpdateTransactionStatusByPaymentIntent(pi string, statusID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, t := range m.transactions {
+		if t.PaymentIntent == pi {
+			t.TransactionStatusID = statusID
+			t.UpdatedAt = time.Now()
+			m.transactions[id] = t
+		}
+	}
+	return nil
+}
+
+func (m *MemoryModel) InsertOrder(order Order) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order.ID = m.nextID("orders")
+	order.CreatedAt, order.UpdatedAt = time.Now(), time.Now()
+	m.orders[order.ID] = order
+	return order.ID, nil
+}
+
+func (m *MemoryModel) InsertOrderWithItems(order Order, items []OrderItem) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.insertOrderWithItems(order, items)
+}
+
+func (m *MemoryModel) insertOrderWithItems(order Order, items []OrderItem) (int, error) {
+	if len(items) == 0 {
+		return 0, errors.New("an order needs at least one item")
+	}
+	for _, i := range items {
+		if _, ok := m.items[i.ItemID]; !ok {
+			return 0, fmt.Errorf("item %d does not exist", i.ItemID)
+		}
+	}
+
+	order.ID = m.nextID("orders")
+	order.ItemID = items[0].ItemID
+	order.Quantity = 0
+	for _, i := range items {
+		order.Quantity += i.Quantity
+	}
+	order.CreatedAt, order.UpdatedAt = time.Now(), time.Now()
+	order.Items = nil
+	m.orders[order.ID] = order
+
+	lines := make([]OrderItem, len(items))
+	for n, i := range items {
+		i.ID = m.nextID("order_items")
+		i.OrderID = order.ID
+		i.CreatedAt, i.UpdatedAt = time.Now(), time.Now()
+		lines[n] = i
+	}
+	m.orderItems[order.ID] = lines
+
+	return order.ID, nil
+}
+
+// SaveCheckout saves the customer, transaction and order and queues the invoice under
+// one lock, so a failed order leaves nothing behind
+func (m *MemoryModel) SaveCheckout(c Customer, txn Transaction, order Order, items []OrderItem) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(items) == 0 {
+		return 0, errors.New("an order needs at least one item")
+	}
+	for _, i := range items {
+		if _, ok := m.items[i.ItemID]; !ok {
+			return 0, fmt.Errorf("item %d does not exist", i.ItemID)
+		}
+	}
+
+	txnID, err := m.insertTransaction(txn)
+	if err != nil {
+		return 0, err
+	}
+	order.CustomerID = m.insertCustomer(c)
+	order.TransactionID = txnID
+	id, err := m.insertOrderWithItems(order, items)
+	if err != nil {
+		return 0, err
+	}
+
+	order.ID = id
+	job, err := NewJob(JobKindInvoice, NewInvoiceJob(order, c, txn, items))
+	if err != nil {
+		return 0, err
+	}
+	m.enqueueJob(job)
+	return id, nil
+}
+
+func (m *MemoryModel) GetOrderItems(orderIDs ...int) (map[int][]OrderItem, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	lines := make(map[int][]OrderItem)
+	for _, id := range orderIDs {
+		for _, l := range m.orderItems[id] {
+			l.Item = m.items[l.ItemID]
+			lines[id] = append(lines[id], l)
+		}
+	}
+	return lines, nil
+}
+
+// joinOrder fills in the item, transaction, customer and lines of an order the way
+// the order queries of DBModel do; the caller must hold the lock
+func (m *MemoryModel) joinOrder(o Order) *Order {
+	o.Item = m.items[o.ItemID]
+	o.Transaction = m.transactions[o.TransactionID]
+	o.Customer = m.customers[o.CustomerID]
+
+	o.Items = nil
+	for _, l := range m.orderItems[o.ID] {
+		l.Item = m.items[l.ItemID]
+		o.Items = append(o.Items, l)
+	}
+	if len(o.Items) == 0 {
+		o.Items = []OrderItem{{
+			OrderID:   o.ID,
+			ItemID:    o.ItemID,
+			Quantity:  o.Quantity,
+			UnitPrice: o.Amount / max(o.Quantity, 1),
+			LineTotal: o.Amount,
+			Item:      o.Item,
+		}}
+	}
+	return &o
+}
+
+// ordersByRecurring returns joined orders for one time or recurring items, newest
+// first; the caller must hold the lock
+func (m *MemoryModel) ordersByRecurring(recurring bool) []*Order {
+	var orders []*Order
+	for _, o := range m.orders {
+		if m.items[o.ItemID].IsRecurring == recurring {
+			orders = append(orders, m.joinOrder(o))
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if orders[i].CreatedAt.Equal(orders[j].CreatedAt) {
+			return orders[i].ID > orders[j].ID
+		}
+		return orders[i].CreatedAt.After(orders[j].CreatedAt)
+	})
+	return orders
+}
+
+func (m *MemoryModel) GetAllOrders(recurring bool) ([]*Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ordersByRecurring(recurring), nil
+}
+
+func (m *MemoryModel) GetAllOrdersPaginated(recurring bool, pageSize, page int) ([]*Order, int, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	all := m.ordersByRecurring(recurring)
+	totalRecords := len(all)
+
+	offset := min(max((page-1)*pageSize, 0), totalRecords)
+	end := min(offset+pageSize, totalRecords)
+	lastPage := totalRecords / pageSize
+
+	return all[offset:end], lastPage, totalRecords, nil
+}
+
+func (m *MemoryModel) GetOrderByID(id int) (Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	o, ok := m.orders[id]
+	if !ok {
+		return Order{}, sql.ErrNoRows
+	}
+	return *m.joinOrder(o), nil
+}
+
+func (m *MemoryModel) UpdateOrderStatus(id int, to OrderStatus, c StatusChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.moveOrder(id, to, c)
+}
+
+func (m *MemoryModel) UpdateOrderStatusByPaymentIntent(pi string, to OrderStatus, c StatusChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for id, o := range m.orders {
+		if m.transactions[o.TransactionID].PaymentIntent == pi {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	var invalid error
+	for _, id := range ids {
+		err := m.moveOrder(id, to, c)
+		if err != nil {
+			invalid = fmt.Errorf("order %d: %w", id, err)
+		}
+	}
+	return invalid
+}
+
+// moveOrder is DBModel.moveOrder; the caller must hold the lock
+func (m *MemoryModel) moveOrder(id int, to OrderStatus, c StatusChange) error {
+	o, ok := m.orders[id]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	record, err := checkTransition(o.StatusID, to)
+	if err != nil || !record {
+		return err
+	}
+	m.recordMove(o, to, c)
+	return nil
+}
+
+// recordMove is DBModel.recordMove; the caller must hold the lock
+func (m *MemoryModel) recordMove(o Order, to OrderStatus, c StatusChange) {
+	id := o.ID
+	h := OrderStatusHistory{
+		ID:         m.nextID("order_status_history"),
+		OrderID:    id,
+		FromStatus: o.StatusID,
+		ToStatus:   to,
+		UserID:     c.UserID,
+		Reason:     c.Reason,
+		CreatedAt:  time.Now(),
+	}
+	m.statusHistory[h.ID] = h
+
+	o.StatusID = to
+	o.UpdatedAt = time.Now()
+	m.orders[id] = o
+}
+
+func (m *MemoryModel) RestoreDisputedOrdersByPaymentIntent(pi string, c StatusChange) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for id, o := range m.orders {
+		if o.StatusID == OrderDisputed && m.transactions[o.TransactionID].PaymentIntent == pi {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		before, last := OrderPaid, 0
+		for _, h := range m.statusHistory {
+			if h.OrderID == id && h.ToStatus == OrderDisputed && h.ID > last {
+				before, last = h.FromStatus, h.ID
+			}
+		}
+		m.recordMove(m.orders[id], before, c)
+	}
+	return nil
+}
+
+func (m *MemoryModel) GetOrderStatusHistory(orderID int) ([]*OrderStatusHistory, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var history []*OrderStatusHistory
+	for _, h := range m.statusHistory {
+		if h.OrderID == orderID {
+			h := h
+			h.From, h.To = h.FromStatus.String(), h.ToStatus.String()
+			if u, ok := m.users[h.UserID]; ok {
+				h.UserName = u.FirstName + " " + u.LastName
+			}
+			history = append(history, &h)
+		}
+	}
+	sort.Slice(history, func(i, j int) bool { return history[i].ID < history[j].ID })
+	return history, nil
+}
+
+func (m *MemoryModel) SaveRefund(r Refund) (OrderStatus, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	o, ok := m.orders[r.OrderID]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+
+	inserted := !m.hasRefund(r.StripeRefundID)
+	refunded := m.refundedAmount(r.OrderID)
+	if inserted {
+		refunded += r.Amount
+	}
+
+	status := OrderPartiallyRefunded
+	if refunded >= m.transactions[o.TransactionID].Amount {
+		status = OrderRefunded
+	}
+	if !inserted {
+		return status, nil
+	}
+	err := m.moveOrder(o.ID, status, refundStatusChange(r))
+	if err != nil {
+		return 0, err
+	}
+	m.insertRefund(r)
+	return status, nil
+}
+
+func (m *MemoryModel) SaveGatewayRefunds(pi string, refunded int, refunds []Refund, txnStatusID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var ids []int
+	for id, o := range m.orders {
+		if m.transactions[o.TransactionID].PaymentIntent == pi {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	sort.Ints(ids)
+	o := m.orders[ids[0]]
+	t := m.transactions[o.TransactionID]
+
+	recorded := m.refundedAmount(o.ID)
+	var saved []Refund
+	for _, r := range refunds {
+		if m.hasRefund(r.StripeRefundID) {
+			continue
+		}
+		r.OrderID, r.TransactionID = o.ID, t.ID
+		recorded += r.Amount
+		saved = append(saved, r)
+	}
+	if recorded < refunded {
+		r := unlistedRefund(o.ID, t.ID, refunded-recorded, t.Currency)
+		recorded += r.Amount
+		saved = append(saved, r)
+	}
+	if len(saved) == 0 {
+		return nil
+	}
+
+	// check every move before making any, as the database transaction would
+	status := OrderPartiallyRefunded
+	if recorded >= t.Amount {
+		status = OrderRefunded
+	}
+	if _, err := checkTransition(o.StatusID, status); err != nil {
+		return err
+	}
+	for _, r := range saved {
+		if err := m.moveOrder(o.ID, status, refundStatusChange(r)); err != nil {
+			return err
+		}
+		m.insertRefund(r)
+	}
+	if status == OrderRefunded {
+		t.TransactionStatusID = txnStatusID
+		t.UpdatedAt = time.Now()
+		m.transactions[t.ID] = t
+	}
+	return nil
+}
+
+// hasRefund reports whether a refund with a Stripe id is recorded; the caller must
+// hold the lock
+func (m *MemoryModel) hasRefund(stripeRefundID string) bool {
+	if stripeRefundID == "" {
+		return false
+	}
+	for _, r := range m.refunds {
+		if r.StripeRefundID == stripeRefundID {
+			return true
+		}
+	}
+	return false
+}
+
+// refundedAmount is DBModel.refundedAmount; the caller must hold the lock
+func (m *MemoryModel) refundedAmount(orderID int) int {
+	var refunded int
+	for _, r := range m.refunds {
+		if r.OrderID == orderID {
+			refunded += r.Amount
+		}
+	}
+	return refunded
+}
+
+// insertRefund adds a refund; the caller must hold the lock
+func (m *MemoryModel) insertRefund(r Refund) {
+	r.ID = m.nextID("refunds")
+	r.CreatedAt, r.UpdatedAt = time.Now(), time.Now()
+	m.refunds[r.ID] = r
+}
+
+func (m *MemoryModel) GetRefundsForOrder(orderID int) ([]*Refund, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var refunds []*Refund
+	for _, r := range m.refunds {
+		if r.OrderID == orderID {
+			r := r
+			if u, ok := m.users[r.UserID]; ok {
+				r.UserName = u.FirstName + " " + u.LastName
+			}
+			refunds = append(refunds, &r)
+		}
+	}
+	sort.Slice(refunds, func(i, j int) bool { return refunds[i].ID > refunds[j].ID })
+	return refunds, nil
+}
+
+func (m *MemoryModel) GetDashboardStats(since time.Time) (DashboardStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	s := DashboardStats{Since: since}
+	for _, o := range m.orders {
+		if !o.CreatedAt.Before(since) {
+			s.Revenue += o.Amount
+			if m.items[o.ItemID].IsRecurring {
+				s.NewSubscriptions++
+			} else {
+				s.Orders++
+			}
+		}
+		if o.StatusID == OrderRefunded && !o.UpdatedAt.Before(since) {
+			s.Refunds++
+			s.RefundedAmount += o.Amount
+		}
+	}
+	return s, nil
+}
+
+func (m *MemoryModel) GetUserByEmail(email string) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	email = strings.ToLower(email)
+	for _, u := range m.users {
+		if u.Email == email {
+			return u, nil
+		}
+	}
+	return User{}, sql.ErrNoRows
+}
+
+func (m *MemoryModel) Authenticate(email, password string) (int, error) {
+	u, err := m.GetUserByEmail(email)
+	if err != nil {
+		return 0, err
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return 0, errors.New("incorrect password")
+	} else if err != nil {
+		return 0, err
+	}
+	return u.ID, nil
+}
+
+func (m *MemoryModel) UpdatePasswordForUser(u User, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.users[u.ID]; ok {
+		stored.Password = hash
+		m.users[u.ID] = stored
+	}
+	return nil
+}
+
+func (m *MemoryModel) GetAllUsers() ([]*User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var users []*User
+	for _, u := range m.users {
+		u.Password = ""
+		if a, ok := m.loginAttempts[AccountKey(u.Email)]; ok && a.LockedUntil != nil && a.LockedUntil.After(time.Now()) {
+			until := *a.LockedUntil
+			u.LockedUntil = &until
+		}
+		u := u
+		users = append(users, &u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].LastName == users[j].LastName {
+			return users[i].FirstName < users[j].FirstName
+		}
+		return users[i].LastName < users[j].LastName
+	})
+	return users, nil
+}
+
+func (m *MemoryModel) GetOneUser(id int) (User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[id]
+	if !ok {
+		return User{}, sql.ErrNoRows
+	}
+	u.Password = ""
+	return u, nil
+}
+
+func (m *MemoryModel) EditUser(u User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stored, ok := m.users[u.ID]
+	if !ok {
+		return nil
+	}
+	if err := m.checkEmailFree(u.Email, u.ID); err != nil {
+		return err
+	}
+	if u.Role != RoleOwner {
+		if err := m.keepAnOwner(u.ID); err != nil {
+			return err
+		}
+	}
+	stored.FirstName = u.FirstName
+	stored.LastName = u.LastName
+	stored.Email = u.Email
+	stored.Role = u.Role
+	stored.UpdatedAt = time.Now()
+	m.users[u.ID] = stored
+	return nil
+}
+
+func (m *MemoryModel) AddUser(u User, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.checkEmailFree(u.Email, 0); err != nil {
+		return err
+	}
+	u.ID = m.nextID("users")
+	u.Password = hash
+	u.CreatedAt, u.UpdatedAt = time.Now(), time.Now()
+	m.users[u.ID] = u
+	return nil
+}
+
+// checkEmailFree enforces the unique email of the users table; the caller must hold the lock
+func (m *MemoryModel) checkEmailFree(email string, exceptID int) error {
+	for _, u := range m.users {
+		if u.ID != exceptID && u.Email == email {
+			return fmt.Errorf("a user with email %s already exists", email)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryModel) DeleteUser(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.keepAnOwner(id); err != nil {
+		return err
+	}
+	delete(m.users, id)
+	delete(m.twoFactor, id)
+	delete(m.recoveryCodes, id)
+	m.deleteTokensFor(id)
+	return nil
+}
+
+// keepAnOwner returns ErrLastOwner if id is the only owner; the caller must hold the lock
+func (m *MemoryModel) keepAnOwner(id int) error {
+	for _, u := range m.users {
+		if u.Role == RoleOwner && u.ID != id {
+			return nil
+		}
+	}
+	if m.users[id].Role == RoleOwner {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+// deleteTokensFor removes every token of a user; the caller must hold the write lock
+func (m *MemoryModel) deleteTokensFor(userID int) {
+	kept := m.tokens[:0]
+	for _, t := range m.tokens {
+		if t.userID != userID {
+			kept = append(kept, t)
+		}
+	}
+	m.tokens = kept
+}
+
+func (m *MemoryModel) InsertToken(t *Token, u User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t.ID = m.nextID("tokens")
+	t.CreatedAt = time.Now()
+	if t.Scope == "" {
+		t.Scope = ScopeAuthentication
+	}
+	stored := *t
+	stored.PlainText = ""
+	stored.Scopes = append([]string(nil), t.Scopes...)
+	stored.Hash = append([]byte(nil), t.Hash...)
+	m.tokens = append(m.tokens, memoryToken{Token: stored, userID: u.ID})
+	return nil
+}
+
+func (m *MemoryModel) GetUserForToken(token string) (*User, *Token, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	hash := sha256.Sum256([]byte(token))
+	for i, t := range m.tokens {
+		if bytes.Equal(t.Hash, hash[:]) && t.active(now) {
+			u, ok := m.users[t.userID]
+			if !ok {
+				break
+			}
+			m.tokens[i].LastUsedAt = &now
+			tok := m.tokens[i].Token
+			tok.Hash = nil
+			tok.Scopes = append([]string(nil), tok.Scopes...)
+			tok.UserID = int64(u.ID)
+			return &User{ID: u.ID, FirstName: u.FirstName, LastName: u.LastName, Email: u.Email, Role: u.Role}, &tok, nil
+		}
+	}
+	return nil, nil, sql.ErrNoRows
+}
+
+func (m *MemoryModel) GetTokensForUser(userID int) ([]*Token, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var tokens []*Token
+	for _, t := range m.tokens {
+		if t.userID == userID && t.active(time.Now()) {
+			tok := t.Token
+			tok.Hash = nil
+			tok.Scopes = append([]string(nil), tok.Scopes...)
+			tok.UserID = int64(userID)
+			tokens = append(tokens, &tok)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID > tokens[j].ID })
+	return tokens, nil
+}
+
+func (m *MemoryModel) RevokeToken(userID, tokenID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, t := range m.tokens {
+		if t.ID == tokenID && t.userID == userID && t.RevokedAt == nil {
+			now := time.Now()
+			m.tokens[i].RevokedAt = &now
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func (m *MemoryModel) RevokeAllTokens(userID int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	n := 0
+	for i, t := range m.tokens {
+		if t.userID == userID && t.RevokedAt == nil {
+			m.tokens[i].RevokedAt = &now
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MemoryModel) GetTwoFactor(userID int) (TwoFactor, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	u, ok := m.users[userID]
+	if !ok {
+		return TwoFactor{}, sql.ErrNoRows
+	}
+	tf := m.twoFactor[userID]
+	tf.UserID = userID
+	tf.Enabled = u.TwoFactorEnabled
+	return tf, nil
+}
+
+func (m *MemoryModel) SetTwoFactorSecret(userID int, secret string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.twoFactor[userID] = TwoFactor{UserID: userID, Secret: secret}
+	m.setTwoFactorEnabled(userID, false)
+	return nil
+}
+
+func (m *MemoryModel) EnableTwoFactor(userID int, recoveryHashes [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.setTwoFactorEnabled(userID, true)
+	m.recoveryCodes[userID] = append([][]byte(nil), recoveryHashes...)
+	return nil
+}
+
+func (m *MemoryModel) ReplaceRecoveryCodes(userID int, recoveryHashes [][]byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.recoveryCodes[userID] = append([][]byte(nil), recoveryHashes...)
+	return nil
+}
+
+func (m *MemoryModel) UseTOTPCounter(userID int, counter int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tf := m.twoFactor[userID]
+	if counter <= tf.LastCounter {
+		return false, nil
+	}
+	tf.LastCounter = counter
+	m.twoFactor[userID] = tf
+	return true, nil
+}
+
+func (m *MemoryModel) UseRecoveryCode(userID int, hash []byte) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes := m.recoveryCodes[userID]
+	for i, c := range codes {
+		if bytes.Equal(c, hash) {
+			m.recoveryCodes[userID] = append(codes[:i:i], codes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MemoryModel) ResetTwoFactor(userID int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.twoFactor, userID)
+	delete(m.recoveryCodes, userID)
+	m.setTwoFactorEnabled(userID, false)
+	return nil
+}
+
+// setTwoFactorEnabled updates the flag on the stored user; the caller must hold the write lock
+func (m *MemoryModel) setTwoFactorEnabled(userID int, enabled bool) {
+	if u, ok := m.users[userID]; ok {
+		u.TwoFactorEnabled = enabled
+		m.users[userID] = u
+	}
+}
+
+func (m *MemoryModel) LockedUntil(keys ...ThrottleKey) (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var until time.Time
+	for _, k := range keys {
+		a, ok := m.loginAttempts[k]
+		if ok && a.LockedUntil != nil && a.LockedUntil.After(until) && a.LockedUntil.After(time.Now()) {
+			until = *a.LockedUntil
+		}
+	}
+	return until, nil
+}
+
+func (m *MemoryModel) RecordFailure(key ThrottleKey, p LockoutPolicy) (LoginAttempt, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	a, ok := m.loginAttempts[key]
+	if !ok {
+		a = LoginAttempt{ThrottleKey: key, LastFailureAt: time.Now()}
+	}
+	a = p.fail(a, time.Now())
+	m.loginAttempts[key] = a
+	return a, nil
+}
+
+func (m *MemoryModel) ClearFailures(key ThrottleKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.loginAttempts, key)
+	return nil
+}
+
+func (m *MemoryModel) SaveCart(c Cart) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if stored, ok := m.carts[c.Token]; ok {
+		c.CreatedAt = stored.CreatedAt
+	} else {
+		c.CreatedAt = time.Now()
+	}
+	c.UpdatedAt = time.Now()
+	c.Lines = append([]CartLine(nil), c.Lines...)
+	m.carts[c.Token] = c
+	return nil
+}
+
+func (m *MemoryModel) GetCart(token string) (Cart, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c, ok := m.carts[token]
+	if !ok {
+		return Cart{}, sql.ErrNoRows
+	}
+	c.Lines = append([]CartLine(nil), c.Lines...)
+	return c, nil
+}
+
+func (m *MemoryModel) DeleteCart(token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.carts, token)
+	return nil
+}
+
+func (m *MemoryModel) GetCouponByCode(code string) (Coupon, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	c, ok := m.coupons[strings.ToUpper(strings.TrimSpace(code))]
+	if !ok || !c.Active || (c.ExpiresAt != nil && !c.ExpiresAt.After(time.Now())) {
+		return Coupon{}, sql.ErrNoRows
+	}
+	return c, nil
+}
+
+func (m *MemoryModel) OrderItemsForCart(c Cart) ([]OrderItem, error) {
+	return orderItemsForCart(m, c)
+}
+
+func (m *MemoryModel) QuoteForLines(cartLines []CartLine, couponCode string, taxBasisPoints int) (Quote, error) {
+	return quoteForLines(m, cartLines, couponCode, taxBasisPoints)
+}
+
+func (m *MemoryModel) InsertWebhookEvent(e WebhookEvent) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if stored, ok := m.webhookEvents[e.EventID]; ok {
+		if stored.ProcessedAt != nil && stored.Error == "" {
+			return false, nil
+		}
+		if stored.ProcessedAt == nil && stored.ClaimedAt.After(now.Add(-WebhookLease)) {
+			return false, ErrWebhookEventClaimed
+		}
+		stored.ProcessedAt = nil
+		stored.Error = ""
+		stored.ClaimedAt = now
+		m.webhookEvents[e.EventID] = stored
+		return true, nil
+	}
+
+	e.ID = m.nextID("webhook_events")
+	e.ProcessedAt = nil
+	e.ClaimedAt = now
+	e.CreatedAt = now
+	m.webhookEvents[e.EventID] = e
+	return true, nil
+}
+
+func (m *MemoryModel) MarkWebhookEventProcessed(eventID, errMsg string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.webhookEvents[eventID]; ok {
+		now := time.Now()
+		e.ProcessedAt = &now
+		e.Error = errMsg
+		m.webhookEvents[eventID] = e
+	}
+	return nil
+}
+
+func idempotencyMapKey(k IdempotencyKey) string {
+	return k.Route + "\x00" + k.Owner + "\x00" + k.Key
+}
+
+func (m *MemoryModel) ReserveIdempotencyKey(k IdempotencyKey) (IdempotencyKey, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, stored := range m.idempotencyKeys {
+		if stored.ExpiresAt.Before(time.Now()) {
+			delete(m.idempotencyKeys, id)
+		}
+	}
+
+	id := idempotencyMapKey(k)
+	if stored, ok := m.idempotencyKeys[id]; ok {
+		return stored, false, nil
+	}
+
+	k.StatusCode = 0
+	k.ResponseBody = nil
+	k.CreatedAt = time.Now()
+	m.idempotencyKeys[id] = k
+	return k, true, nil
+}
+
+func (m *MemoryModel) SaveIdempotentResponse(k IdempotencyKey, statusCode int, body []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := idempotencyMapKey(k)
+	if stored, ok := m.idempotencyKeys[id]; ok {
+		stored.StatusCode = statusCode
+		stored.ResponseBody = append([]byte(nil), body...)
+		m.idempotencyKeys[id] = stored
+	}
+	return nil
+}
+
+func (m *MemoryModel) ReleaseIdempotencyKey(k IdempotencyKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.idempotencyKeys, idempotencyMapKey(k))
+	return nil
+}
+
+func (m *MemoryModel) InsertReconciliation(r Reconciliation) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r.ID = m.nextID("reconciliations")
+	r.ResolvedAt = nil
+	r.CreatedAt, r.UpdatedAt = time.Now(), time.Now()
+	m.reconciliations[r.ID] = r
+	return r.ID, nil
+}
+
+func (m *MemoryModel) GetUnresolvedReconciliations() ([]*Reconciliation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var recs []*Reconciliation
+	for _, r := range m.reconciliations {
+		if r.ResolvedAt == nil {
+			r := r
+			recs = append(recs, &r)
+		}
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].ID < recs[j].ID })
+	return recs, nil
+}
+
+func (m *MemoryModel) ResolveReconciliation(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r, ok := m.reconciliations[id]; ok {
+		now := time.Now()
+		r.ResolvedAt = &now
+		r.UpdatedAt = now
+		m.reconciliations[id] = r
+	}
+	return nil
+}
+
+func (m *MemoryModel) EnqueueJob(j Job) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.enqueueJob(j), nil
+}
+
+// enqueueJob saves a pending job; the caller must hold the write lock
+func (m *MemoryModel) enqueueJob(j Job) int {
+	j.ID = m.nextID("jobs")
+	j.Status = JobPending
+	j.Attempts = 0
+	if j.MaxAttempts == 0 {
+		j.MaxAttempts = DefaultJobAttempts
+	}
+	if j.RunAt.IsZero() {
+		j.RunAt = time.Now()
+	}
+	j.LockedUntil = nil
+	j.CreatedAt, j.UpdatedAt = time.Now(), time.Now()
+	m.jobs[j.ID] = j
+	return j.ID
+}
+
+func (m *MemoryModel) ClaimJob(kind string, lease time.Duration) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	var next *Job
+	for _, j := range m.jobs {
+		if j.Kind != kind {
+			continue
+		}
+		expired := j.Status == JobRunning && j.LockedUntil != nil && j.LockedUntil.Before(now)
+		if expired && j.Attempts >= j.MaxAttempts {
+			j.Status = JobFailed
+			j.LockedUntil = nil
+			j.LastError = errJobLeaseExpired
+			j.UpdatedAt = now
+			m.jobs[j.ID] = j
+			continue
+		}
+		if !expired && !(j.Status == JobPending && !j.RunAt.After(now)) {
+			continue
+		}
+		if next == nil || j.RunAt.Before(next.RunAt) || (j.RunAt.Equal(next.RunAt) && j.ID < next.ID) {
+			j := j
+			next = &j
+		}
+	}
+	if next == nil {
+		return Job{}, sql.ErrNoRows
+	}
+
+	lockedUntil := now.Add(lease)
+	next.Status = JobRunning
+	next.Attempts++
+	next.LockedUntil = &lockedUntil
+	next.UpdatedAt = now
+	m.jobs[next.ID] = *next
+	return *next, nil
+}
+
+func (m *MemoryModel) CompleteJob(claim Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.leasedJob(claim)
+	if !ok {
+		return ErrJobLeaseLost
+	}
+	j.Status = JobDone
+	j.LockedUntil = nil
+	j.LastError = ""
+	j.UpdatedAt = time.Now()
+	m.jobs[j.ID] = j
+	return nil
+}
+
+func (m *MemoryModel) FailJob(claim Job, errMsg string, retryAt time.Time) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.leasedJob(claim)
+	if !ok {
+		return "", ErrJobLeaseLost
+	}
+	j.Status = JobPending
+	if j.Attempts >= j.MaxAttempts {
+		j.Status = JobFailed
+	}
+	j.RunAt = retryAt
+	j.LockedUntil = nil
+	j.LastError = errMsg
+	j.UpdatedAt = time.Now()
+	m.jobs[j.ID] = j
+	return j.Status, nil
+}
+
+// leasedJob returns the stored job if the claim it was handed out with still holds;
+// the caller must hold the write lock
+func (m *MemoryModel) leasedJob(claim Job) (Job, bool) {
+	j, ok := m.jobs[claim.ID]
+	if !ok || j.Status != JobRunning || j.LockedUntil == nil || claim.LockedUntil == nil || !j.LockedUntil.Equal(*claim.LockedUntil) {
+		return Job{}, false
+	}
+	return j, true
+}
+
+func (m *MemoryModel) GetJobs(status string) ([]*Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var jobs []*Job
+	for _, j := range m.jobs {
+		if status == "" || j.Status == status {
+			j := j
+			jobs = append(jobs, &j)
+		}
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		if jobs[i].UpdatedAt.Equal(jobs[k].UpdatedAt) {
+			return jobs[i].ID > jobs[k].ID
+		}
+		return jobs[i].UpdatedAt.After(jobs[k].UpdatedAt)
+	})
+	return jobs[:min(len(jobs), 100)], nil
+}
+
+func (m *MemoryModel) RetryJob(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j, ok := m.jobs[id]
+	if !ok || j.Status != JobFailed {
+		return sql.ErrNoRows
+	}
+	j.Status = JobPending
+	j.Attempts = 0
+	j.RunAt = time.Now()
+	j.UpdatedAt = time.Now()
+	m.jobs[id] = j
+	return nil
+}
+
+func (m *MemoryModel) IssueInvoice(inv Invoice, n InvoiceNumbering) (Invoice, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.orders[inv.OrderID]; !ok {
+		return Invoice{}, fmt.Errorf("order %d does not exist", inv.OrderID)
+	}
+	for _, existing := range m.invoices {
+		if existing.OrderID == inv.OrderID && existing.Status != InvoiceVoid {
+			return existing, nil
+		}
+	}
+
+	year := inv.IssuedAt.UTC().Year()
+	key := fmt.Sprintf("%s/%d", n.Prefix, year)
+	m.invoiceSeq[key]++
+
+	inv.ID = m.nextID("invoices")
+	inv.Year = year
+	inv.Sequence = m.invoiceSeq[key]
+	inv.Number = n.Format(year, inv.Sequence)
+	inv.Status = InvoiceIssued
+	inv.SentAt = nil
+	inv.CreatedAt, inv.UpdatedAt = time.Now(), time.Now()
+	m.invoices[inv.ID] = inv
+	return inv, nil
+}
+
+func (m *MemoryModel) MarkInvoiceSent(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if inv, ok := m.invoices[id]; ok && inv.Status == InvoiceIssued {
+		now := time.Now()
+		inv.Status = InvoiceSent
+		inv.SentAt = &now
+		inv.UpdatedAt = now
+		m.invoices[id] = inv
+	}
+	return nil
+}
+
+func (m *MemoryModel) ClaimInvoiceResend(id, seen int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invoices[id]
+	if !ok || inv.Resends != seen {
+		return false, nil
+	}
+	inv.Resends++
+	inv.UpdatedAt = time.Now()
+	m.invoices[id] = inv
+	return true, nil
+}
+
+func (m *MemoryModel) SetInvoiceChecksum(id int, checksum string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if inv, ok := m.invoices[id]; ok {
+		inv.Checksum = checksum
+		inv.UpdatedAt = time.Now()
+		m.invoices[id] = inv
+	}
+	return nil
+}
+
+func (m *MemoryModel) GetInvoicesForOrder(orderID int) ([]*Invoice, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var invoices []*Invoice
+	for _, inv := range m.invoices {
+		if inv.OrderID == orderID {
+			inv := inv
+			invoices = append(invoices, &inv)
+		}
+	}
+	sort.Slice(invoices, func(i, j int) bool { return invoices[i].ID > invoices[j].ID })
+	return invoices, nil
+}
+
+func (m *MemoryModel) GetInvoiceByNumber(number string) (Invoice, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, inv := range m.invoices {
+		if inv.Number == number {
+			return inv, nil
+		}
+	}
+	return Invoice{}, sql.ErrNoRows
+}
+
+func (m *MemoryModel) IssueCreditNote(cn CreditNote, n InvoiceNumbering) (CreditNote, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	inv, ok := m.invoices[cn.InvoiceID]
+	if !ok {
+		return CreditNote{}, sql.ErrNoRows
+	}
+
+	credited := 0
+	for _, existing := range m.creditNotes {
+		if existing.Reference == cn.Reference {
+			return existing, nil
+		}
+		if existing.InvoiceID == cn.InvoiceID {
+			credited += existing.Amount
+		}
+	}
+	if cn.Amount <= 0 || credited+cn.Amount > inv.Total {
+		return CreditNote{}, ErrCreditExceedsInvoice
+	}
+
+	year := cn.IssuedAt.UTC().Year()
+	key := fmt.Sprintf("%s/%d", n.Prefix, year)
+	m.invoiceSeq[key]++
+
+	cn.ID = m.nextID("credit_notes")
+	cn.Year = year
+	cn.Sequence = m.invoiceSeq[key]
+	cn.Number = n.Format(year, cn.Sequence)
+	cn.InvoiceNumber = inv.Number
+	cn.Status = InvoiceIssued
+	cn.SentAt = nil
+	cn.CreatedAt, cn.UpdatedAt = time.Now(), time.Now()
+	m.creditNotes[cn.ID] = cn
+
+	if credited+cn.Amount == inv.Total {
+		inv.Status = InvoiceCredited
+		inv.UpdatedAt = time.Now()
+		m.invoices[inv.ID] = inv
+	}
+	return cn, nil
+}
+
+func (m *MemoryModel) MarkCreditNoteSent(id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cn, ok := m.creditNotes[id]; ok && cn.Status == InvoiceIssued {
+		now := time.Now()
+		cn.Status = InvoiceSent
+		cn.SentAt = &now
+		cn.UpdatedAt = now
+		m.creditNotes[id] = cn
+	}
+	return nil
+}
+
+func (m *MemoryModel) SetCreditNoteChecksum(id int, checksum string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if cn, ok := m.creditNotes[id]; ok {
+		cn.Checksum = checksum
+		cn.UpdatedAt = time.Now()
+		m.creditNotes[id] = cn
+	}
+	return nil
+}
+
+func (m *MemoryModel) GetCreditNotesForOrder(orderID int) ([]*CreditNote, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var notes []*CreditNote
+	for _, cn := range m.creditNotes {
+		if cn.OrderID == orderID {
+			cn := cn
+			notes = append(notes, &cn)
+		}
+	}
+	sort.Slice(notes, func(i, j int) bool { return notes[i].ID > notes[j].ID })
+	return notes, nil
+}
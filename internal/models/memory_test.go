@@ -0,0 +1,86 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLastOwner(t *testing.T) {
+	m := NewMemoryModel()
+	m.AddUser(User{Email: "owner@example.com", Role: RoleOwner}, "")
+	m.AddUser(User{Email: "other@example.com", Role: RoleOwner}, "")
+	owner, _ := m.GetUserByEmail("owner@example.com")
+	other, _ := m.GetUserByEmail("other@example.com")
+
+	other.Role = RoleSupport
+	if err := m.EditUser(other); err != nil {
+		t.Fatalf("demoting one of two owners: %s", err)
+	}
+
+	owner.Role = RoleFinance
+	if err := m.EditUser(owner); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("demoting the last owner: error = %v, want ErrLastOwner", err)
+	}
+	if err := m.DeleteUser(owner.ID); !errors.Is(err, ErrLastOwner) {
+		t.Errorf("deleting the last owner: error = %v, want ErrLastOwner", err)
+	}
+	if err := m.DeleteUser(other.ID); err != nil {
+		t.Errorf("deleting a support user: %s", err)
+	}
+}
+
+func TestJobLease(t *testing.T) {
+	m := NewMemoryModel()
+	job, _ := NewJob(JobKindInvoice, InvoiceJob{})
+	m.EnqueueJob(job)
+
+	first, err := m.ClaimJob(JobKindInvoice, time.Nanosecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+
+	// the first worker's lease ran out, so another worker takes the job over
+	second, err := m.ClaimJob(JobKindInvoice, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.CompleteJob(first); !errors.Is(err, ErrJobLeaseLost) {
+		t.Errorf("completing with a lost lease: error = %v, want ErrJobLeaseLost", err)
+	}
+	if _, err := m.FailJob(first, "boom", time.Now()); !errors.Is(err, ErrJobLeaseLost) {
+		t.Errorf("failing with a lost lease: error = %v, want ErrJobLeaseLost", err)
+	}
+	if err := m.CompleteJob(second); err != nil {
+		t.Errorf("completing with the current lease: %s", err)
+	}
+	if err := m.CompleteJob(second); !errors.Is(err, ErrJobLeaseLost) {
+		t.Errorf("completing a job twice: error = %v, want ErrJobLeaseLost", err)
+	}
+}
+
+func TestJobLeaseExpiredOnLastAttempt(t *testing.T) {
+	m := NewMemoryModel()
+	job, _ := NewJob(JobKindInvoice, InvoiceJob{})
+	job.MaxAttempts = 2
+	id, _ := m.EnqueueJob(job)
+
+	// each worker dies holding the job
+	for i := 0; i < 2; i++ {
+		if _, err := m.ClaimJob(JobKindInvoice, time.Nanosecond); err != nil {
+			t.Fatalf("claim %d: %s", i+1, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := m.ClaimJob(JobKindInvoice, time.Minute); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("claiming a job with no attempts left: error = %v, want sql.ErrNoRows", err)
+	}
+	failed, _ := m.GetJobs(JobFailed)
+	if len(failed) != 1 || failed[0].ID != id || failed[0].Attempts != 2 {
+		t.Errorf("failed jobs = %+v, want job %d after 2 attempts", failed, id)
+	}
+}
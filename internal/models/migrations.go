@@ -0,0 +1,256 @@
+package models
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the advisory lock key held while a migration runs, so two
+// processes migrating at once cannot apply the same version twice
+const migrationLock = 7247001
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration type for one versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus type for a migration and when it was applied, if it has been
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Migrations returns the embedded migrations ordered by version
+func Migrations() ([]Migration, error) {
+	return readMigrations(migrationFiles, "migrations")
+}
+
+// readMigrations parses NNNNNN_name.up.sql and NNNNNN_name.down.sql files in dir
+func readMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, e := range entries {
+		parts := migrationName.FindStringSubmatch(e.Name())
+		if parts == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(parts[1])
+
+		body, err := fs.ReadFile(fsys, dir+"/"+e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		mg, ok := byVersion[version]
+		if !ok {
+			mg = &Migration{Version: version, Name: parts[2]}
+			byVersion[version] = mg
+		} else if mg.Name != parts[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mg.Name, parts[2])
+		}
+
+		if parts[3] == "up" {
+			mg.Up = string(body)
+		} else {
+			mg.Down = string(body)
+		}
+	}
+
+	var migrations []Migration
+	for _, mg := range byVersion {
+		if mg.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", mg.Version, mg.Name)
+		}
+		migrations = append(migrations, *mg)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// ensureMigrationsTable creates the schema_migrations table if it does not exist
+func (m *DBModel) ensureMigrationsTable(ctx context.Context) error {
+	_, err := m.DB.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`)
+	return err
+}
+
+// appliedMigrations returns when each applied migration version was applied
+func (m *DBModel) appliedMigrations(ctx context.Context) (map[int]time.Time, error) {
+	applied := make(map[int]time.Time)
+
+	rows, err := m.DB.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var at time.Time
+		err = rows.Scan(&version, &at)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = at
+	}
+	return applied, rows.Err()
+}
+
+// MigrationStatus lists every embedded migration and whether it has been applied
+func (m *DBModel) MigrationStatus() ([]MigrationStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.ensureMigrationsTable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := m.appliedMigrations(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, mg := range migrations {
+		s := MigrationStatus{Migration: mg}
+		if at, ok := applied[mg.Version]; ok {
+			s.AppliedAt = &at
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses, nil
+}
+
+// MigrateUp applies every pending migration in version order, each in its own
+// transaction, and returns the migrations it applied
+func (m *DBModel) MigrateUp() ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for _, mg := range migrations {
+		applied, err := m.applyMigration(mg, true)
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", mg.Version, mg.Name, err)
+		}
+		if applied {
+			done = append(done, mg)
+		}
+	}
+	return done, nil
+}
+
+// MigrateDown rolls back the n most recently applied migrations and returns them
+func (m *DBModel) MigrateDown(n int) ([]Migration, error) {
+	statuses, err := m.MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	var done []Migration
+	for i := len(statuses) - 1; i >= 0 && len(done) < n; i-- {
+		mg := statuses[i].Migration
+		if statuses[i].AppliedAt == nil {
+			continue
+		}
+		if mg.Down == "" {
+			return done, fmt.Errorf("migration %d_%s has no down file", mg.Version, mg.Name)
+		}
+
+		reverted, err := m.applyMigration(mg, false)
+		if err != nil {
+			return done, fmt.Errorf("migration %d_%s: %w", mg.Version, mg.Name, err)
+		}
+		if reverted {
+			done = append(done, mg)
+		}
+	}
+	return done, nil
+}
+
+// applyMigration runs the up or down script of a migration and records it in
+// schema_migrations. It reports false when there was nothing to do because another
+// process got there first.
+func (m *DBModel) applyMigration(mg Migration, up bool) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	changed := false
+	err := m.WithTx(ctx, func(tx *DBModel) error {
+		_, err := tx.DB.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock)
+		if err != nil {
+			return err
+		}
+
+		err = tx.ensureMigrationsTable(ctx)
+		if err != nil {
+			return err
+		}
+
+		var applied bool
+		err = tx.DB.QueryRowContext(ctx,
+			`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, mg.Version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied == up {
+			return nil
+		}
+
+		if up {
+			_, err = tx.DB.ExecContext(ctx, mg.Up)
+			if err != nil {
+				return err
+			}
+			_, err = tx.DB.ExecContext(ctx,
+				`INSERT INTO schema_migrations (version, name, applied_at) VALUES ($1, $2, $3)`,
+				mg.Version, mg.Name, time.Now())
+		} else {
+			_, err = tx.DB.ExecContext(ctx, mg.Down)
+			if err != nil {
+				return err
+			}
+			_, err = tx.DB.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, mg.Version)
+		}
+		if err != nil {
+			return err
+		}
+
+		changed = true
+		return nil
+	})
+	return changed, err
+}
@@ -0,0 +1,120 @@
+CREATE TABLE statuses (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE transaction_statuses (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE items (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    description TEXT NOT NULL DEFAULT '',
+    inventory_level INTEGER NOT NULL DEFAULT 0,
+    price INTEGER NOT NULL,
+    image VARCHAR(255),
+    is_recurring BOOLEAN NOT NULL DEFAULT false,
+    plan_id VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE transactions (
+    id SERIAL PRIMARY KEY,
+    amount INTEGER NOT NULL,
+    currency VARCHAR(255) NOT NULL,
+    last_four VARCHAR(255) NOT NULL DEFAULT '',
+    bank_return_code VARCHAR(255) NOT NULL DEFAULT '',
+    payment_intent VARCHAR(255) NOT NULL DEFAULT '',
+    payment_method VARCHAR(255) NOT NULL DEFAULT '',
+    transaction_status_id INTEGER NOT NULL REFERENCES transaction_statuses (id),
+    expiry_month INTEGER NOT NULL DEFAULT 0,
+    expiry_year INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX transactions_payment_intent_idx ON transactions (payment_intent);
+
+CREATE TABLE customers (
+    id SERIAL PRIMARY KEY,
+    first_name VARCHAR(255) NOT NULL,
+    last_name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE orders (
+    id SERIAL PRIMARY KEY,
+    item_id INTEGER NOT NULL REFERENCES items (id),
+    transaction_id INTEGER NOT NULL REFERENCES transactions (id),
+    customer_id INTEGER NOT NULL REFERENCES customers (id),
+    status_id INTEGER NOT NULL REFERENCES statuses (id),
+    quantity INTEGER NOT NULL,
+    amount INTEGER NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE users (
+    id SERIAL PRIMARY KEY,
+    first_name VARCHAR(255) NOT NULL,
+    last_name VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL UNIQUE,
+    password VARCHAR(60) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL DEFAULT '',
+    email VARCHAR(255) NOT NULL,
+    token_hash BYTEA NOT NULL,
+    expiry TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX tokens_token_hash_idx ON tokens (token_hash);
+
+-- session store used by github.com/alexedwards/scs/postgresstore
+CREATE TABLE sessions (
+    token TEXT PRIMARY KEY,
+    data BYTEA NOT NULL,
+    expiry TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX sessions_expiry_idx ON sessions (expiry);
+
+INSERT INTO statuses (id, name) VALUES
+    (1, 'Cleared'),
+    (2, 'Refunded'),
+    (3, 'Cancelled'),
+    (4, 'Disputed');
+SELECT setval('statuses_id_seq', (SELECT max(id) FROM statuses));
+
+INSERT INTO transaction_statuses (id, name) VALUES
+    (1, 'Pending'),
+    (2, 'Cleared'),
+    (3, 'Declined'),
+    (4, 'Refunded');
+SELECT setval('transaction_statuses_id_seq', (SELECT max(id) FROM transaction_statuses));
+
+-- plan_id must be replaced with the price ID of the plan in your Stripe account
+INSERT INTO items (id, name, description, inventory_level, price, image, is_recurring, plan_id) VALUES
+    (1, 'Widget', 'A very nice widget.', 10, 1000, '', false, ''),
+    (2, 'Bronze Plan', 'Get three widgets for the price of two every month.', 10, 2000, '', true, 'price_bronze');
+SELECT setval('items_id_seq', (SELECT max(id) FROM items));
+
+-- admin@example.com / password, change it after the first login
+INSERT INTO users (first_name, last_name, email, password) VALUES
+    ('Admin', 'User', 'admin@example.com', '$2a$12$55p7qs.O3qvl3C2zaG3kGOT2ftlLVlw8/wIXPryhKNCc.qVS1z3aK');
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS reconciliations;
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS webhook_events;
+DROP TABLE IF EXISTS coupons;
+DROP TABLE IF EXISTS carts;
+DROP TABLE IF EXISTS order_items;
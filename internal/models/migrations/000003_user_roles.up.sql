@@ -0,0 +1,4 @@
+-- existing users keep full access, new users start read only
+ALTER TABLE users ADD COLUMN role VARCHAR(32) NOT NULL DEFAULT 'owner'
+    CHECK (role IN ('owner', 'finance', 'support', 'read-only'));
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'read-only';
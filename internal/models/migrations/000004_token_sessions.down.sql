@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS tokens_user_id_idx;
+
+ALTER TABLE tokens
+    DROP COLUMN revoked_at,
+    DROP COLUMN user_agent,
+    DROP COLUMN ip,
+    DROP COLUMN last_used_at;
@@ -0,0 +1,7 @@
+ALTER TABLE tokens
+    ADD COLUMN last_used_at TIMESTAMPTZ,
+    ADD COLUMN ip VARCHAR(64) NOT NULL DEFAULT '',
+    ADD COLUMN user_agent TEXT NOT NULL DEFAULT '',
+    ADD COLUMN revoked_at TIMESTAMPTZ;
+
+CREATE INDEX tokens_user_id_idx ON tokens (user_id);
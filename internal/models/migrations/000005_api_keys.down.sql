@@ -0,0 +1,6 @@
+DELETE FROM tokens WHERE expiry IS NULL;
+
+ALTER TABLE tokens
+    ALTER COLUMN expiry SET NOT NULL,
+    DROP COLUMN scopes,
+    DROP COLUMN scope;
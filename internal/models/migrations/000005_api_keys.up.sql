@@ -0,0 +1,4 @@
+ALTER TABLE tokens
+    ADD COLUMN scope VARCHAR(32) NOT NULL DEFAULT 'authentication',
+    ADD COLUMN scopes TEXT NOT NULL DEFAULT '',
+    ALTER COLUMN expiry DROP NOT NULL;
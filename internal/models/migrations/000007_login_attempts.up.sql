@@ -0,0 +1,10 @@
+CREATE TABLE login_attempts (
+    kind VARCHAR(32) NOT NULL,
+    key VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    locked_until TIMESTAMPTZ,
+    PRIMARY KEY (kind, key)
+);
+
+CREATE INDEX login_attempts_locked_until_idx ON login_attempts (locked_until);
@@ -0,0 +1,27 @@
+CREATE TABLE invoice_sequences (
+    prefix VARCHAR(32) NOT NULL,
+    year INTEGER NOT NULL,
+    last_number INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (prefix, year)
+);
+
+CREATE TABLE invoices (
+    id SERIAL PRIMARY KEY,
+    number VARCHAR(64) NOT NULL UNIQUE,
+    year INTEGER NOT NULL,
+    sequence INTEGER NOT NULL,
+    order_id INTEGER NOT NULL REFERENCES orders (id),
+    email VARCHAR(255) NOT NULL,
+    currency VARCHAR(8) NOT NULL DEFAULT 'usd',
+    subtotal INTEGER NOT NULL,
+    total INTEGER NOT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'issued',
+    issued_at TIMESTAMPTZ NOT NULL,
+    due_at TIMESTAMPTZ NOT NULL,
+    sent_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- an order has at most one invoice that is not void
+CREATE UNIQUE INDEX invoices_order_id_idx ON invoices (order_id) WHERE status <> 'void';
@@ -0,0 +1,2 @@
+-- sha256 of the invoice pdf, which is also its name in storage
+ALTER TABLE invoices ADD COLUMN pdf_checksum VARCHAR(64) NOT NULL DEFAULT '';
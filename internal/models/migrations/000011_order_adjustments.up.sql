@@ -0,0 +1,3 @@
+-- the coupon discount and sales tax included in an order's amount, in cents
+ALTER TABLE orders ADD COLUMN discount INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE orders ADD COLUMN tax INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,23 @@
+CREATE TABLE credit_notes (
+    id SERIAL PRIMARY KEY,
+    number VARCHAR(64) NOT NULL UNIQUE,
+    year INTEGER NOT NULL,
+    sequence INTEGER NOT NULL,
+    invoice_id INTEGER NOT NULL REFERENCES invoices (id),
+    order_id INTEGER NOT NULL REFERENCES orders (id),
+    email VARCHAR(255) NOT NULL,
+    currency VARCHAR(8) NOT NULL DEFAULT 'usd',
+    amount INTEGER NOT NULL,
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    -- whatever asked for the credit note, so asking again returns the same one
+    reference VARCHAR(255) NOT NULL UNIQUE,
+    status VARCHAR(16) NOT NULL DEFAULT 'issued',
+    issued_at TIMESTAMPTZ NOT NULL,
+    sent_at TIMESTAMPTZ,
+    pdf_checksum VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX credit_notes_order_id_idx ON credit_notes (order_id);
+CREATE INDEX credit_notes_invoice_id_idx ON credit_notes (invoice_id);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS refunds;
+
+UPDATE orders SET status_id = 2 WHERE status_id = 5;
+DELETE FROM statuses WHERE id = 5;
@@ -0,0 +1,18 @@
+INSERT INTO statuses (id, name) VALUES (5, 'Partially Refunded');
+SELECT setval('statuses_id_seq', (SELECT max(id) FROM statuses));
+
+CREATE TABLE refunds (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders (id),
+    transaction_id INTEGER NOT NULL REFERENCES transactions (id),
+    amount INTEGER NOT NULL,
+    currency VARCHAR(8) NOT NULL DEFAULT 'usd',
+    reason VARCHAR(255) NOT NULL DEFAULT '',
+    stripe_refund_id VARCHAR(255) NOT NULL DEFAULT '',
+    -- the admin who made the refund
+    user_id INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX refunds_order_id_idx ON refunds (order_id);
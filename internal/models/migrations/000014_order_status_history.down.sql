@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS order_status_history;
+
+UPDATE orders SET status_id = 1 WHERE status_id IN (7, 8, 9);
+UPDATE orders SET status_id = 3 WHERE status_id = 6;
+DELETE FROM statuses WHERE id IN (6, 7, 8, 9);
+UPDATE statuses SET name = 'Cleared' WHERE id = 1;
@@ -0,0 +1,20 @@
+UPDATE statuses SET name = 'Paid' WHERE id = 1;
+INSERT INTO statuses (id, name) VALUES
+    (6, 'Pending'),
+    (7, 'Fulfilled'),
+    (8, 'Shipped'),
+    (9, 'Delivered');
+SELECT setval('statuses_id_seq', (SELECT max(id) FROM statuses));
+
+CREATE TABLE order_status_history (
+    id SERIAL PRIMARY KEY,
+    order_id INTEGER NOT NULL REFERENCES orders (id),
+    from_status_id INTEGER NOT NULL REFERENCES statuses (id),
+    to_status_id INTEGER NOT NULL REFERENCES statuses (id),
+    -- the admin who made the change, or NULL for changes reported by Stripe
+    user_id INTEGER REFERENCES users (id) ON DELETE SET NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX order_status_history_order_id_idx ON order_status_history (order_id);
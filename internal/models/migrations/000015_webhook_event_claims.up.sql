@@ -0,0 +1,3 @@
+ALTER TABLE webhook_events ADD COLUMN claimed_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+UPDATE webhook_events SET claimed_at = created_at;
@@ -0,0 +1,6 @@
+DELETE FROM idempotency_keys WHERE owner <> '';
+
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key, route);
+
+ALTER TABLE idempotency_keys DROP COLUMN owner;
@@ -0,0 +1,4 @@
+ALTER TABLE idempotency_keys ADD COLUMN owner VARCHAR(255) NOT NULL DEFAULT '';
+
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (key, route, owner);
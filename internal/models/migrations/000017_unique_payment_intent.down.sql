@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS transactions_payment_intent_key;
+
+CREATE INDEX transactions_payment_intent_idx ON transactions (payment_intent);
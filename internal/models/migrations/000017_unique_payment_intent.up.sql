@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS transactions_payment_intent_idx;
+
+-- a payment intent pays for one transaction; subscriptions store the subscription ID
+CREATE UNIQUE INDEX transactions_payment_intent_key ON transactions (payment_intent) WHERE payment_intent <> '';
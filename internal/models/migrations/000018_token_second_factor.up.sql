@@ -0,0 +1,2 @@
+-- set on session tokens issued after the user's second factor was checked
+ALTER TABLE tokens ADD COLUMN second_factor BOOLEAN NOT NULL DEFAULT false;
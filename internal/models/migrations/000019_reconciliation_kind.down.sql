@@ -0,0 +1,2 @@
+ALTER TABLE reconciliations DROP COLUMN stripe_refund_id;
+ALTER TABLE reconciliations DROP COLUMN kind;
@@ -0,0 +1,4 @@
+-- a lost refund is money that went back to the customer, not money taken from them,
+-- so each row says which it is and which refund it was
+ALTER TABLE reconciliations ADD COLUMN kind VARCHAR(16) NOT NULL DEFAULT 'charge' CHECK (kind IN ('charge', 'refund'));
+ALTER TABLE reconciliations ADD COLUMN stripe_refund_id VARCHAR(255) NOT NULL DEFAULT '';
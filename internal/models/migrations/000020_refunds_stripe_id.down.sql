@@ -0,0 +1 @@
+DROP INDEX IF EXISTS refunds_stripe_refund_id_idx;
@@ -0,0 +1,3 @@
+-- a refund reported by Stripe more than once, or made here and then reported, is
+-- recorded once
+CREATE UNIQUE INDEX refunds_stripe_refund_id_idx ON refunds (stripe_refund_id) WHERE stripe_refund_id <> '';
@@ -0,0 +1,3 @@
+-- how often the invoice has been resent; a resend link carries the count it was made
+-- at, so each link works once
+ALTER TABLE invoices ADD COLUMN resends INTEGER NOT NULL DEFAULT 0;
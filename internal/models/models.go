@@ -10,9 +10,39 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// DBTX is the part of *sql.DB and *sql.Tx the models use, so the same model
+// methods run against the pool or inside a transaction
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 // DBModel type for database connection values
 type DBModel struct {
-	DB *sql.DB
+	DB DBTX
+}
+
+// WithTx runs fn with a DBModel bound to a single transaction, committing if fn
+// returns nil and rolling back otherwise. Calling WithTx on a model that is already
+// in a transaction runs fn in that transaction.
+func (m *DBModel) WithTx(ctx context.Context, fn func(tx *DBModel) error) error {
+	db, ok := m.DB.(*sql.DB)
+	if !ok {
+		return fn(m)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = fn(&DBModel{DB: tx})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 // Models is the wrapper to all models
@@ -47,14 +77,30 @@ type Order struct {
 	ItemID        int         `json:"item_id"`
 	TransactionID int         `json:"transaction_id"`
 	CustomerID    int         `json:"customer_id"`
-	StatusID      int         `json:"status_id"`
+	StatusID      OrderStatus `json:"status_id"`
 	Quantity      int         `json:"quantity"`
 	Amount        int         `json:"amount"`
+	Discount      int         `json:"discount"` // coupon discount included in Amount
+	Tax           int         `json:"tax"`      // sales tax included in Amount
 	CreatedAt     time.Time   `json:"-"`
 	UpdatedAt     time.Time   `json:"-"`
 	Item          Item        `json:"item"`
 	Transaction   Transaction `json:"transaction"`
 	Customer      Customer    `json:"customer"`
+	Items         []OrderItem `json:"items"`
+}
+
+// OrderItem type for the lines of an order
+type OrderItem struct {
+	ID        int       `json:"id"`
+	OrderID   int       `json:"order_id"`
+	ItemID    int       `json:"item_id"`
+	Quantity  int       `json:"quantity"`
+	UnitPrice int       `json:"unit_price"`
+	LineTotal int       `json:"line_total"`
+	CreatedAt time.Time `json:"-"`
+	UpdatedAt time.Time `json:"-"`
+	Item      Item      `json:"item"`
 }
 
 // Status type for order statuses
@@ -91,13 +137,16 @@ type Transaction struct {
 
 // User type for transtactions
 type User struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	CreatedAt time.Time `json:"-"`
-	UpdatedAt time.Time `json:"-"`
+	ID               int        `json:"id"`
+	FirstName        string     `json:"first_name"`
+	LastName         string     `json:"last_name"`
+	Email            string     `json:"email"`
+	Password         string     `json:"password"`
+	Role             string     `json:"role"`
+	TwoFactorEnabled bool       `json:"two_factor_enabled"`
+	LockedUntil      *time.Time `json:"locked_until,omitempty"`
+	CreatedAt        time.Time  `json:"-"`
+	UpdatedAt        time.Time  `json:"-"`
 }
 
 // Customer type for transtactions
@@ -139,6 +188,10 @@ func (m *DBModel) GetItem(id int) (Item, error) {
 	return item, nil
 }
 
+// ErrPaymentIntentUsed is returned when a payment intent is already recorded against
+// another transaction
+var ErrPaymentIntentUsed = errors.New("payment intent has already been used")
+
 // InsertTransaction inserts a transaction and returns txn ID
 func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -148,6 +201,7 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 		INSERT INTO transactions
 		(amount, currency, last_four, bank_return_code, payment_intent, payment_method, transaction_status_id, expiry_month, expiry_year, created_at, updated_at)
 		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (payment_intent) WHERE payment_intent <> '' DO NOTHING
 		RETURNING id
 	`
 
@@ -165,6 +219,9 @@ func (m *DBModel) InsertTransaction(txn Transaction) (int, error) {
 		time.Now(),
 		time.Now(),
 	).Scan(&txnID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrPaymentIntentUsed
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -179,8 +236,8 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 
 	query := `
 		INSERT INTO orders
-		(item_id, transaction_id, status_id, customer_id, quantity, amount, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		(item_id, transaction_id, status_id, customer_id, quantity, amount, discount, tax, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 		RETURNING id
 	`
 
@@ -192,6 +249,8 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 		order.CustomerID,
 		order.Quantity,
 		order.Amount,
+		order.Discount,
+		order.Tax,
 		time.Now(),
 		time.Now(),
 	).Scan(&orderID)
@@ -202,6 +261,206 @@ func (m *DBModel) InsertOrder(order Order) (int, error) {
 	return orderID, nil
 }
 
+// InsertOrderWithItems inserts an order and its lines in one transaction and returns
+// the order ID. The order's item_id and quantity summarize the first line and the
+// total quantity so single item reports keep working.
+func (m *DBModel) InsertOrderWithItems(order Order, items []OrderItem) (int, error) {
+	if len(items) == 0 {
+		return 0, errors.New("an order needs at least one item")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	order.ItemID = items[0].ItemID
+	order.Quantity = 0
+	for _, i := range items {
+		order.Quantity += i.Quantity
+	}
+
+	var orderID int
+	err := m.WithTx(ctx, func(tx *DBModel) error {
+		query := `
+			INSERT INTO orders
+			(item_id, transaction_id, status_id, customer_id, quantity, amount, discount, tax, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			RETURNING id
+		`
+
+		err := tx.DB.QueryRowContext(ctx, query,
+			order.ItemID,
+			order.TransactionID,
+			order.StatusID,
+			order.CustomerID,
+			order.Quantity,
+			order.Amount,
+			order.Discount,
+			order.Tax,
+			time.Now(),
+			time.Now(),
+		).Scan(&orderID)
+		if err != nil {
+			return err
+		}
+
+		stmt := `
+			INSERT INTO order_items
+			(order_id, item_id, quantity, unit_price, line_total, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`
+		for _, i := range items {
+			_, err = tx.DB.ExecContext(ctx, stmt,
+				orderID,
+				i.ItemID,
+				i.Quantity,
+				i.UnitPrice,
+				i.LineTotal,
+				time.Now(),
+				time.Now(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return orderID, nil
+}
+
+// SaveCheckout writes the customer, transaction and order of a checkout, and queues
+// its invoice, in one transaction and returns the order ID. Either everything is
+// saved or nothing is.
+func (m *DBModel) SaveCheckout(c Customer, txn Transaction, order Order, items []OrderItem) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var orderID int
+	err := m.WithTx(ctx, func(tx *DBModel) error {
+		customerID, err := tx.InsertCustomer(c)
+		if err != nil {
+			return err
+		}
+
+		txnID, err := tx.InsertTransaction(txn)
+		if err != nil {
+			return err
+		}
+
+		order.CustomerID = customerID
+		order.TransactionID = txnID
+		orderID, err = tx.InsertOrderWithItems(order, items)
+		if err != nil {
+			return err
+		}
+
+		// the invoice is queued with the order, so it is sent even if the invoice
+		// service is down right now
+		order.ID = orderID
+		job, err := NewJob(JobKindInvoice, NewInvoiceJob(order, c, txn, items))
+		if err != nil {
+			return err
+		}
+		_, err = tx.EnqueueJob(job)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return orderID, nil
+}
+
+// GetOrderItems returns the lines of the given orders keyed by order ID
+func (m *DBModel) GetOrderItems(orderIDs ...int) (map[int][]OrderItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	lines := make(map[int][]OrderItem)
+	if len(orderIDs) == 0 {
+		return lines, nil
+	}
+
+	ids := make([]int64, len(orderIDs))
+	for i, id := range orderIDs {
+		ids[i] = int64(id)
+	}
+
+	query := `
+	select oi.id, oi.order_id, oi.item_id, oi.quantity, oi.unit_price, oi.line_total, oi.created_at, oi.updated_at,
+		i.id, i.name, i.description, i.price, i.is_recurring
+	from order_items oi
+	left join items i on (oi.item_id = i.id)
+	where oi.order_id = ANY($1)
+	order by oi.order_id, oi.id
+	`
+
+	rows, err := m.DB.QueryContext(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var l OrderItem
+		err = rows.Scan(
+			&l.ID,
+			&l.OrderID,
+			&l.ItemID,
+			&l.Quantity,
+			&l.UnitPrice,
+			&l.LineTotal,
+			&l.CreatedAt,
+			&l.UpdatedAt,
+			&l.Item.ID,
+			&l.Item.Name,
+			&l.Item.Description,
+			&l.Item.Price,
+			&l.Item.IsRecurring,
+		)
+		if err != nil {
+			return nil, err
+		}
+		lines[l.OrderID] = append(lines[l.OrderID], l)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+// attachOrderItems fills in the lines of each order. Orders placed before order_items
+// existed get a single line built from the order itself.
+func (m *DBModel) attachOrderItems(orders ...*Order) error {
+	ids := make([]int, len(orders))
+	for i, o := range orders {
+		ids[i] = o.ID
+	}
+
+	lines, err := m.GetOrderItems(ids...)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range orders {
+		o.Items = lines[o.ID]
+		if len(o.Items) == 0 {
+			o.Items = []OrderItem{{
+				OrderID:   o.ID,
+				ItemID:    o.ItemID,
+				Quantity:  o.Quantity,
+				UnitPrice: o.Amount / max(o.Quantity, 1),
+				LineTotal: o.Amount,
+				Item:      o.Item,
+			}}
+		}
+	}
+	return nil
+}
+
 // InsertCustomer inserts a customer and returns order ID
 func (m *DBModel) InsertCustomer(c Customer) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -229,48 +488,6 @@ func (m *DBModel) InsertCustomer(c Customer) (int, error) {
 	return customerID, nil
 }
 
-func (m *DBModel) CreateTables() {
-	// dropItemTable := `DROP TABLE IF EXISTS items`
-	// _, err := m.DB.Exec(dropItemTable)
-	// if err != nil {
-	// 	panic("could not drop items table")
-	// }
-	// createItemsTable := `CREATE TABLE IF NOT EXISTS items (
-	// 	id SERIAL PRIMARY KEY,
-	// 	name TEXT NOT NULL
-	// )`
-
-	// _, err := m.DB.Exec(createItemsTable)
-	// if err != nil {
-	// 	panic("could not create items table")
-	// }
-
-	err := m.testItemData()
-	if err != nil {
-		panic("could not create test item data")
-	}
-
-}
-
-func (m *DBModel) testItemData() error {
-	insertTestData := `INSERT INTO items (id, name, description, inventory_level, price, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7)`
-
-	_, err := m.DB.Exec(insertTestData,
-		2,
-		"Bronze Series Plan",
-		"Receive three unique items for the price of two every month.",
-		10,
-		2000,
-		time.Now(),
-		time.Now(),
-	)
-	if err != nil {
-		panic("could not create test item data")
-	}
-
-	return nil
-}
-
 // GetUserByEmail gets user by email address
 func (m *DBModel) GetUserByEmail(email string) (User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -280,7 +497,7 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 	var u User
 
 	row := m.DB.QueryRowContext(ctx, `
-		SELECT id, first_name, last_name, email, password, created_at, updated_at
+		SELECT id, first_name, last_name, email, password, role, totp_enabled, created_at, updated_at
 		FROM users
 		WHERE email = $1
 	`, email)
@@ -291,6 +508,8 @@ func (m *DBModel) GetUserByEmail(email string) (User, error) {
 		&u.LastName,
 		&u.Email,
 		&u.Password,
+		&u.Role,
+		&u.TwoFactorEnabled,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -526,6 +745,11 @@ func (m *DBModel) GetAllOrdersPaginated(recurring bool, pageSize, page int) ([]*
 	}
 	lastPage := totalRecords / pageSize
 
+	err = m.attachOrderItems(orders...)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
 	return orders, lastPage, totalRecords, nil
 }
 
@@ -536,7 +760,7 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 	var o Order
 
 	query := `
-	select o.id, o.item_id, o.transaction_id, o.customer_id, o.status_id, o.quantity, o.amount, o.created_at, o.updated_at,
+	select o.id, o.item_id, o.transaction_id, o.customer_id, o.status_id, o.quantity, o.amount, o.discount, o.tax, o.created_at, o.updated_at,
 		i.id, i.name, t.id, t.amount, t.currency, t.last_four, t.expiry_month, t.expiry_year, t.payment_intent, t.bank_return_code,
 		c.id, c.first_name, c.last_name, c.email
 	from orders o
@@ -557,6 +781,8 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 		&o.StatusID,
 		&o.Quantity,
 		&o.Amount,
+		&o.Discount,
+		&o.Tax,
 		&o.CreatedAt,
 		&o.UpdatedAt,
 		&o.Item.ID,
@@ -578,21 +804,23 @@ func (m *DBModel) GetOrderByID(id int) (Order, error) {
 		return o, err
 	}
 
+	err = m.attachOrderItems(&o)
+	if err != nil {
+		return o, err
+	}
+
 	return o, nil
 }
 
-// UpdateOrderStatus updates the status of order by id with given status id
-func (m *DBModel) UpdateOrderStatus(id, statusID int) error {
+// UpdateOrderStatus moves an order to another status and records who did it and why.
+// A change its lifecycle does not allow fails with ErrInvalidTransition.
+func (m *DBModel) UpdateOrderStatus(id int, to OrderStatus, c StatusChange) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `UPDATE orders SET status_id = $1 WHERE id = $2`
-
-	_, err := m.DB.ExecContext(ctx, stmt, statusID, id)
-	if err != nil {
-		return err
-	}
-	return nil
+	return m.WithTx(ctx, func(tx *DBModel) error {
+		return tx.moveOrder(ctx, id, to, c)
+	})
 }
 
 func (m *DBModel) GetAllUsers() ([]*User, error) {
@@ -601,10 +829,15 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 
 	var users []*User
 
-	query := `SELECT id, last_name, first_name, email, created_at, updated_at
-		FROM users ORDER BY last_name, first_name`
+	// users whose account is locked out after failed logins carry when the lock ends
+	query := `SELECT u.id, u.last_name, u.first_name, u.email, u.role, u.totp_enabled,
+			la.locked_until, u.created_at, u.updated_at
+		FROM users u
+		LEFT JOIN login_attempts la
+		ON (la.kind = $1 AND la.key = lower(btrim(u.email)) AND la.locked_until > $2)
+		ORDER BY u.last_name, u.first_name`
 
-	rows, err := m.DB.QueryContext(ctx, query)
+	rows, err := m.DB.QueryContext(ctx, query, ThrottleAccount, time.Now())
 	if err != nil {
 		return nil, err
 	}
@@ -617,6 +850,9 @@ func (m *DBModel) GetAllUsers() ([]*User, error) {
 			&u.LastName,
 			&u.FirstName,
 			&u.Email,
+			&u.Role,
+			&u.TwoFactorEnabled,
+			&u.LockedUntil,
 			&u.CreatedAt,
 			&u.UpdatedAt,
 		)
@@ -635,7 +871,7 @@ func (m *DBModel) GetOneUser(id int) (User, error) {
 
 	var u User
 
-	query := `SELECT id, last_name, first_name, email, created_at, updated_at
+	query := `SELECT id, last_name, first_name, email, role, totp_enabled, created_at, updated_at
 		FROM users WHERE id = $1`
 
 	row := m.DB.QueryRowContext(ctx, query, id)
@@ -645,6 +881,8 @@ func (m *DBModel) GetOneUser(id int) (User, error) {
 		&u.LastName,
 		&u.FirstName,
 		&u.Email,
+		&u.Role,
+		&u.TwoFactorEnabled,
 		&u.CreatedAt,
 		&u.UpdatedAt,
 	)
@@ -655,24 +893,61 @@ func (m *DBModel) GetOneUser(id int) (User, error) {
 	return u, nil
 }
 
+// ErrLastOwner is returned when a change would leave no user with the owner role
+var ErrLastOwner = errors.New("there must be at least one owner")
+
+// EditUser updates a user, refusing to demote the last owner
 func (m *DBModel) EditUser(u User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `UPDATE users SET first_name = $1, last_name = $2, email = $3, updated_at = $4
-		WHERE id = $5`
+	return m.WithTx(ctx, func(tx *DBModel) error {
+		if u.Role != RoleOwner {
+			err := tx.keepAnOwner(ctx, u.ID)
+			if err != nil {
+				return err
+			}
+		}
 
-	_, err := m.DB.ExecContext(ctx, stmt,
-		u.FirstName,
-		u.LastName,
-		u.Email,
-		time.Now(),
-		u.ID,
-	)
+		stmt := `UPDATE users SET first_name = $1, last_name = $2, email = $3, role = $4, updated_at = $5
+			WHERE id = $6`
+
+		_, err := tx.DB.ExecContext(ctx, stmt,
+			u.FirstName,
+			u.LastName,
+			u.Email,
+			u.Role,
+			time.Now(),
+			u.ID,
+		)
+		return err
+	})
+}
+
+// keepAnOwner returns ErrLastOwner if id is the only owner. It locks the owners'
+// rows, so concurrent changes cannot each take away a different last owner.
+func (m *DBModel) keepAnOwner(ctx context.Context, id int) error {
+	rows, err := m.DB.QueryContext(ctx, `SELECT id FROM users WHERE role = $1 FOR UPDATE`, RoleOwner)
 	if err != nil {
 		return err
 	}
+	defer rows.Close()
 
+	var owners []int
+	for rows.Next() {
+		var ownerID int
+		if err := rows.Scan(&ownerID); err != nil {
+			return err
+		}
+		owners = append(owners, ownerID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(owners) == 1 && owners[0] == id {
+		return ErrLastOwner
+	}
 	return nil
 }
 
@@ -681,8 +956,8 @@ func (m *DBModel) AddUser(u User, hash string) error {
 	defer cancel()
 
 	stmt := `
-		INSERT INTO users (first_name, last_name, email, password, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
+		INSERT INTO users (first_name, last_name, email, password, role, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 	`
 
 	_, err := m.DB.ExecContext(ctx, stmt,
@@ -690,6 +965,7 @@ func (m *DBModel) AddUser(u User, hash string) error {
 		u.LastName,
 		u.Email,
 		hash,
+		u.Role,
 		time.Now(),
 		time.Now(),
 	)
@@ -700,24 +976,23 @@ func (m *DBModel) AddUser(u User, hash string) error {
 	return nil
 }
 
+// DeleteUser deletes a user and their tokens, refusing to delete the last owner
 func (m *DBModel) DeleteUser(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	stmt := `
-		DELETE from Users WHERE id = $1
-	`
+	return m.WithTx(ctx, func(tx *DBModel) error {
+		err := tx.keepAnOwner(ctx, id)
+		if err != nil {
+			return err
+		}
 
-	_, err := m.DB.ExecContext(ctx, stmt, id)
-	if err != nil {
-		return err
-	}
+		_, err = tx.DB.ExecContext(ctx, `DELETE from Users WHERE id = $1`, id)
+		if err != nil {
+			return err
+		}
 
-	stmt = `DELETE from tokens WHERE user_id = $1`
-	_, err = m.DB.ExecContext(ctx, stmt, id)
-	if err != nil {
+		_, err = tx.DB.ExecContext(ctx, `DELETE from tokens WHERE user_id = $1`, id)
 		return err
-	}
-
-	return nil
+	})
 }
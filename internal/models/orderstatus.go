@@ -0,0 +1,272 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// OrderStatus is where an order is in its lifecycle; it is the id of its statuses row
+type OrderStatus int
+
+// Order statuses
+const (
+	OrderPaid              OrderStatus = 1
+	OrderRefunded          OrderStatus = 2
+	OrderCancelled         OrderStatus = 3
+	OrderDisputed          OrderStatus = 4
+	OrderPartiallyRefunded OrderStatus = 5
+	OrderPending           OrderStatus = 6
+	OrderFulfilled         OrderStatus = 7
+	OrderShipped           OrderStatus = 8
+	OrderDelivered         OrderStatus = 9
+)
+
+var orderStatusNames = map[OrderStatus]string{
+	OrderPaid:              "Paid",
+	OrderRefunded:          "Refunded",
+	OrderCancelled:         "Cancelled",
+	OrderDisputed:          "Disputed",
+	OrderPartiallyRefunded: "Partially Refunded",
+	OrderPending:           "Pending",
+	OrderFulfilled:         "Fulfilled",
+	OrderShipped:           "Shipped",
+	OrderDelivered:         "Delivered",
+}
+
+// orderTransitions lists the statuses an order may move to from each status. Refunded
+// and cancelled orders are done with. A partially refunded order may be refunded in
+// part again. A won dispute returns the order to where it was before, whatever that
+// was; see RestoreDisputedOrdersByPaymentIntent.
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPending:           {OrderPaid, OrderCancelled},
+	OrderPaid:              {OrderFulfilled, OrderPartiallyRefunded, OrderRefunded, OrderCancelled, OrderDisputed},
+	OrderFulfilled:         {OrderShipped, OrderPartiallyRefunded, OrderRefunded, OrderDisputed},
+	OrderShipped:           {OrderDelivered, OrderPartiallyRefunded, OrderRefunded, OrderDisputed},
+	OrderDelivered:         {OrderPartiallyRefunded, OrderRefunded, OrderDisputed},
+	OrderPartiallyRefunded: {OrderPartiallyRefunded, OrderRefunded, OrderDisputed},
+	OrderDisputed:          {OrderPaid, OrderRefunded},
+}
+
+// ErrInvalidTransition is returned for a status change the order lifecycle does not
+// allow
+var ErrInvalidTransition = errors.New("invalid order status change")
+
+func (s OrderStatus) String() string {
+	if name, ok := orderStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status %d", int(s))
+}
+
+// CanMoveTo reports whether an order may go from s to another status
+func (s OrderStatus) CanMoveTo(to OrderStatus) bool {
+	for _, next := range orderTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTransition decides what to do about moving an order from one status to
+// another: record the change, do nothing for a move to the status it already has,
+// which is how Stripe redelivering an event looks, or refuse it
+func checkTransition(from, to OrderStatus) (bool, error) {
+	if from.CanMoveTo(to) {
+		return true, nil
+	}
+	if from == to {
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: an order that is %s cannot become %s", ErrInvalidTransition, from, to)
+}
+
+// StatusChange is who changed the status of an order and why. A change with no user
+// came from Stripe.
+type StatusChange struct {
+	UserID int
+	Reason string
+}
+
+// OrderStatusHistory type for one change of the status of an order
+type OrderStatusHistory struct {
+	ID         int         `json:"id"`
+	OrderID    int         `json:"order_id"`
+	FromStatus OrderStatus `json:"from_status_id"`
+	ToStatus   OrderStatus `json:"to_status_id"`
+	From       string      `json:"from"`
+	To         string      `json:"to"`
+	UserID     int         `json:"user_id"`
+	UserName   string      `json:"user_name"`
+	Reason     string      `json:"reason"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+// moveOrder changes the status of an order if its lifecycle allows, and records the
+// change. It locks the order, so it should run in a transaction.
+func (m *DBModel) moveOrder(ctx context.Context, id int, to OrderStatus, c StatusChange) error {
+	var from OrderStatus
+	err := m.DB.QueryRowContext(ctx, `SELECT status_id FROM orders WHERE id = $1 FOR UPDATE`, id).Scan(&from)
+	if err != nil {
+		return err
+	}
+
+	record, err := checkTransition(from, to)
+	if err != nil || !record {
+		return err
+	}
+	return m.recordMove(ctx, id, from, to, c)
+}
+
+// recordMove sets the status of an order the caller has locked and adds the change to
+// its history
+func (m *DBModel) recordMove(ctx context.Context, id int, from, to OrderStatus, c StatusChange) error {
+	now := time.Now()
+	_, err := m.DB.ExecContext(ctx, `
+		UPDATE orders SET status_id = $1, updated_at = $2 WHERE id = $3
+	`, int(to), now, id)
+	if err != nil {
+		return err
+	}
+
+	var userID sql.NullInt64
+	if c.UserID > 0 {
+		userID = sql.NullInt64{Int64: int64(c.UserID), Valid: true}
+	}
+	_, err = m.DB.ExecContext(ctx, `
+		INSERT INTO order_status_history (order_id, from_status_id, to_status_id, user_id, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`, id, int(from), int(to), userID, c.Reason, now)
+	return err
+}
+
+// RestoreDisputedOrdersByPaymentIntent returns every disputed order paid through the
+// given payment intent to the status it had before the dispute, so a won dispute does
+// not undo its fulfilment. An order with no such change in its history goes back to
+// paid. Orders that are not disputed, as after a redelivered event, are left alone.
+func (m *DBModel) RestoreDisputedOrdersByPaymentIntent(pi string, c StatusChange) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *DBModel) error {
+		rows, err := tx.DB.QueryContext(ctx, `
+			SELECT o.id FROM orders o JOIN transactions t ON (o.transaction_id = t.id)
+			WHERE t.payment_intent = $1 AND o.status_id = $2
+			ORDER BY o.id
+			FOR UPDATE OF o
+		`, pi, int(OrderDisputed))
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			before := OrderPaid
+			err := tx.DB.QueryRowContext(ctx, `
+				SELECT from_status_id FROM order_status_history
+				WHERE order_id = $1 AND to_status_id = $2
+				ORDER BY id DESC
+				LIMIT 1
+			`, id, int(OrderDisputed)).Scan(&before)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			if err := tx.recordMove(ctx, id, OrderDisputed, before, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetOrderStatusHistory returns the status changes of an order, oldest first, with
+// the name of the admin who made each
+func (m *DBModel) GetOrderStatusHistory(orderID int) ([]*OrderStatusHistory, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var history []*OrderStatusHistory
+
+	rows, err := m.DB.QueryContext(ctx, `
+		SELECT h.id, h.order_id, h.from_status_id, h.to_status_id, coalesce(h.user_id, 0),
+			coalesce(u.first_name || ' ' || u.last_name, ''), h.reason, h.created_at
+		FROM order_status_history h
+		LEFT JOIN users u ON (h.user_id = u.id)
+		WHERE h.order_id = $1
+		ORDER BY h.id
+	`, orderID)
+	if err != nil {
+		return history, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h OrderStatusHistory
+		err = rows.Scan(
+			&h.ID,
+			&h.OrderID,
+			&h.FromStatus,
+			&h.ToStatus,
+			&h.UserID,
+			&h.UserName,
+			&h.Reason,
+			&h.CreatedAt,
+		)
+		if err != nil {
+			return history, err
+		}
+		h.From, h.To = h.FromStatus.String(), h.ToStatus.String()
+		history = append(history, &h)
+	}
+	return history, rows.Err()
+}
+
+// OrderStatusNames returns the names of the order statuses
+func OrderStatusNames() map[OrderStatus]string {
+	names := make(map[OrderStatus]string, len(orderStatusNames))
+	for s, name := range orderStatusNames {
+		names[s] = name
+	}
+	return names
+}
+
+// OrderStatusesTo returns the statuses an order may move to another status from, in
+// order of id
+func OrderStatusesTo(to OrderStatus) []OrderStatus {
+	var from []OrderStatus
+	for s := OrderPaid; s <= OrderDelivered; s++ {
+		if s.CanMoveTo(to) {
+			from = append(from, s)
+		}
+	}
+	return from
+}
+
+// NextFulfilment returns the fulfilment step that follows each status that has one
+func NextFulfilment() map[OrderStatus]OrderStatus {
+	next := make(map[OrderStatus]OrderStatus)
+	for s := OrderPaid; s <= OrderDelivered; s++ {
+		for _, step := range []OrderStatus{OrderFulfilled, OrderShipped, OrderDelivered} {
+			if s.CanMoveTo(step) {
+				next[s] = step
+				break
+			}
+		}
+	}
+	return next
+}
@@ -0,0 +1,84 @@
+package models
+
+import "testing"
+
+func TestCanMoveTo(t *testing.T) {
+	tests := []struct {
+		from, to OrderStatus
+		want     bool
+	}{
+		{OrderPending, OrderPaid, true},
+		{OrderPending, OrderFulfilled, false},
+		{OrderPaid, OrderFulfilled, true},
+		{OrderPaid, OrderShipped, false},
+		{OrderPaid, OrderPaid, false},
+		{OrderFulfilled, OrderShipped, true},
+		{OrderFulfilled, OrderPaid, false},
+		{OrderShipped, OrderDelivered, true},
+		{OrderDelivered, OrderShipped, false},
+		{OrderDelivered, OrderCancelled, false},
+		{OrderPaid, OrderPartiallyRefunded, true},
+		{OrderPartiallyRefunded, OrderPartiallyRefunded, true},
+		{OrderPartiallyRefunded, OrderFulfilled, false},
+		{OrderShipped, OrderDisputed, true},
+		{OrderDisputed, OrderRefunded, true},
+		{OrderDisputed, OrderPartiallyRefunded, false},
+		{OrderDisputed, OrderShipped, false},
+		{OrderRefunded, OrderPaid, false},
+		{OrderCancelled, OrderPaid, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.from.CanMoveTo(tt.to); got != tt.want {
+			t.Errorf("%s to %s: CanMoveTo = %t, want %t", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestTransitionsKnownStatuses(t *testing.T) {
+	for from, next := range orderTransitions {
+		if _, ok := orderStatusNames[from]; !ok {
+			t.Errorf("transitions from unknown status %d", from)
+		}
+		for _, to := range next {
+			if _, ok := orderStatusNames[to]; !ok {
+				t.Errorf("%s moves to unknown status %d", from, to)
+			}
+		}
+	}
+	for _, done := range []OrderStatus{OrderRefunded, OrderCancelled} {
+		if len(orderTransitions[done]) != 0 {
+			t.Errorf("%s orders are done with but may move to %v", done, orderTransitions[done])
+		}
+	}
+}
+
+func TestRestoreDisputedOrders(t *testing.T) {
+	m := NewMemoryModel()
+	itemID := m.AddItem(Item{Name: "Widget", Price: 100})
+	id, err := m.SaveCheckout(Customer{Email: "jane@example.com"}, Transaction{Amount: 100, PaymentIntent: "pi_1"},
+		Order{StatusID: OrderPaid, Amount: 100}, []OrderItem{{ItemID: itemID, Quantity: 1, UnitPrice: 100, LineTotal: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []OrderStatus{OrderFulfilled, OrderShipped, OrderDisputed} {
+		if err := m.UpdateOrderStatus(id, to, StatusChange{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := m.RestoreDisputedOrdersByPaymentIntent("pi_1", StatusChange{}); err != nil {
+		t.Fatal(err)
+	}
+	order, _ := m.GetOrderByID(id)
+	if order.StatusID != OrderShipped {
+		t.Errorf("restored order is %s, want Shipped", order.StatusID)
+	}
+
+	// a redelivered event finds the order no longer disputed
+	m.RestoreDisputedOrdersByPaymentIntent("pi_1", StatusChange{})
+	history, _ := m.GetOrderStatusHistory(id)
+	if len(history) != 4 {
+		t.Errorf("history has %d changes, want 4", len(history))
+	}
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Coupon type for discount codes. A coupon takes either a percentage or a fixed
+// amount in cents off the subtotal.
+type Coupon struct {
+	ID         int        `json:"id"`
+	Code       string     `json:"code"`
+	PercentOff int        `json:"percent_off"`
+	AmountOff  int        `json:"amount_off"`
+	Active     bool       `json:"active"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedAt  time.Time  `json:"-"`
+	UpdatedAt  time.Time  `json:"-"`
+}
+
+// Quote is the server side price breakdown of an order. All amounts are in cents.
+type Quote struct {
+	Lines      []OrderItem `json:"lines"`
+	Subtotal   int         `json:"subtotal"`
+	Discount   int         `json:"discount"`
+	Tax        int         `json:"tax"`
+	Total      int         `json:"total"`
+	CouponCode string      `json:"coupon_code,omitempty"`
+}
+
+// PriceQuote totals priced order lines, applies an optional coupon and adds tax at
+// taxBasisPoints (825 is 8.25%) on the discounted subtotal, rounding half up
+func PriceQuote(lines []OrderItem, taxBasisPoints int, coupon *Coupon) Quote {
+	q := Quote{Lines: lines}
+	for _, l := range lines {
+		q.Subtotal += l.LineTotal
+	}
+
+	if coupon != nil && coupon.Active {
+		q.CouponCode = coupon.Code
+		if coupon.PercentOff > 0 {
+			q.Discount = (q.Subtotal*coupon.PercentOff + 50) / 100
+		} else {
+			q.Discount = coupon.AmountOff
+		}
+		q.Discount = min(q.Discount, q.Subtotal)
+	}
+
+	taxable := q.Subtotal - q.Discount
+	q.Tax = (taxable*taxBasisPoints + 5000) / 10000
+	q.Total = taxable + q.Tax
+	return q
+}
+
+// Metadata describes the quote as payment intent metadata, so a paid intent can be
+// matched against the order it is used for
+func (q Quote) Metadata() map[string]string {
+	var items []string
+	for _, l := range q.Lines {
+		items = append(items, fmt.Sprintf("%d:%d", l.ItemID, l.Quantity))
+	}
+	return map[string]string{
+		"items":    strings.Join(items, ","),
+		"subtotal": strconv.Itoa(q.Subtotal),
+		"discount": strconv.Itoa(q.Discount),
+		"tax":      strconv.Itoa(q.Tax),
+		"total":    strconv.Itoa(q.Total),
+		"coupon":   q.CouponCode,
+	}
+}
+
+// GetCouponByCode gets an active, unexpired coupon by its code
+func (m *DBModel) GetCouponByCode(code string) (Coupon, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var c Coupon
+
+	row := m.DB.QueryRowContext(ctx, `
+		SELECT id, code, percent_off, amount_off, active, expires_at, created_at, updated_at
+		FROM coupons
+		WHERE code = $1 AND active AND (expires_at IS NULL OR expires_at > $2)
+	`, strings.ToUpper(strings.TrimSpace(code)), time.Now())
+
+	err := row.Scan(
+		&c.ID,
+		&c.Code,
+		&c.PercentOff,
+		&c.AmountOff,
+		&c.Active,
+		&c.ExpiresAt,
+		&c.CreatedAt,
+		&c.UpdatedAt,
+	)
+	if err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// QuoteForLines prices cart lines from the items table and returns the quote for them
+func (m *DBModel) QuoteForLines(cartLines []CartLine, couponCode string, taxBasisPoints int) (Quote, error) {
+	return quoteForLines(m, cartLines, couponCode, taxBasisPoints)
+}
+
+// quoteForLines prices cart lines and looks up the coupon through a pricing store
+func quoteForLines(s PricingStore, cartLines []CartLine, couponCode string, taxBasisPoints int) (Quote, error) {
+	if len(cartLines) == 0 {
+		return Quote{}, errors.New("no items to price")
+	}
+	for _, l := range cartLines {
+		if l.Quantity < 1 {
+			return Quote{}, errors.New("quantity must be at least 1")
+		}
+	}
+
+	lines, err := s.OrderItemsForCart(Cart{Lines: cartLines})
+	if err != nil {
+		return Quote{}, err
+	}
+
+	var coupon *Coupon
+	if couponCode != "" {
+		c, err := s.GetCouponByCode(couponCode)
+		if err != nil {
+			return Quote{}, errors.New("invalid coupon code")
+		}
+		coupon = &c
+	}
+
+	return PriceQuote(lines, taxBasisPoints, coupon), nil
+}
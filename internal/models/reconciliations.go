@@ -0,0 +1,159 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Kinds of reconciliation
+const (
+	ReconcileCharge = "charge"
+	ReconcileRefund = "refund"
+)
+
+// Reconciliation type for payments the gateway took, or refunds it made, that the
+// database did not record. Each row needs someone to record the order or refund by
+// hand, or to undo it at the gateway. Kind says which of the two it is; Amount is
+// always what moved, whichever way it went.
+type Reconciliation struct {
+	ID             int        `json:"id"`
+	Kind           string     `json:"kind"`
+	StripeRefundID string     `json:"stripe_refund_id,omitempty"`
+	PaymentIntent  string     `json:"payment_intent"`
+	PaymentMethod  string     `json:"payment_method"`
+	Amount         int        `json:"amount"`
+	Currency       string     `json:"currency"`
+	Email          string     `json:"email"`
+	Reason         string     `json:"reason"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"-"`
+}
+
+// InsertReconciliation records a charge or refund that needs reconciliation and returns its id
+func (m *DBModel) InsertReconciliation(r Reconciliation) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var id int
+	query := `
+		INSERT INTO reconciliations
+		(kind, stripe_refund_id, payment_intent, payment_method, amount, currency, email, reason, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id
+	`
+
+	err := m.DB.QueryRowContext(ctx, query,
+		r.Kind,
+		r.StripeRefundID,
+		r.PaymentIntent,
+		r.PaymentMethod,
+		r.Amount,
+		r.Currency,
+		r.Email,
+		r.Reason,
+		time.Now(),
+		time.Now(),
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetUnresolvedReconciliations returns the charges and refunds still waiting to be reconciled, oldest first
+func (m *DBModel) GetUnresolvedReconciliations() ([]*Reconciliation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var recs []*Reconciliation
+
+	rows, err := m.DB.QueryContext(ctx, `
+		SELECT id, kind, stripe_refund_id, payment_intent, payment_method, amount, currency, email, reason, created_at, updated_at
+		FROM reconciliations
+		WHERE resolved_at IS NULL
+		ORDER BY created_at
+	`)
+	if err != nil {
+		return recs, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Reconciliation
+		err = rows.Scan(
+			&r.ID,
+			&r.Kind,
+			&r.StripeRefundID,
+			&r.PaymentIntent,
+			&r.PaymentMethod,
+			&r.Amount,
+			&r.Currency,
+			&r.Email,
+			&r.Reason,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return recs, err
+		}
+		recs = append(recs, &r)
+	}
+	return recs, rows.Err()
+}
+
+// ResolveReconciliation marks a reconciliation as handled
+func (m *DBModel) ResolveReconciliation(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `
+		UPDATE reconciliations SET resolved_at = $1, updated_at = $1 WHERE id = $2
+	`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SaveChargedCheckout saves the customer, transaction and order of a checkout whose
+// card has already been charged, in one database transaction, and returns the order
+// id. A failed save is recorded for reconciliation, unless the payment intent already
+// paid for another order, when there is nothing to reconcile.
+func SaveChargedCheckout(repo Repository, c Customer, txn Transaction, order Order, lines []OrderItem) (int, error) {
+	id, err := repo.SaveCheckout(c, txn, order, lines)
+	if err != nil && !errors.Is(err, ErrPaymentIntentUsed) {
+		return 0, errors.Join(err, RecordUnsavedCharge(repo, txn, c.Email, err))
+	}
+	return id, err
+}
+
+// SaveChargedTransaction saves a transaction whose card has already been charged and
+// returns its id, recording a failed save for reconciliation as SaveChargedCheckout does
+func SaveChargedTransaction(repo Repository, txn Transaction, email string) (int, error) {
+	id, err := repo.InsertTransaction(txn)
+	if err != nil && !errors.Is(err, ErrPaymentIntentUsed) {
+		return 0, errors.Join(err, RecordUnsavedCharge(repo, txn, email, err))
+	}
+	return id, err
+}
+
+// RecordUnsavedCharge records a charge the gateway took but the database did not, for
+// cause
+func RecordUnsavedCharge(repo ReconciliationStore, txn Transaction, email string, cause error) error {
+	_, err := repo.InsertReconciliation(Reconciliation{
+		Kind:          ReconcileCharge,
+		PaymentIntent: txn.PaymentIntent,
+		PaymentMethod: txn.PaymentMethod,
+		Amount:        txn.Amount,
+		Currency:      txn.Currency,
+		Email:         email,
+		Reason:        cause.Error(),
+	})
+	if err != nil {
+		return fmt.Errorf("could not record payment intent %s for reconciliation: %w", txn.PaymentIntent, err)
+	}
+	return nil
+}
@@ -0,0 +1,249 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Refund type for money given back on an order, all or part of what was paid
+type Refund struct {
+	ID             int       `json:"id"`
+	OrderID        int       `json:"order_id"`
+	TransactionID  int       `json:"transaction_id"`
+	Amount         int       `json:"amount"`
+	Currency       string    `json:"currency"`
+	Reason         string    `json:"reason"`
+	StripeRefundID string    `json:"stripe_refund_id"`
+	UserID         int       `json:"user_id"`
+	UserName       string    `json:"user_name"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"-"`
+}
+
+// SaveRefund records a refund made with the payment gateway and, in the same
+// transaction, moves the order to refunded once its refunds add up to what was paid,
+// or to partially refunded before then. It returns the status the order was moved to.
+func (m *DBModel) SaveRefund(r Refund) (OrderStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var status OrderStatus
+	err := m.WithTx(ctx, func(tx *DBModel) error {
+		// lock the order so refunds made at the same time see each other
+		var paid int
+		err := tx.DB.QueryRowContext(ctx, `
+			SELECT t.amount FROM orders o JOIN transactions t ON (o.transaction_id = t.id)
+			WHERE o.id = $1 FOR UPDATE OF o
+		`, r.OrderID).Scan(&paid)
+		if err != nil {
+			return err
+		}
+
+		inserted, err := tx.insertRefund(ctx, r)
+		if err != nil {
+			return err
+		}
+
+		refunded, err := tx.refundedAmount(ctx, r.OrderID)
+		if err != nil {
+			return err
+		}
+
+		status = OrderPartiallyRefunded
+		if refunded >= paid {
+			status = OrderRefunded
+		}
+		if !inserted {
+			// the charge.refunded webhook got here first and has moved the order
+			return nil
+		}
+		return tx.moveOrder(ctx, r.OrderID, status, refundStatusChange(r))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return status, nil
+}
+
+// SaveGatewayRefunds records the refunds Stripe reports for a payment intent that are
+// not recorded yet, such as ones made in the Stripe dashboard. refunded is the total
+// Stripe has refunded; whatever the listed refunds leave unaccounted for is recorded
+// as one refund without a Stripe id, since events only list refunds for older API
+// versions. In the same transaction the order is moved as SaveRefund moves it and,
+// once it is fully refunded, its transaction is given the status txnStatusID.
+func (m *DBModel) SaveGatewayRefunds(pi string, refunded int, refunds []Refund, txnStatusID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *DBModel) error {
+		var orderID, txnID, paid int
+		var currency string
+		err := tx.DB.QueryRowContext(ctx, `
+			SELECT o.id, t.id, t.amount, t.currency
+			FROM orders o JOIN transactions t ON (o.transaction_id = t.id)
+			WHERE t.payment_intent = $1
+			ORDER BY o.id LIMIT 1
+			FOR UPDATE OF o
+		`, pi).Scan(&orderID, &txnID, &paid, &currency)
+		if errors.Is(err, sql.ErrNoRows) {
+			// not a payment this store took
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		recorded, err := tx.refundedAmount(ctx, orderID)
+		if err != nil {
+			return err
+		}
+		var saved []Refund
+		for _, r := range refunds {
+			r.OrderID, r.TransactionID = orderID, txnID
+			inserted, err := tx.insertRefund(ctx, r)
+			if err != nil {
+				return err
+			}
+			if inserted {
+				recorded += r.Amount
+				saved = append(saved, r)
+			}
+		}
+		if recorded < refunded {
+			r := unlistedRefund(orderID, txnID, refunded-recorded, currency)
+			if _, err := tx.insertRefund(ctx, r); err != nil {
+				return err
+			}
+			recorded += r.Amount
+			saved = append(saved, r)
+		}
+		if len(saved) == 0 {
+			return nil
+		}
+
+		status := OrderPartiallyRefunded
+		if recorded >= paid {
+			status = OrderRefunded
+			_, err = tx.DB.ExecContext(ctx, `
+				UPDATE transactions SET transaction_status_id = $1, updated_at = $2 WHERE id = $3
+			`, txnStatusID, time.Now(), txnID)
+			if err != nil {
+				return err
+			}
+		}
+		for _, r := range saved {
+			if err := tx.moveOrder(ctx, orderID, status, refundStatusChange(r)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// insertRefund adds a refund unless one with its Stripe id is recorded already, and
+// reports whether it did
+func (m *DBModel) insertRefund(ctx context.Context, r Refund) (bool, error) {
+	var userID sql.NullInt64
+	if r.UserID > 0 {
+		userID = sql.NullInt64{Int64: int64(r.UserID), Valid: true}
+	}
+	res, err := m.DB.ExecContext(ctx, `
+		INSERT INTO refunds
+			(order_id, transaction_id, amount, currency, reason, stripe_refund_id, user_id, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		ON CONFLICT (stripe_refund_id) WHERE stripe_refund_id <> '' DO NOTHING`,
+		r.OrderID,
+		r.TransactionID,
+		r.Amount,
+		r.Currency,
+		r.Reason,
+		r.StripeRefundID,
+		userID,
+		time.Now(),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// refundedAmount is the sum of the refunds of an order
+func (m *DBModel) refundedAmount(ctx context.Context, orderID int) (int, error) {
+	var refunded int
+	err := m.DB.QueryRowContext(ctx, `
+		SELECT coalesce(sum(amount), 0) FROM refunds WHERE order_id = $1
+	`, orderID).Scan(&refunded)
+	return refunded, err
+}
+
+// GetRefundsForOrder returns the refunds of an order, newest first, with the name of
+// the admin who made each
+func (m *DBModel) GetRefundsForOrder(orderID int) ([]*Refund, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var refunds []*Refund
+
+	rows, err := m.DB.QueryContext(ctx, `
+		SELECT r.id, r.order_id, r.transaction_id, r.amount, r.currency, r.reason, r.stripe_refund_id,
+			coalesce(r.user_id, 0), coalesce(u.first_name || ' ' || u.last_name, ''), r.created_at, r.updated_at
+		FROM refunds r
+		LEFT JOIN users u ON (r.user_id = u.id)
+		WHERE r.order_id = $1
+		ORDER BY r.id DESC
+	`, orderID)
+	if err != nil {
+		return refunds, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r Refund
+		err = rows.Scan(
+			&r.ID,
+			&r.OrderID,
+			&r.TransactionID,
+			&r.Amount,
+			&r.Currency,
+			&r.Reason,
+			&r.StripeRefundID,
+			&r.UserID,
+			&r.UserName,
+			&r.CreatedAt,
+			&r.UpdatedAt,
+		)
+		if err != nil {
+			return refunds, err
+		}
+		refunds = append(refunds, &r)
+	}
+	return refunds, rows.Err()
+}
+
+// unlistedRefund is a refund Stripe reports in its total but not one by one
+func unlistedRefund(orderID, txnID, amount int, currency string) Refund {
+	return Refund{
+		OrderID:       orderID,
+		TransactionID: txnID,
+		Amount:        amount,
+		Currency:      currency,
+		Reason:        "Refunded in Stripe",
+	}
+}
+
+// refundStatusChange is the status change a refund makes
+func refundStatusChange(r Refund) StatusChange {
+	reason := fmt.Sprintf("Refund of %d.%02d %s", r.Amount/100, r.Amount%100, strings.ToUpper(r.Currency))
+	if r.Reason != "" {
+		reason += ": " + r.Reason
+	}
+	return StatusChange{UserID: r.UserID, Reason: reason}
+}
@@ -0,0 +1,175 @@
+package models
+
+import "time"
+
+// ItemStore reads the product catalogue
+type ItemStore interface {
+	GetItem(id int) (Item, error)
+}
+
+// CustomerStore saves customers
+type CustomerStore interface {
+	InsertCustomer(c Customer) (int, error)
+}
+
+// TransactionStore saves transactions and tracks their status
+type TransactionStore interface {
+	InsertTransaction(txn Transaction) (int, error)
+	UpdateTransactionStatusByPaymentIntent(pi string, statusID int) error
+}
+
+// OrderStore saves and reads orders and their lines
+type OrderStore interface {
+	InsertOrder(order Order) (int, error)
+	InsertOrderWithItems(order Order, items []OrderItem) (int, error)
+	SaveCheckout(c Customer, txn Transaction, order Order, items []OrderItem) (int, error)
+	GetOrderItems(orderIDs ...int) (map[int][]OrderItem, error)
+	GetAllOrders(recurring bool) ([]*Order, error)
+	GetAllOrdersPaginated(recurring bool, pageSize, page int) ([]*Order, int, int, error)
+	GetOrderByID(id int) (Order, error)
+	UpdateOrderStatus(id int, to OrderStatus, c StatusChange) error
+	UpdateOrderStatusByPaymentIntent(pi string, to OrderStatus, c StatusChange) error
+	RestoreDisputedOrdersByPaymentIntent(pi string, c StatusChange) error
+	GetOrderStatusHistory(orderID int) ([]*OrderStatusHistory, error)
+}
+
+// RefundStore records refunds and keeps the status of their orders in step
+type RefundStore interface {
+	SaveRefund(r Refund) (OrderStatus, error)
+	SaveGatewayRefunds(pi string, refunded int, refunds []Refund, txnStatusID int) error
+	GetRefundsForOrder(orderID int) ([]*Refund, error)
+}
+
+// DashboardStore sums up recent sales for the admin dashboard
+type DashboardStore interface {
+	GetDashboardStats(since time.Time) (DashboardStats, error)
+}
+
+// UserStore manages admin users and their passwords
+type UserStore interface {
+	GetUserByEmail(email string) (User, error)
+	Authenticate(email, password string) (int, error)
+	UpdatePasswordForUser(u User, hash string) error
+	GetAllUsers() ([]*User, error)
+	GetOneUser(id int) (User, error)
+	EditUser(u User) error
+	AddUser(u User, hash string) error
+	DeleteUser(id int) error
+}
+
+// TokenStore saves api tokens, resolves them to users and revokes them
+type TokenStore interface {
+	InsertToken(t *Token, u User) error
+	GetUserForToken(token string) (*User, *Token, error)
+	GetTokensForUser(userID int) ([]*Token, error)
+	RevokeToken(userID, tokenID int) error
+	RevokeAllTokens(userID int) (int, error)
+}
+
+// TwoFactorStore keeps users' authenticator secrets and recovery codes
+type TwoFactorStore interface {
+	GetTwoFactor(userID int) (TwoFactor, error)
+	SetTwoFactorSecret(userID int, secret string) error
+	EnableTwoFactor(userID int, recoveryHashes [][]byte) error
+	ReplaceRecoveryCodes(userID int, recoveryHashes [][]byte) error
+	UseTOTPCounter(userID int, counter int64) (bool, error)
+	UseRecoveryCode(userID int, hash []byte) (bool, error)
+	ResetTwoFactor(userID int) error
+}
+
+// ThrottleStore counts failed logins and password resets and locks them out
+type ThrottleStore interface {
+	LockedUntil(keys ...ThrottleKey) (time.Time, error)
+	RecordFailure(key ThrottleKey, p LockoutPolicy) (LoginAttempt, error)
+	ClearFailures(key ThrottleKey) error
+}
+
+// CartStore saves shopping carts by token
+type CartStore interface {
+	SaveCart(c Cart) error
+	GetCart(token string) (Cart, error)
+	DeleteCart(token string) error
+}
+
+// PricingStore prices cart lines and looks up coupons
+type PricingStore interface {
+	ItemStore
+	GetCouponByCode(code string) (Coupon, error)
+	OrderItemsForCart(c Cart) ([]OrderItem, error)
+	QuoteForLines(cartLines []CartLine, couponCode string, taxBasisPoints int) (Quote, error)
+}
+
+// WebhookStore records webhook events received from the payment provider
+type WebhookStore interface {
+	InsertWebhookEvent(e WebhookEvent) (bool, error)
+	MarkWebhookEventProcessed(eventID, errMsg string) error
+}
+
+// IdempotencyStore reserves idempotency keys and stores their responses
+type IdempotencyStore interface {
+	ReserveIdempotencyKey(k IdempotencyKey) (IdempotencyKey, bool, error)
+	SaveIdempotentResponse(k IdempotencyKey, statusCode int, body []byte) error
+	ReleaseIdempotencyKey(k IdempotencyKey) error
+}
+
+// ReconciliationStore records charges that need reconciling by hand
+type ReconciliationStore interface {
+	InsertReconciliation(r Reconciliation) (int, error)
+	GetUnresolvedReconciliations() ([]*Reconciliation, error)
+	ResolveReconciliation(id int) error
+}
+
+// JobStore queues background jobs and hands them out to workers
+type JobStore interface {
+	EnqueueJob(j Job) (int, error)
+	ClaimJob(kind string, lease time.Duration) (Job, error)
+	CompleteJob(j Job) error
+	FailJob(j Job, errMsg string, retryAt time.Time) (string, error)
+	GetJobs(status string) ([]*Job, error)
+	RetryJob(id int) error
+}
+
+// InvoiceStore numbers and records the invoices sent for orders
+type InvoiceStore interface {
+	IssueInvoice(inv Invoice, n InvoiceNumbering) (Invoice, error)
+	MarkInvoiceSent(id int) error
+	ClaimInvoiceResend(id, seen int) (bool, error)
+	SetInvoiceChecksum(id int, checksum string) error
+	GetInvoicesForOrder(orderID int) ([]*Invoice, error)
+	GetInvoiceByNumber(number string) (Invoice, error)
+}
+
+// CreditNoteStore numbers and records the credit notes issued for refunds
+type CreditNoteStore interface {
+	IssueCreditNote(cn CreditNote, n InvoiceNumbering) (CreditNote, error)
+	MarkCreditNoteSent(id int) error
+	SetCreditNoteChecksum(id int, checksum string) error
+	GetCreditNotesForOrder(orderID int) ([]*CreditNote, error)
+}
+
+// Repository is everything the web and api applications need from storage. DBModel
+// implements it on Postgres and MemoryModel in memory.
+type Repository interface {
+	CustomerStore
+	TransactionStore
+	OrderStore
+	RefundStore
+	DashboardStore
+	UserStore
+	TokenStore
+	TwoFactorStore
+	ThrottleStore
+	CartStore
+	PricingStore
+	WebhookStore
+	IdempotencyStore
+	ReconciliationStore
+	JobStore
+	InvoiceStore
+	CreditNoteStore
+}
+
+var (
+	_ Repository = (*DBModel)(nil)
+	_ Repository = (*MemoryModel)(nil)
+)
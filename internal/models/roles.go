@@ -0,0 +1,65 @@
+package models
+
+// Roles an admin user can have
+const (
+	RoleOwner    = "owner"
+	RoleFinance  = "finance"
+	RoleSupport  = "support"
+	RoleReadOnly = "read-only"
+)
+
+// Permissions checked by the api routes and web pages
+const (
+	PermViewSales          = "sales:view"
+	PermChargeCards        = "sales:charge"
+	PermRefund             = "sales:refund"
+	PermCancelSubscription = "subscriptions:cancel"
+	PermViewUsers          = "users:view"
+	PermManageUsers        = "users:manage"
+	PermManageJobs         = "jobs:manage"
+	PermSendInvoices       = "invoices:send"
+	PermFulfilOrders       = "sales:fulfil"
+)
+
+// rolePermissions lists what each role may do. A role not listed here may do nothing.
+var rolePermissions = map[string][]string{
+	RoleOwner: {
+		PermViewSales, PermChargeCards, PermRefund, PermCancelSubscription,
+		PermViewUsers, PermManageUsers, PermManageJobs, PermSendInvoices, PermFulfilOrders,
+	},
+	RoleFinance: {
+		PermViewSales, PermChargeCards, PermRefund, PermCancelSubscription, PermManageJobs, PermSendInvoices,
+	},
+	RoleSupport: {
+		PermViewSales, PermCancelSubscription, PermViewUsers, PermSendInvoices, PermFulfilOrders,
+	},
+	RoleReadOnly: {
+		PermViewSales,
+	},
+}
+
+// Roles returns every role, most privileged first
+func Roles() []string {
+	return []string{RoleOwner, RoleFinance, RoleSupport, RoleReadOnly}
+}
+
+// ValidRole reports whether role is a known role
+func ValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// RoleCan reports whether role grants permission
+func RoleCan(role, permission string) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the user's role grants permission
+func (u User) Can(permission string) bool {
+	return RoleCan(u.Role, permission)
+}
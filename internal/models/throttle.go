@@ -0,0 +1,156 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Kinds of login attempt counters
+const (
+	ThrottleAccount      = "account"
+	ThrottleIP           = "ip"
+	ThrottleResetAccount = "reset-account"
+	ThrottleResetIP      = "reset-ip"
+)
+
+// ThrottleKey names one attempt counter, such as the failed logins for an email
+type ThrottleKey struct {
+	Kind string
+	Key  string
+}
+
+// AccountKey is the counter of failed logins for an email
+func AccountKey(email string) ThrottleKey {
+	return ThrottleKey{Kind: ThrottleAccount, Key: strings.ToLower(strings.TrimSpace(email))}
+}
+
+// IPKey is the counter of failed logins from an address
+func IPKey(ip string) ThrottleKey {
+	return ThrottleKey{Kind: ThrottleIP, Key: ip}
+}
+
+// LockoutPolicy decides how long a counter is locked after each failure. Below
+// MaxFailures each failure doubles the wait from BaseDelay up to MaxDelay; at
+// MaxFailures the counter is locked for Lockout. Failures older than Window are forgotten.
+type LockoutPolicy struct {
+	MaxFailures int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Lockout     time.Duration
+	Window      time.Duration
+}
+
+// Lockout policies for login and password reset counters
+var (
+	AccountPolicy = LockoutPolicy{MaxFailures: 5, BaseDelay: time.Second, MaxDelay: 30 * time.Second, Lockout: 15 * time.Minute, Window: 15 * time.Minute}
+	IPPolicy      = LockoutPolicy{MaxFailures: 20, BaseDelay: 0, MaxDelay: 0, Lockout: 15 * time.Minute, Window: 15 * time.Minute}
+	ResetPolicy   = LockoutPolicy{MaxFailures: 5, BaseDelay: 0, MaxDelay: 0, Lockout: time.Hour, Window: time.Hour}
+)
+
+// LoginAttempt type for one attempt counter
+type LoginAttempt struct {
+	ThrottleKey
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+// fail counts one more failure at now and locks the counter as the policy says
+func (p LockoutPolicy) fail(a LoginAttempt, now time.Time) LoginAttempt {
+	if now.Sub(a.LastFailureAt) > p.Window {
+		a.Failures = 0
+	}
+	a.Failures++
+	a.LastFailureAt = now
+
+	var wait time.Duration
+	if a.Failures >= p.MaxFailures {
+		wait = p.Lockout
+	} else if p.BaseDelay > 0 {
+		wait = p.BaseDelay << (a.Failures - 1)
+		if wait > p.MaxDelay || wait <= 0 {
+			wait = p.MaxDelay
+		}
+	}
+
+	a.LockedUntil = nil
+	if wait > 0 {
+		until := now.Add(wait)
+		a.LockedUntil = &until
+	}
+	return a
+}
+
+// LockedUntil returns the latest time any of keys is locked until, or the zero time
+// if none of them is locked
+func (m *DBModel) LockedUntil(keys ...ThrottleKey) (time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var until time.Time
+	for _, k := range keys {
+		var lockedUntil sql.NullTime
+		err := m.DB.QueryRowContext(ctx, `
+			SELECT locked_until FROM login_attempts
+			WHERE kind = $1 AND key = $2 AND locked_until > $3
+		`, k.Kind, k.Key, time.Now()).Scan(&lockedUntil)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return until, err
+		}
+		if lockedUntil.Time.After(until) {
+			until = lockedUntil.Time
+		}
+	}
+	return until, nil
+}
+
+// RecordFailure counts a failed attempt against key and returns the counter after it
+func (m *DBModel) RecordFailure(key ThrottleKey, p LockoutPolicy) (LoginAttempt, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	a := LoginAttempt{ThrottleKey: key}
+	err := m.WithTx(ctx, func(tx *DBModel) error {
+		// make sure the row exists so it can be locked while we count
+		_, err := tx.DB.ExecContext(ctx, `
+			INSERT INTO login_attempts (kind, key, failures, last_failure_at)
+			VALUES ($1, $2, 0, $3)
+			ON CONFLICT (kind, key) DO NOTHING
+		`, key.Kind, key.Key, time.Now())
+		if err != nil {
+			return err
+		}
+
+		err = tx.DB.QueryRowContext(ctx, `
+			SELECT failures, last_failure_at FROM login_attempts
+			WHERE kind = $1 AND key = $2
+			FOR UPDATE
+		`, key.Kind, key.Key).Scan(&a.Failures, &a.LastFailureAt)
+		if err != nil {
+			return err
+		}
+
+		a = p.fail(a, time.Now())
+		_, err = tx.DB.ExecContext(ctx, `
+			UPDATE login_attempts SET failures = $1, last_failure_at = $2, locked_until = $3
+			WHERE kind = $4 AND key = $5
+		`, a.Failures, a.LastFailureAt, a.LockedUntil, key.Kind, key.Key)
+		return err
+	})
+	return a, err
+}
+
+// ClearFailures forgets the failed attempts counted against key
+func (m *DBModel) ClearFailures(key ThrottleKey) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM login_attempts WHERE kind = $1 AND key = $2`, key.Kind, key.Key)
+	return err
+}
@@ -4,22 +4,37 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"database/sql"
 	"encoding/base32"
 	"log"
+	"strings"
 	"time"
 )
 
 const (
 	ScopeAuthentication = "authentication"
+	ScopeAPIKey         = "api-key"
 )
 
-// Token is the type for authentication
+// Token is the type for authentication. A user can hold many tokens at once, one per
+// device or login, and revoke each of them. Api keys are tokens with the api-key scope
+// and a list of Scopes; a zero Expiry means the key never expires. SecondFactor is set
+// on session tokens issued after the user's second factor was checked.
 type Token struct {
-	PlainText string    `json:"token"`
-	UserID    int64     `json:"-"`
-	Hash      []byte    `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	ID           int        `json:"id,omitempty"`
+	PlainText    string     `json:"token,omitempty"`
+	UserID       int64      `json:"-"`
+	Hash         []byte     `json:"-"`
+	Expiry       time.Time  `json:"expiry"`
+	Scope        string     `json:"scope"`
+	Scopes       []string   `json:"scopes,omitempty"`
+	SecondFactor bool       `json:"second_factor,omitempty"`
+	Name         string     `json:"name,omitempty"`
+	IP           string     `json:"ip,omitempty"`
+	UserAgent    string     `json:"user_agent,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
 }
 
 // GenerateToken generates a token to that last for ttl duration and returns token
@@ -41,30 +56,38 @@ func GenerateToken(userID int, ttl time.Duration, scope string) (*Token, error)
 	return token, nil
 }
 
+// InsertToken saves a new token for the user alongside any tokens they already have
 func (m *DBModel) InsertToken(t *Token, u User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	// delete existing tokens
-	stmt := `DELETE FROM tokens WHERE user_id = $1`
-	_, err := m.DB.ExecContext(ctx, stmt, u.ID)
-	if err != nil {
-		return err
-	}
+	stmt := `INSERT INTO tokens (user_id, name, email, token_hash, expiry, scope, scopes, second_factor, ip, user_agent, created_at, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+			RETURNING id`
 
-	stmt = `INSERT INTO tokens (user_id, name, email, token_hash, expiry, created_at, updated_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	var expiry sql.NullTime
+	if !t.Expiry.IsZero() {
+		expiry = sql.NullTime{Time: t.Expiry, Valid: true}
+	}
+	if t.Scope == "" {
+		t.Scope = ScopeAuthentication
+	}
 
-	_, err = m.DB.ExecContext(ctx, stmt,
+	t.CreatedAt = time.Now()
+	err := m.DB.QueryRowContext(ctx, stmt,
 		u.ID,
-		u.LastName,
+		t.Name,
 		u.Email,
 		t.Hash,
-		t.Expiry,
-		time.Now(),
-		time.Now(),
-	)
-
+		expiry,
+		t.Scope,
+		strings.Join(t.Scopes, " "),
+		t.SecondFactor,
+		t.IP,
+		t.UserAgent,
+		t.CreatedAt,
+		t.CreatedAt,
+	).Scan(&t.ID)
 	if err != nil {
 		return err
 	}
@@ -72,19 +95,31 @@ func (m *DBModel) InsertToken(t *Token, u User) error {
 	return nil
 }
 
-func (m *DBModel) GetUserForToken(token string) (*User, error) {
+// GetUserForToken returns the user a token belongs to and the token itself, without
+// its hash
+func (m *DBModel) GetUserForToken(token string) (*User, *Token, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
 	tokenHash := sha256.Sum256([]byte(token))
 	var user User
-
-	query := `SELECT u.id, u.first_name, u.last_name, u.email 
-			FROM users u 
-			INNER JOIN tokens t 
+	var t Token
+	var expiry sql.NullTime
+	var scopes string
+
+	// find the token and record its use in one statement
+	query := `WITH t AS (
+				UPDATE tokens SET last_used_at = $2
+				WHERE token_hash = $1
+				AND (expiry IS NULL OR expiry > $2)
+				AND revoked_at IS NULL
+				RETURNING id, user_id, name, expiry, scope, scopes, second_factor, created_at, last_used_at
+			)
+			SELECT u.id, u.first_name, u.last_name, u.email, u.role,
+				t.id, t.name, t.expiry, t.scope, t.scopes, t.second_factor, t.created_at, t.last_used_at
+			FROM users u
+			INNER JOIN t
 			ON (u.id = t.user_id)
-			WHERE t.token_hash = $1
-			AND t.expiry > $2
 			`
 
 	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], time.Now()).Scan(
@@ -92,11 +127,112 @@ func (m *DBModel) GetUserForToken(token string) (*User, error) {
 		&user.FirstName,
 		&user.LastName,
 		&user.Email,
+		&user.Role,
+		&t.ID,
+		&t.Name,
+		&expiry,
+		&t.Scope,
+		&scopes,
+		&t.SecondFactor,
+		&t.CreatedAt,
+		&t.LastUsedAt,
 	)
 	if err != nil {
 		log.Println(err)
+		return nil, nil, err
+	}
+	t.UserID = int64(user.ID)
+	t.Expiry = expiry.Time
+	t.Scopes = strings.Fields(scopes)
+
+	return &user, &t, nil
+}
+
+// GetTokensForUser returns the unexpired, unrevoked tokens and api keys of a user,
+// newest first
+func (m *DBModel) GetTokensForUser(userID int) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var tokens []*Token
+
+	query := `SELECT id, user_id, name, expiry, scope, scopes, ip, user_agent, created_at, last_used_at
+			FROM tokens
+			WHERE user_id = $1
+			AND (expiry IS NULL OR expiry > $2)
+			AND revoked_at IS NULL
+			ORDER BY created_at DESC`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, time.Now())
+	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Token
+		var expiry sql.NullTime
+		var scopes string
+		err = rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.Name,
+			&expiry,
+			&t.Scope,
+			&scopes,
+			&t.IP,
+			&t.UserAgent,
+			&t.CreatedAt,
+			&t.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		t.Expiry = expiry.Time
+		t.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, &t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeToken revokes one of a user's tokens. It returns sql.ErrNoRows if the user
+// has no such active token.
+func (m *DBModel) RevokeToken(userID, tokenID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE tokens SET revoked_at = $1, updated_at = $1
+			WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`
+
+	res, err := m.DB.ExecContext(ctx, stmt, time.Now(), tokenID, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeAllTokens revokes every active token and api key of a user and returns how many it revoked
+func (m *DBModel) RevokeAllTokens(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
-	return &user, nil
+	stmt := `UPDATE tokens SET revoked_at = $1, updated_at = $1
+			WHERE user_id = $2 AND revoked_at IS NULL`
+
+	res, err := m.DB.ExecContext(ctx, stmt, time.Now(), userID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
 }
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+// ScopeTwoFactor is the scope of the short-lived challenge token handed out after a
+// correct password when the user still has to give their second factor
+const ScopeTwoFactor = "two-factor"
+
+// RecoveryCodeCount is how many recovery codes a user gets at a time
+const RecoveryCodeCount = 10
+
+// TwoFactor type for a user's authenticator enrollment. Secret is encrypted and
+// LastCounter is the last time step a code was accepted for, so no code works twice.
+type TwoFactor struct {
+	UserID      int
+	Secret      string
+	Enabled     bool
+	LastCounter int64
+}
+
+// GenerateRecoveryCodes returns n one-time recovery codes and their hashes
+func GenerateRecoveryCodes(n int) ([]string, [][]byte, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, 0, n)
+	hashes := make([][]byte, 0, n)
+	for i := 0; i < n; i++ {
+		b := make([]byte, 6)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		s := strings.ToLower(enc.EncodeToString(b))
+		code := s[:5] + "-" + s[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, HashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode hashes a recovery code, ignoring case, spaces and dashes
+func HashRecoveryCode(code string) []byte {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// GetTwoFactor returns a user's authenticator enrollment
+func (m *DBModel) GetTwoFactor(userID int) (TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tf := TwoFactor{UserID: userID}
+	row := m.DB.QueryRowContext(ctx, `
+		SELECT totp_secret, totp_enabled, totp_last_counter
+		FROM users
+		WHERE id = $1
+	`, userID)
+
+	err := row.Scan(&tf.Secret, &tf.Enabled, &tf.LastCounter)
+	if err != nil {
+		return tf, err
+	}
+	return tf, nil
+}
+
+// SetTwoFactorSecret stores a new, not yet enabled, encrypted secret for a user
+func (m *DBModel) SetTwoFactorSecret(userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE users SET totp_secret = $1, totp_enabled = false, totp_last_counter = 0, updated_at = $2
+			WHERE id = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, secret, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// EnableTwoFactor turns on the user's second factor and replaces their recovery codes
+func (m *DBModel) EnableTwoFactor(userID int, recoveryHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *DBModel) error {
+		_, err := tx.DB.ExecContext(ctx,
+			`UPDATE users SET totp_enabled = true, updated_at = $1 WHERE id = $2`, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+		return tx.replaceRecoveryCodes(ctx, userID, recoveryHashes)
+	})
+}
+
+// ReplaceRecoveryCodes throws away a user's recovery codes and stores new ones
+func (m *DBModel) ReplaceRecoveryCodes(userID int, recoveryHashes [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *DBModel) error {
+		return tx.replaceRecoveryCodes(ctx, userID, recoveryHashes)
+	})
+}
+
+func (m *DBModel) replaceRecoveryCodes(ctx context.Context, userID int, recoveryHashes [][]byte) error {
+	_, err := m.DB.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+	for _, hash := range recoveryHashes {
+		_, err = m.DB.ExecContext(ctx,
+			`INSERT INTO recovery_codes (user_id, code_hash, created_at) VALUES ($1, $2, $3)`,
+			userID, hash, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseTOTPCounter records that a code for time step counter was accepted. It reports
+// false if a code for that step or a later one was already accepted.
+func (m *DBModel) UseTOTPCounter(userID int, counter int64) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE users SET totp_last_counter = $1
+			WHERE id = $2 AND totp_last_counter < $1`
+
+	res, err := m.DB.ExecContext(ctx, stmt, counter, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// UseRecoveryCode marks one of the user's unused recovery codes as used. It reports
+// false if the user has no unused code with that hash.
+func (m *DBModel) UseRecoveryCode(userID int, hash []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE recovery_codes SET used_at = $1
+			WHERE id = (
+				SELECT id FROM recovery_codes
+				WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL
+				LIMIT 1
+			)`
+
+	res, err := m.DB.ExecContext(ctx, stmt, time.Now(), userID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// ResetTwoFactor turns off the user's second factor and deletes their secret and
+// recovery codes
+func (m *DBModel) ResetTwoFactor(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.WithTx(ctx, func(tx *DBModel) error {
+		_, err := tx.DB.ExecContext(ctx, `
+			UPDATE users SET totp_secret = '', totp_enabled = false, totp_last_counter = 0, updated_at = $1
+			WHERE id = $2`, time.Now(), userID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.DB.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = $1`, userID)
+		return err
+	})
+}
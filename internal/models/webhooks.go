@@ -0,0 +1,147 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// WebhookEvent is the type for raw events received from the payment provider
+type WebhookEvent struct {
+	ID          int        `json:"id"`
+	EventID     string     `json:"event_id"`
+	EventType   string     `json:"event_type"`
+	Payload     []byte     `json:"-"`
+	Error       string     `json:"error,omitempty"`
+	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+	ClaimedAt   time.Time  `json:"claimed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// WebhookLease is how long a delivery of a webhook event has to process it before a
+// redelivery may take it over
+const WebhookLease = 5 * time.Minute
+
+// ErrWebhookEventClaimed is returned for an event that another delivery is processing
+var ErrWebhookEventClaimed = errors.New("webhook event is being processed")
+
+// InsertWebhookEvent stores a raw webhook event and claims it for processing. It
+// returns false without error when an event with the same event id has already been
+// processed successfully, so redelivered events are only dispatched again if the
+// earlier attempt failed. An event another delivery claimed less than WebhookLease
+// ago, and has not finished, returns ErrWebhookEventClaimed.
+func (m *DBModel) InsertWebhookEvent(e WebhookEvent) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	query := `
+		INSERT INTO webhook_events (event_id, event_type, payload, claimed_at, created_at)
+		VALUES ($1, $2, $3, $4, $4)
+		ON CONFLICT (event_id) DO UPDATE SET processed_at = NULL, error = '', claimed_at = $4
+		WHERE (webhook_events.processed_at IS NOT NULL AND webhook_events.error <> '')
+			OR (webhook_events.processed_at IS NULL AND webhook_events.claimed_at < $5)
+		RETURNING id
+	`
+
+	var id int
+	err := m.DB.QueryRowContext(ctx, query, e.EventID, e.EventType, e.Payload, now, now.Add(-WebhookLease)).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		var processed bool
+		err = m.DB.QueryRowContext(ctx, `
+			SELECT processed_at IS NOT NULL FROM webhook_events WHERE event_id = $1
+		`, e.EventID).Scan(&processed)
+		if err != nil {
+			return false, err
+		}
+		if !processed {
+			return false, ErrWebhookEventClaimed
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// MarkWebhookEventProcessed records the outcome of dispatching a webhook event
+func (m *DBModel) MarkWebhookEventProcessed(eventID, errMsg string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE webhook_events SET processed_at = $1, error = $2 WHERE event_id = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), errMsg, eventID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateOrderStatusByPaymentIntent moves every order paid through the given payment
+// intent or subscription id to another status. Orders whose lifecycle does not allow
+// the change keep their status, and ErrInvalidTransition is returned once the others
+// have moved.
+func (m *DBModel) UpdateOrderStatusByPaymentIntent(pi string, to OrderStatus, c StatusChange) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var invalid error
+	err := m.WithTx(ctx, func(tx *DBModel) error {
+		rows, err := tx.DB.QueryContext(ctx, `
+			SELECT o.id FROM orders o JOIN transactions t ON (o.transaction_id = t.id)
+			WHERE t.payment_intent = $1
+			ORDER BY o.id
+		`, pi)
+		if err != nil {
+			return err
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return err
+			}
+			ids = append(ids, id)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			err := tx.moveOrder(ctx, id, to, c)
+			if errors.Is(err, ErrInvalidTransition) {
+				invalid = fmt.Errorf("order %d: %w", id, err)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return invalid
+}
+
+// UpdateTransactionStatusByPaymentIntent updates the status of the transactions for
+// the given payment intent or subscription id
+func (m *DBModel) UpdateTransactionStatusByPaymentIntent(pi string, statusID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	stmt := `UPDATE transactions SET transaction_status_id = $1, updated_at = $2 WHERE payment_intent = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, statusID, time.Now(), pi)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package netutil
+
+import (
+	"net"
+	"net/http"
+)
+
+// ClientIP returns the address of the client that sent the request, without its port
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -2,6 +2,8 @@ package urlsigner
 
 import (
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -43,3 +45,30 @@ func (s *Signer) Expired(token string, ttl int) bool {
 
 	return time.Since(ts.Timestamp) > time.Duration(ttl)*time.Minute
 }
+
+// GenerateExpiringToken signs data with an expires parameter, so the link stops
+// working at expires rather than after a fixed time
+func (s *Signer) GenerateExpiringToken(data string, expires time.Time) string {
+	sep := "?"
+	if strings.Contains(data, "?") {
+		sep = "&"
+	}
+	return s.GenerateTokenFromString(fmt.Sprintf("%s%sexpires=%d", data, sep, expires.Unix()))
+}
+
+// ValidUntilExpiry reports whether a token made by GenerateExpiringToken is genuine
+// and has not expired
+func (s *Signer) ValidUntilExpiry(token string) bool {
+	if !s.VerifyToken(token) {
+		return false
+	}
+	u, err := url.Parse(token)
+	if err != nil {
+		return false
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Now().Before(time.Unix(expires, 0))
+}